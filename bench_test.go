@@ -0,0 +1,293 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// benchInput is an input that the benchmarks are run against, where the match is placed at the end so that the entire
+// input is scanned.
+type benchInput struct {
+	name    string
+	pattern string
+	text    string
+}
+
+// benchInputs returns ASCII and Unicode inputs in small and large sizes.
+func benchInputs() []benchInput {
+	var inputs []benchInput
+	for _, size := range []struct {
+		name    string
+		repeats int
+	}{{"Small", 4}, {"Large", 4096}} {
+		inputs = append(inputs,
+			benchInput{
+				name:    "ASCII" + size.name,
+				pattern: `[a-z]+@[a-z]+\.com`,
+				text:    strings.Repeat("the quick brown fox ", size.repeats) + "someone@example.com",
+			},
+			benchInput{
+				name:    "Unicode" + size.name,
+				pattern: `\p{Han}+@\p{Han}+\.com`,
+				text:    strings.Repeat("\u00fcber schnelle F\u00fcchse \U0001F600 ", size.repeats) + "\u5c71\u7530@\u4f8b\u5b50.com",
+			},
+		)
+	}
+	return inputs
+}
+
+// newBenchRegex creates a Regex with the given pattern, failing the benchmark on error.
+func newBenchRegex(b *testing.B, ctx context.Context, bufferSize uint32, pattern string) Regex {
+	regex := CreateRegex(bufferSize)
+	if err := regex.SetRegexString(ctx, pattern, RegexFlags_None); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := regex.Close(); err != nil {
+			b.Fatal(err)
+		}
+	})
+	return regex
+}
+
+func BenchmarkCreateRegex(b *testing.B) {
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := CreateRegex(0).Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// Every Regex is held until the end, so that each one needs its own module, which shows the benefit of WarmPool.
+	// Recycling the runtime would discard the warmed modules partway through, so it is disabled here.
+	modulePool.mutex.Lock()
+	prevMaxFetch := modulePool.maxFetch
+	modulePool.mutex.Unlock()
+	SetPoolFetchMax(math.MaxUint64)
+	defer SetPoolFetchMax(prevMaxFetch)
+	for _, warm := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Burst/Warm=%t", warm), func(b *testing.B) {
+			const burst = 4
+			regexes := make([]Regex, burst)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// Idle modules left by earlier iterations (and other benchmarks) would otherwise be reused
+				modulePool.mutex.Lock()
+				modulePool.closeIdleModules(context.Background(), 0)
+				modulePool.mutex.Unlock()
+				if warm {
+					if err := WarmPool(burst); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+				for j := range regexes {
+					regexes[j] = CreateRegex(0)
+				}
+				b.StopTimer()
+				for _, regex := range regexes {
+					if err := regex.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	ctx := context.Background()
+	for _, input := range benchInputs()[:2] {
+		b.Run(input.name[:len(input.name)-len("Small")], func(b *testing.B) {
+			regex := newBenchRegex(b, ctx, 0, input.pattern)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := regex.SetRegexString(ctx, input.pattern, RegexFlags_None); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	ctx := context.Background()
+	for _, input := range benchInputs() {
+		// The string buffer avoids an allocation within the module whenever the match string fits
+		for _, bufferSize := range []uint32{0, 1024 * 1024} {
+			b.Run(fmt.Sprintf("%s/Buffer=%d", input.name, bufferSize), func(b *testing.B) {
+				regex := newBenchRegex(b, ctx, bufferSize, input.pattern)
+				b.SetBytes(int64(len(input.text)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := regex.SetMatchString(ctx, input.text); err != nil {
+						b.Fatal(err)
+					}
+					if ok, err := regex.Matches(ctx, 0, 0); err != nil || !ok {
+						b.Fatal(ok, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMatchExists(b *testing.B) {
+	ctx := context.Background()
+	// Every word is captured while the matcher tries to find an address, so the groups are updated at each position
+	pattern := `((\w+)[.-])*(\w+)@((\w+)\.)+(com|org|net)`
+	text := strings.Repeat("first.last-name example.dom ", 256) + "some.one@mail.example.com"
+	for _, variant := range []struct {
+		name    string
+		compile func(pattern string, flags RegexFlags) (Regex, error)
+	}{{"Groups", CompileFrom}, {"Exists", CompileExists}} {
+		b.Run(variant.name, func(b *testing.B) {
+			regex, err := variant.compile(pattern, RegexFlags_None)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() {
+				if err := regex.Close(); err != nil {
+					b.Fatal(err)
+				}
+			})
+			if err = regex.SetMatchString(ctx, text); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(text)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ok, err := regex.Matches(ctx, 0, 0); err != nil || !ok {
+					b.Fatal(ok, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLexerTokenize(b *testing.B) {
+	ctx := context.Background()
+	lexer, err := NewLexer(ctx, []NamedPattern{
+		{Name: "number", Pattern: `\d+`},
+		{Name: "operator", Pattern: `[-+*/]`},
+		{Name: "string", Pattern: `"[^"]*"`},
+	}, LexerMode_Longest_Match)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := lexer.Close(); err != nil {
+			b.Fatal(err)
+		}
+	})
+	// The string pattern never matches, which would rescan the rest of the input at every token without caching
+	for _, size := range []int{2 * 1024, 32 * 1024} {
+		input := strings.Repeat("1+", size/2)
+		b.Run(fmt.Sprintf("Size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// Forgetting the input ensures that every iteration begins without any cached matches
+				lexer.inputSet = false
+				if _, err := lexer.Tokenize(ctx, input); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatchBatch(b *testing.B) {
+	ctx := context.Background()
+	for _, input := range benchInputs() {
+		b.Run(input.name, func(b *testing.B) {
+			regex := newBenchRegex(b, ctx, 1024*1024, input.pattern)
+			// Every line is checked, as when filtering the rows of a table
+			lines := strings.SplitAfter(input.text, " ")
+			b.SetBytes(int64(len(input.text)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, line := range lines {
+					if err := regex.SetMatchString(ctx, line); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := regex.Matches(ctx, 0, 0); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReplaceAll(b *testing.B) {
+	ctx := context.Background()
+	for _, input := range benchInputs() {
+		b.Run(input.name, func(b *testing.B) {
+			regex := newBenchRegex(b, ctx, 1024*1024, `\s+`)
+			if err := regex.SetMatchString(ctx, input.text); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(input.text)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := regex.Replace(ctx, "_", 1, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatchConcurrent(b *testing.B) {
+	ctx := context.Background()
+	for _, input := range benchInputs() {
+		b.Run(input.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input.text)))
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine needs its own Regex, as a Regex may not be used concurrently
+				regex := CreateRegex(1024 * 1024)
+				defer regex.Close()
+				if err := regex.SetRegexString(ctx, input.pattern, RegexFlags_None); err != nil {
+					b.Error(err)
+					return
+				}
+				for pb.Next() {
+					if err := regex.SetMatchString(ctx, input.text); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := regex.Matches(ctx, 0, 0); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,512 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// ErrEngineClosed is returned when attempting to use a SerializedEngine, or a Regex created from one, after the engine
+// has been closed.
+var ErrEngineClosed = errors.NewKind("the serialized engine has been closed")
+
+// SerializedEngine creates Regex objects that all share a single runtime and module. As modules may not be used by
+// multiple goroutines at once, every operation is executed by a single worker goroutine that owns the module. This
+// trades throughput for a drastically lower memory footprint, as only one runtime exists regardless of how many Regex
+// objects are created, which makes it suitable for memory-constrained environments. The Regex objects created by the
+// engine may be used from any goroutine, however each one must still be closed before the engine is closed.
+type SerializedEngine struct {
+	r         wazero.Runtime
+	mod       api.Module
+	requests  chan func()
+	stopping  chan struct{}
+	stopped   chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewSerializedEngine creates a new *SerializedEngine, along with its runtime, module, and worker goroutine. The
+// engine must be closed once it is no longer needed. The engine's module counts toward the global memory limit, and
+// this panics if the limit would be exceeded.
+func NewSerializedEngine() *SerializedEngine {
+	ctx := context.Background()
+	r, compiled := createRuntime(ctx)
+	mod, err := instantiateModule(ctx, r, compiled)
+	if err != nil {
+		_ = r.Close(ctx)
+		panic(err)
+	}
+	engine := &SerializedEngine{
+		r:         r,
+		mod:       mod,
+		requests:  make(chan func()),
+		stopping:  make(chan struct{}),
+		stopped:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go engine.work()
+	return engine
+}
+
+// CreateRegex creates a Regex that is backed by the engine's module. The string buffer behaves the same as the one
+// described in the package-level CreateRegex, as are the options. Returns ErrEngineClosed if the engine has been closed.
+func (engine *SerializedEngine) CreateRegex(stringBufferInBytes uint32, opts ...RegexOption) (Regex, error) {
+	var pr *privateRegex
+	err := engine.do(func() {
+		// Modules are not returned to a pool, as the engine owns its only module
+		pr = newPrivateRegex(engine.mod, stringBufferInBytes, func(api.Module) {}, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serializedRegex{engine: engine, pr: pr}, nil
+}
+
+// Close stops the worker goroutine, and closes the module and runtime. All Regex objects created by the engine should
+// be closed beforehand, as they are unusable afterward.
+func (engine *SerializedEngine) Close() (err error) {
+	engine.closeOnce.Do(func() {
+		close(engine.stopping)
+		<-engine.stopped
+		ctx := context.Background()
+		err = closeModule(ctx, engine.mod)
+		if rErr := engine.r.Close(ctx); err == nil {
+			err = rErr
+		}
+	})
+	return err
+}
+
+// work is the worker loop that executes every request, and is the only goroutine that touches the module.
+func (engine *SerializedEngine) work() {
+	for {
+		select {
+		case request := <-engine.requests:
+			request()
+		case <-engine.stopping:
+			close(engine.stopped)
+			return
+		}
+	}
+}
+
+// do executes the given function on the worker goroutine, and waits for it to complete. If the function panics, then
+// the panic is recovered on the worker goroutine (which continues to serve other requests), and raised again on the
+// calling goroutine.
+func (engine *SerializedEngine) do(f func()) error {
+	finished := make(chan struct{})
+	var panicked any
+	request := func() {
+		defer close(finished)
+		defer func() { panicked = recover() }()
+		f()
+	}
+	select {
+	case engine.requests <- request:
+		<-finished
+		if panicked != nil {
+			panic(panicked)
+		}
+		return nil
+	case <-engine.stopped:
+		return ErrEngineClosed.New()
+	}
+}
+
+// serializedRegex is a Regex that forwards all calls to a *privateRegex through the worker goroutine of its engine.
+type serializedRegex struct {
+	engine *SerializedEngine
+	pr     *privateRegex
+}
+
+var _ Regex = (*serializedRegex)(nil)
+var _ GroupIndexer = (*serializedRegex)(nil)
+
+// SetRegexString implements the interface Regex.
+func (sr *serializedRegex) SetRegexString(ctx context.Context, regexStr string, flags RegexFlags) (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.SetRegexString(ctx, regexStr, flags) }); dErr != nil {
+		return dErr
+	}
+	return err
+}
+
+// SetMatchString implements the interface Regex.
+func (sr *serializedRegex) SetMatchString(ctx context.Context, matchStr string) (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.SetMatchString(ctx, matchStr) }); dErr != nil {
+		return dErr
+	}
+	return err
+}
+
+// SetMatchUText implements the interface Regex. The chunks are read on the calling goroutine, so that a slow provider
+// does not hold up the worker goroutine, which only sets the flattened match string.
+func (sr *serializedRegex) SetMatchUText(ctx context.Context, provider ChunkProvider) error {
+	matchStr, err := readChunks(provider)
+	if err != nil {
+		return err
+	}
+	return sr.SetMatchString(ctx, matchStr)
+}
+
+// GroupIndexAcrossMatches implements the interface GroupIndexer.
+func (sr *serializedRegex) GroupIndexAcrossMatches(ctx context.Context, group int, occurrence int, endIndex bool) (idx int, err error) {
+	if dErr := sr.engine.do(func() { idx, err = sr.pr.GroupIndexAcrossMatches(ctx, group, occurrence, endIndex) }); dErr != nil {
+		return 0, dErr
+	}
+	return idx, err
+}
+
+// RefreshText implements the interface Regex.
+func (sr *serializedRegex) RefreshText(ctx context.Context, text string) (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.RefreshText(ctx, text) }); dErr != nil {
+		return dErr
+	}
+	return err
+}
+
+// SetRegion implements the interface Regex.
+func (sr *serializedRegex) SetRegion(ctx context.Context, start int, end int) (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.SetRegion(ctx, start, end) }); dErr != nil {
+		return dErr
+	}
+	return err
+}
+
+// SetRegionBytes implements the interface Regex.
+func (sr *serializedRegex) SetRegionBytes(ctx context.Context, fromByte int, toByte int) (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.SetRegionBytes(ctx, fromByte, toByte) }); dErr != nil {
+		return dErr
+	}
+	return err
+}
+
+// RegionBytes implements the interface Regex.
+func (sr *serializedRegex) RegionBytes() (from int, to int, err error) {
+	if dErr := sr.engine.do(func() { from, to, err = sr.pr.RegionBytes() }); dErr != nil {
+		return 0, 0, dErr
+	}
+	return from, to, err
+}
+
+// Region implements the interface Regex.
+func (sr *serializedRegex) Region(ctx context.Context) (start int, end int, err error) {
+	if dErr := sr.engine.do(func() { start, end, err = sr.pr.Region(ctx) }); dErr != nil {
+		return 0, 0, dErr
+	}
+	return start, end, err
+}
+
+// SetMaxScanLength implements the interface Regex.
+func (sr *serializedRegex) SetMaxScanLength(n int) {
+	_ = sr.engine.do(func() { sr.pr.SetMaxScanLength(n) })
+}
+
+// Matches implements the interface Regex.
+func (sr *serializedRegex) Matches(ctx context.Context, start int, occurrence int) (ok bool, err error) {
+	if dErr := sr.engine.do(func() { ok, err = sr.pr.Matches(ctx, start, occurrence) }); dErr != nil {
+		return false, dErr
+	}
+	return ok, err
+}
+
+// MatchesWithFlags implements the interface Regex.
+func (sr *serializedRegex) MatchesWithFlags(ctx context.Context, input string, flags RegexFlags) (ok bool, err error) {
+	if dErr := sr.engine.do(func() { ok, err = sr.pr.MatchesWithFlags(ctx, input, flags) }); dErr != nil {
+		return false, dErr
+	}
+	return ok, err
+}
+
+// MatchesInRegions implements the interface Regex.
+func (sr *serializedRegex) MatchesInRegions(ctx context.Context, regions [][2]int) (results []bool, err error) {
+	if dErr := sr.engine.do(func() { results, err = sr.pr.MatchesInRegions(ctx, regions) }); dErr != nil {
+		return nil, dErr
+	}
+	return results, err
+}
+
+// IsStartAnchored implements the interface Regex.
+func (sr *serializedRegex) IsStartAnchored(ctx context.Context) (anchored bool, err error) {
+	if dErr := sr.engine.do(func() { anchored, err = sr.pr.IsStartAnchored(ctx) }); dErr != nil {
+		return false, dErr
+	}
+	return anchored, err
+}
+
+// Replace implements the interface Regex.
+func (sr *serializedRegex) Replace(ctx context.Context, replacementStr string, position int, occurrence int) (replacedStr string, err error) {
+	if dErr := sr.engine.do(func() { replacedStr, err = sr.pr.Replace(ctx, replacementStr, position, occurrence) }); dErr != nil {
+		return "", dErr
+	}
+	return replacedStr, err
+}
+
+// ReplaceAllString implements the interface Regex.
+func (sr *serializedRegex) ReplaceAllString(ctx context.Context, replacementStr string) (result string, replaced bool, err error) {
+	if dErr := sr.engine.do(func() { result, replaced, err = sr.pr.ReplaceAllString(ctx, replacementStr) }); dErr != nil {
+		return "", false, dErr
+	}
+	return result, replaced, err
+}
+
+// ReplaceAllSizeDelta implements the interface Regex.
+func (sr *serializedRegex) ReplaceAllSizeDelta(ctx context.Context, replacementStr string) (deltaBytes int, matches int, err error) {
+	if dErr := sr.engine.do(func() { deltaBytes, matches, err = sr.pr.ReplaceAllSizeDelta(ctx, replacementStr) }); dErr != nil {
+		return 0, 0, dErr
+	}
+	return deltaBytes, matches, err
+}
+
+// Partition implements the interface Regex.
+func (sr *serializedRegex) Partition(ctx context.Context, start int, occurrence int) (before string, match string, after string, ok bool, err error) {
+	if dErr := sr.engine.do(func() { before, match, after, ok, err = sr.pr.Partition(ctx, start, occurrence) }); dErr != nil {
+		return "", "", "", false, dErr
+	}
+	return before, match, after, ok, err
+}
+
+// GroupTree implements the interface Regex.
+func (sr *serializedRegex) GroupTree(ctx context.Context, start int, occurrence int) (root *GroupNode, ok bool, err error) {
+	if dErr := sr.engine.do(func() { root, ok, err = sr.pr.GroupTree(ctx, start, occurrence) }); dErr != nil {
+		return nil, false, dErr
+	}
+	return root, ok, err
+}
+
+// NamedGroupsOrdered implements the interface Regex.
+func (sr *serializedRegex) NamedGroupsOrdered(ctx context.Context, start int, occurrence int) (groups []NamedGroup, ok bool, err error) {
+	if dErr := sr.engine.do(func() { groups, ok, err = sr.pr.NamedGroupsOrdered(ctx, start, occurrence) }); dErr != nil {
+		return nil, false, dErr
+	}
+	return groups, ok, err
+}
+
+// SubstringFrom implements the interface Regex.
+func (sr *serializedRegex) SubstringFrom(ctx context.Context, start int, occurrence int) (text string, endPos int, ok bool, err error) {
+	if dErr := sr.engine.do(func() { text, endPos, ok, err = sr.pr.SubstringFrom(ctx, start, occurrence) }); dErr != nil {
+		return "", 0, false, dErr
+	}
+	return text, endPos, ok, err
+}
+
+// SubstringGrapheme implements the interface Regex.
+func (sr *serializedRegex) SubstringGrapheme(ctx context.Context, start int, occurrence int) (substring string, ok bool, err error) {
+	if dErr := sr.engine.do(func() { substring, ok, err = sr.pr.SubstringGrapheme(ctx, start, occurrence) }); dErr != nil {
+		return "", false, dErr
+	}
+	return substring, ok, err
+}
+
+// ReplaceAllWithSpans implements the interface Regex.
+func (sr *serializedRegex) ReplaceAllWithSpans(ctx context.Context, replacementStr string) (result string, originalSpans []MatchBounds, err error) {
+	if dErr := sr.engine.do(func() { result, originalSpans, err = sr.pr.ReplaceAllWithSpans(ctx, replacementStr) }); dErr != nil {
+		return "", nil, dErr
+	}
+	return result, originalSpans, err
+}
+
+// FindAllString implements the interface Regex.
+func (sr *serializedRegex) FindAllString(ctx context.Context, start int, limit int) (results []string, err error) {
+	if dErr := sr.engine.do(func() { results, err = sr.pr.FindAllString(ctx, start, limit) }); dErr != nil {
+		return nil, dErr
+	}
+	return results, err
+}
+
+// FindAllRuneBounds implements the interface Regex.
+func (sr *serializedRegex) FindAllRuneBounds(ctx context.Context, start int, limit int) (results []MatchBounds, err error) {
+	if dErr := sr.engine.do(func() { results, err = sr.pr.FindAllRuneBounds(ctx, start, limit) }); dErr != nil {
+		return nil, dErr
+	}
+	return results, err
+}
+
+// MatchReaderAll implements the interface Regex. The reader is read on the calling goroutine, so that a slow reader
+// does not hold up the worker goroutine, which only matches each window.
+func (sr *serializedRegex) MatchReaderAll(ctx context.Context, r io.Reader, window int, overlap int) ([]MatchBounds, error) {
+	return matchReaderAll(r, window, overlap, func(text string, eof bool, carryStart int) (matches []MatchBounds, err error) {
+		if dErr := sr.engine.do(func() { matches, err = sr.pr.matchWindow(ctx, text, eof, carryStart) }); dErr != nil {
+			return nil, dErr
+		}
+		return matches, err
+	})
+}
+
+// AllGroup implements the interface Regex.
+func (sr *serializedRegex) AllGroup(ctx context.Context, group int, limit int) (results []string, err error) {
+	if dErr := sr.engine.do(func() { results, err = sr.pr.AllGroup(ctx, group, limit) }); dErr != nil {
+		return nil, dErr
+	}
+	return results, err
+}
+
+// AllGroupParticipating implements the interface Regex.
+func (sr *serializedRegex) AllGroupParticipating(ctx context.Context, group int, limit int) (results []string, err error) {
+	if dErr := sr.engine.do(func() { results, err = sr.pr.AllGroupParticipating(ctx, group, limit) }); dErr != nil {
+		return nil, dErr
+	}
+	return results, err
+}
+
+// FindAllSubmatchColumnar implements the interface Regex.
+func (sr *serializedRegex) FindAllSubmatchColumnar(ctx context.Context, start int, limit int) (matchStarts []int, matchEnds []int, groups [][]string, err error) {
+	if dErr := sr.engine.do(func() { matchStarts, matchEnds, groups, err = sr.pr.FindAllSubmatchColumnar(ctx, start, limit) }); dErr != nil {
+		return nil, nil, nil, dErr
+	}
+	return matchStarts, matchEnds, groups, err
+}
+
+// FindLazy implements the interface Regex.
+func (sr *serializedRegex) FindLazy(ctx context.Context, start int) (match *LazyMatch, ok bool, err error) {
+	if dErr := sr.engine.do(func() { match, ok, err = sr.pr.FindLazy(ctx, start) }); dErr != nil {
+		return nil, false, dErr
+	}
+	if match != nil {
+		// The text is read from the module, so that must also happen on the worker goroutine
+		read := match.read
+		match.read = func(startIdx int, endIdx int) (str string, ok bool) {
+			if dErr := sr.engine.do(func() { str, ok = read(startIdx, endIdx) }); dErr != nil {
+				return "", false
+			}
+			return str, ok
+		}
+	}
+	return match, ok, err
+}
+
+// FindFrom implements the interface Regex.
+func (sr *serializedRegex) FindFrom(ctx context.Context, pos int) (bounds MatchBounds, ok bool, err error) {
+	if dErr := sr.engine.do(func() { bounds, ok, err = sr.pr.FindFrom(ctx, pos) }); dErr != nil {
+		return MatchBounds{}, false, dErr
+	}
+	return bounds, ok, err
+}
+
+// LongestPrefixMatch implements the interface Regex.
+func (sr *serializedRegex) LongestPrefixMatch(ctx context.Context) (length int, err error) {
+	if dErr := sr.engine.do(func() { length, err = sr.pr.LongestPrefixMatch(ctx) }); dErr != nil {
+		return 0, dErr
+	}
+	return length, err
+}
+
+// ExplainNonMatch implements the interface Regex.
+func (sr *serializedRegex) ExplainNonMatch(ctx context.Context) (explanation string, err error) {
+	if dErr := sr.engine.do(func() { explanation, err = sr.pr.ExplainNonMatch(ctx) }); dErr != nil {
+		return "", dErr
+	}
+	return explanation, err
+}
+
+// GroupCount implements the interface Regex.
+func (sr *serializedRegex) GroupCount() (count int, err error) {
+	if dErr := sr.engine.do(func() { count, err = sr.pr.GroupCount() }); dErr != nil {
+		return 0, dErr
+	}
+	return count, err
+}
+
+// NumSubexp implements the interface Regex.
+func (sr *serializedRegex) NumSubexp() (count int) {
+	_ = sr.engine.do(func() { count = sr.pr.NumSubexp() })
+	return count
+}
+
+// SubexpNames implements the interface Regex.
+func (sr *serializedRegex) SubexpNames() (names []string) {
+	_ = sr.engine.do(func() { names = sr.pr.SubexpNames() })
+	return names
+}
+
+// NamedGroupCount implements the interface Regex.
+func (sr *serializedRegex) NamedGroupCount(ctx context.Context) (count int, err error) {
+	if dErr := sr.engine.do(func() { count, err = sr.pr.NamedGroupCount(ctx) }); dErr != nil {
+		return 0, dErr
+	}
+	return count, err
+}
+
+// ValidateReplacement implements the interface Regex.
+func (sr *serializedRegex) ValidateReplacement(ctx context.Context, replacementStr string) (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.ValidateReplacement(ctx, replacementStr) }); dErr != nil {
+		return dErr
+	}
+	return err
+}
+
+// Pattern implements the interface Regex.
+func (sr *serializedRegex) Pattern() (pattern string, flags RegexFlags, err error) {
+	if dErr := sr.engine.do(func() { pattern, flags, err = sr.pr.Pattern() }); dErr != nil {
+		return "", RegexFlags_None, dErr
+	}
+	return pattern, flags, err
+}
+
+// MatchWithContext implements the interface Regex.
+func (sr *serializedRegex) MatchWithContext(ctx context.Context, start int, occurrence int, contextLines int) (result ContextResult, ok bool, err error) {
+	if dErr := sr.engine.do(func() { result, ok, err = sr.pr.MatchWithContext(ctx, start, occurrence, contextLines) }); dErr != nil {
+		return ContextResult{}, false, dErr
+	}
+	return result, ok, err
+}
+
+// Clone implements the interface Regex. The clone is created within the same engine.
+func (sr *serializedRegex) Clone(ctx context.Context) (clone Regex, err error) {
+	var pr *privateRegex
+	dErr := sr.engine.do(func() {
+		// Check for the regex pointer first
+		if sr.pr.regexPtr == 0 {
+			err = sr.pr.regexNotSetError()
+			return
+		}
+		pr, err = sr.pr.clone(ctx, sr.engine.mod, func(api.Module) {})
+	})
+	if dErr != nil {
+		return nil, dErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &serializedRegex{engine: sr.engine, pr: pr}, nil
+}
+
+// AsStdlib implements the interface Regex.
+func (sr *serializedRegex) AsStdlib(ctx context.Context) StdlibCompat {
+	return StdlibCompat{regex: sr, ctx: ctx}
+}
+
+// StringBufferSize implements the interface Regex.
+func (sr *serializedRegex) StringBufferSize() uint32 {
+	return sr.pr.StringBufferSize()
+}
+
+// Close implements the interface Regex.
+func (sr *serializedRegex) Close() (err error) {
+	if dErr := sr.engine.do(func() { err = sr.pr.Close() }); dErr != nil {
+		// The engine's module is already gone, so there's nothing left to free. We only need to make sure that the
+		// finalizer does not complain about this regex.
+		sr.pr.mod = nil
+		sr.pr.closed = true
+		runtime.SetFinalizer(sr.pr, nil)
+		return dErr
+	}
+	return err
+}
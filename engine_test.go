@@ -0,0 +1,160 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerializedEngine(t *testing.T) {
+	ctx := context.Background()
+	engine := NewSerializedEngine()
+
+	const numGoroutines = 32
+	errs := make(chan error, numGoroutines)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- func() error {
+				regex, err := engine.CreateRegex(64)
+				if err != nil {
+					return err
+				}
+				defer regex.Close()
+				// Every regex must be backed by the engine's only module
+				if regex.(*serializedRegex).pr.mod != engine.mod {
+					return fmt.Errorf("regex %d is not using the engine's module", i)
+				}
+				if err = regex.SetRegexString(ctx, fmt.Sprintf(`n%d\b`, i), RegexFlags_None); err != nil {
+					return err
+				}
+				for j := 0; j < numGoroutines; j++ {
+					if err = regex.SetMatchString(ctx, fmt.Sprintf("value n%d here", j)); err != nil {
+						return err
+					}
+					ok, err := regex.Matches(ctx, 0, 0)
+					if err != nil {
+						return err
+					}
+					if ok != (i == j) {
+						return fmt.Errorf("regex %d returned %v when matching against %d", i, ok, j)
+					}
+				}
+				replaced, err := regex.Replace(ctx, "X", 1, 0)
+				if err != nil {
+					return err
+				}
+				if expected := fmt.Sprintf("value n%d here", numGoroutines-1); i != numGoroutines-1 && replaced != expected {
+					return fmt.Errorf("regex %d replaced to %q", i, replaced)
+				}
+				return nil
+			}()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	regex, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	require.NoError(t, engine.Close())
+	require.True(t, ErrEngineClosed.Is(regex.SetRegexString(ctx, `abc`, RegexFlags_None)))
+	require.True(t, ErrEngineClosed.Is(regex.Close()))
+	_, err = engine.CreateRegex(0)
+	require.True(t, ErrEngineClosed.Is(err))
+	require.NoError(t, engine.Close())
+}
+
+func TestSerializedEnginePanic(t *testing.T) {
+	ctx := context.Background()
+	engine := NewSerializedEngine()
+	defer engine.Close()
+
+	// The panic is raised on the calling goroutine, while the worker continues to serve requests
+	require.PanicsWithValue(t, "request failed", func() {
+		_ = engine.do(func() { panic("request failed") })
+	})
+	regex, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	defer regex.Close()
+	require.NoError(t, regex.SetRegexString(ctx, `a`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "cat"))
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+// blockingReader is an io.Reader that waits until it is released before reading from its text.
+type blockingReader struct {
+	reading chan struct{}
+	release chan struct{}
+	r       io.Reader
+}
+
+// Read implements the interface io.Reader.
+func (br *blockingReader) Read(p []byte) (int, error) {
+	if br.reading != nil {
+		close(br.reading)
+		br.reading = nil
+		<-br.release
+	}
+	return br.r.Read(p)
+}
+
+func TestSerializedEngineSlowReader(t *testing.T) {
+	ctx := context.Background()
+	engine := NewSerializedEngine()
+	defer engine.Close()
+
+	slow, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	defer slow.Close()
+	require.NoError(t, slow.SetRegexString(ctx, `b+`, RegexFlags_None))
+	reader := &blockingReader{reading: make(chan struct{}), release: make(chan struct{}), r: strings.NewReader("abba abbba")}
+	var bounds []MatchBounds
+	var readErr error
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		bounds, readErr = slow.MatchReaderAll(ctx, reader, 4, 2)
+	}()
+
+	// Other regexes on the engine continue to work while the reader is blocked
+	<-reader.reading
+	regex, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	defer regex.Close()
+	require.NoError(t, regex.SetRegexString(ctx, `a`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "cat"))
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	close(reader.release)
+	<-finished
+	require.NoError(t, readErr)
+	require.Equal(t, []MatchBounds{{2, 4}, {7, 10}}, bounds)
+}
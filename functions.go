@@ -16,7 +16,10 @@ package regex
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+
+	"github.com/tetratelabs/wazero/sys"
 )
 
 type URegularExpressionPtr uint32
@@ -24,6 +27,177 @@ type UCharPtr uint32
 type UErrorCode int32
 type CharPtr int32
 
+// abortExitCode is the exit code of the module when it calls abort, which the C++ standard library does when an
+// allocation fails, as the module is built without exceptions.
+const abortExitCode = 1
+
+// These are the UErrorCode values that ICU may return. Warnings are negative, errors are positive, and U_ZERO_ERROR
+// indicates success. All values were taken directly from ICU.
+const (
+	U_USING_FALLBACK_WARNING        UErrorCode = -128
+	U_USING_DEFAULT_WARNING         UErrorCode = -127
+	U_SAFECLONE_ALLOCATED_WARNING   UErrorCode = -126
+	U_STATE_OLD_WARNING             UErrorCode = -125
+	U_STRING_NOT_TERMINATED_WARNING UErrorCode = -124
+	U_SORT_KEY_TOO_SHORT_WARNING    UErrorCode = -123
+	U_AMBIGUOUS_ALIAS_WARNING       UErrorCode = -122
+	U_DIFFERENT_UCA_VERSION         UErrorCode = -121
+	U_PLUGIN_CHANGED_LEVEL_WARNING  UErrorCode = -120
+
+	U_ZERO_ERROR              UErrorCode = 0
+	U_ILLEGAL_ARGUMENT_ERROR  UErrorCode = 1
+	U_MISSING_RESOURCE_ERROR  UErrorCode = 2
+	U_INVALID_FORMAT_ERROR    UErrorCode = 3
+	U_FILE_ACCESS_ERROR       UErrorCode = 4
+	U_INTERNAL_PROGRAM_ERROR  UErrorCode = 5
+	U_MESSAGE_PARSE_ERROR     UErrorCode = 6
+	U_MEMORY_ALLOCATION_ERROR UErrorCode = 7
+	U_INDEX_OUTOFBOUNDS_ERROR UErrorCode = 8
+	U_PARSE_ERROR             UErrorCode = 9
+	U_INVALID_CHAR_FOUND      UErrorCode = 10
+	U_TRUNCATED_CHAR_FOUND    UErrorCode = 11
+	U_ILLEGAL_CHAR_FOUND      UErrorCode = 12
+	U_INVALID_TABLE_FORMAT    UErrorCode = 13
+	U_INVALID_TABLE_FILE      UErrorCode = 14
+	U_BUFFER_OVERFLOW_ERROR   UErrorCode = 15
+	U_UNSUPPORTED_ERROR       UErrorCode = 16
+
+	U_REGEX_INTERNAL_ERROR             UErrorCode = 0x10300
+	U_REGEX_RULE_SYNTAX                UErrorCode = 0x10301
+	U_REGEX_INVALID_STATE              UErrorCode = 0x10302
+	U_REGEX_BAD_ESCAPE_SEQUENCE        UErrorCode = 0x10303
+	U_REGEX_PROPERTY_SYNTAX            UErrorCode = 0x10304
+	U_REGEX_UNIMPLEMENTED              UErrorCode = 0x10305
+	U_REGEX_MISMATCHED_PAREN           UErrorCode = 0x10306
+	U_REGEX_NUMBER_TOO_BIG             UErrorCode = 0x10307
+	U_REGEX_BAD_INTERVAL               UErrorCode = 0x10308
+	U_REGEX_MAX_LT_MIN                 UErrorCode = 0x10309
+	U_REGEX_INVALID_BACK_REF           UErrorCode = 0x1030A
+	U_REGEX_INVALID_FLAG               UErrorCode = 0x1030B
+	U_REGEX_LOOK_BEHIND_LIMIT          UErrorCode = 0x1030C
+	U_REGEX_SET_CONTAINS_STRING        UErrorCode = 0x1030D
+	U_REGEX_MISSING_CLOSE_BRACKET      UErrorCode = 0x1030F
+	U_REGEX_INVALID_RANGE              UErrorCode = 0x10310
+	U_REGEX_STACK_OVERFLOW             UErrorCode = 0x10311
+	U_REGEX_TIME_OUT                   UErrorCode = 0x10312
+	U_REGEX_STOPPED_BY_CALLER          UErrorCode = 0x10313
+	U_REGEX_PATTERN_TOO_BIG            UErrorCode = 0x10314
+	U_REGEX_INVALID_CAPTURE_GROUP_NAME UErrorCode = 0x10315
+)
+
+// String returns the name of the code, which matches the name returned from ICU's u_errorName function.
+func (code UErrorCode) String() string {
+	switch code {
+	case U_USING_FALLBACK_WARNING:
+		return "U_USING_FALLBACK_WARNING"
+	case U_USING_DEFAULT_WARNING:
+		return "U_USING_DEFAULT_WARNING"
+	case U_SAFECLONE_ALLOCATED_WARNING:
+		return "U_SAFECLONE_ALLOCATED_WARNING"
+	case U_STATE_OLD_WARNING:
+		return "U_STATE_OLD_WARNING"
+	case U_STRING_NOT_TERMINATED_WARNING:
+		return "U_STRING_NOT_TERMINATED_WARNING"
+	case U_SORT_KEY_TOO_SHORT_WARNING:
+		return "U_SORT_KEY_TOO_SHORT_WARNING"
+	case U_AMBIGUOUS_ALIAS_WARNING:
+		return "U_AMBIGUOUS_ALIAS_WARNING"
+	case U_DIFFERENT_UCA_VERSION:
+		return "U_DIFFERENT_UCA_VERSION"
+	case U_PLUGIN_CHANGED_LEVEL_WARNING:
+		return "U_PLUGIN_CHANGED_LEVEL_WARNING"
+	case U_ZERO_ERROR:
+		return "U_ZERO_ERROR"
+	case U_ILLEGAL_ARGUMENT_ERROR:
+		return "U_ILLEGAL_ARGUMENT_ERROR"
+	case U_MISSING_RESOURCE_ERROR:
+		return "U_MISSING_RESOURCE_ERROR"
+	case U_INVALID_FORMAT_ERROR:
+		return "U_INVALID_FORMAT_ERROR"
+	case U_FILE_ACCESS_ERROR:
+		return "U_FILE_ACCESS_ERROR"
+	case U_INTERNAL_PROGRAM_ERROR:
+		return "U_INTERNAL_PROGRAM_ERROR"
+	case U_MESSAGE_PARSE_ERROR:
+		return "U_MESSAGE_PARSE_ERROR"
+	case U_MEMORY_ALLOCATION_ERROR:
+		return "U_MEMORY_ALLOCATION_ERROR"
+	case U_INDEX_OUTOFBOUNDS_ERROR:
+		return "U_INDEX_OUTOFBOUNDS_ERROR"
+	case U_PARSE_ERROR:
+		return "U_PARSE_ERROR"
+	case U_INVALID_CHAR_FOUND:
+		return "U_INVALID_CHAR_FOUND"
+	case U_TRUNCATED_CHAR_FOUND:
+		return "U_TRUNCATED_CHAR_FOUND"
+	case U_ILLEGAL_CHAR_FOUND:
+		return "U_ILLEGAL_CHAR_FOUND"
+	case U_INVALID_TABLE_FORMAT:
+		return "U_INVALID_TABLE_FORMAT"
+	case U_INVALID_TABLE_FILE:
+		return "U_INVALID_TABLE_FILE"
+	case U_BUFFER_OVERFLOW_ERROR:
+		return "U_BUFFER_OVERFLOW_ERROR"
+	case U_UNSUPPORTED_ERROR:
+		return "U_UNSUPPORTED_ERROR"
+	case U_REGEX_INTERNAL_ERROR:
+		return "U_REGEX_INTERNAL_ERROR"
+	case U_REGEX_RULE_SYNTAX:
+		return "U_REGEX_RULE_SYNTAX"
+	case U_REGEX_INVALID_STATE:
+		return "U_REGEX_INVALID_STATE"
+	case U_REGEX_BAD_ESCAPE_SEQUENCE:
+		return "U_REGEX_BAD_ESCAPE_SEQUENCE"
+	case U_REGEX_PROPERTY_SYNTAX:
+		return "U_REGEX_PROPERTY_SYNTAX"
+	case U_REGEX_UNIMPLEMENTED:
+		return "U_REGEX_UNIMPLEMENTED"
+	case U_REGEX_MISMATCHED_PAREN:
+		return "U_REGEX_MISMATCHED_PAREN"
+	case U_REGEX_NUMBER_TOO_BIG:
+		return "U_REGEX_NUMBER_TOO_BIG"
+	case U_REGEX_BAD_INTERVAL:
+		return "U_REGEX_BAD_INTERVAL"
+	case U_REGEX_MAX_LT_MIN:
+		return "U_REGEX_MAX_LT_MIN"
+	case U_REGEX_INVALID_BACK_REF:
+		return "U_REGEX_INVALID_BACK_REF"
+	case U_REGEX_INVALID_FLAG:
+		return "U_REGEX_INVALID_FLAG"
+	case U_REGEX_LOOK_BEHIND_LIMIT:
+		return "U_REGEX_LOOK_BEHIND_LIMIT"
+	case U_REGEX_SET_CONTAINS_STRING:
+		return "U_REGEX_SET_CONTAINS_STRING"
+	case U_REGEX_MISSING_CLOSE_BRACKET:
+		return "U_REGEX_MISSING_CLOSE_BRACKET"
+	case U_REGEX_INVALID_RANGE:
+		return "U_REGEX_INVALID_RANGE"
+	case U_REGEX_STACK_OVERFLOW:
+		return "U_REGEX_STACK_OVERFLOW"
+	case U_REGEX_TIME_OUT:
+		return "U_REGEX_TIME_OUT"
+	case U_REGEX_STOPPED_BY_CALLER:
+		return "U_REGEX_STOPPED_BY_CALLER"
+	case U_REGEX_PATTERN_TOO_BIG:
+		return "U_REGEX_PATTERN_TOO_BIG"
+	case U_REGEX_INVALID_CAPTURE_GROUP_NAME:
+		return "U_REGEX_INVALID_CAPTURE_GROUP_NAME"
+	default:
+		return "[BOGUS UErrorCode]"
+	}
+}
+
+// IsFailure returns whether the code represents an error. This mirrors ICU's U_FAILURE macro, so warnings (which are
+// negative) are not considered failures.
+func (code UErrorCode) IsFailure() bool {
+	return code > U_ZERO_ERROR
+}
+
+// IsWarning returns whether the code represents a warning. Warnings do not prevent an operation from succeeding.
+func (code UErrorCode) IsWarning() bool {
+	return code < U_ZERO_ERROR
+}
+
 // void* malloc(size_t size)
 func (pr *privateRegex) malloc(ctx context.Context, sz uint32) (uint32, error) {
 	pr.callStack[0] = uint64(sz)
@@ -58,27 +232,44 @@ func (pr *privateRegex) replace(ctx context.Context, regex URegularExpressionPtr
 	copy(pr.callStack[:], []uint64{uint64(regex), uint64(replacement), uint64(replacementLen), uint64(original), uint64(originalSize), uint64(start), uint64(occurrence), returnSizeAddr})
 	err = pr.f_replace.CallWithStack(ctx, pr.callStack[:])
 	if err != nil {
+		// The replacement is built in a std::u16string, which aborts the module when it cannot grow (rather than
+		// returning an error), so running out of memory appears as the module exiting. Other exits are returned as is.
+		if exitErr, ok := err.(*sys.ExitError); ok && exitErr.ExitCode() == abortExitCode {
+			return 0, ErrOutOfMemory.Wrap(err)
+		}
 		return 0, err
 	}
 	return UCharPtr(pr.callStack[0]), err
 }
 
-// URegularExpression* uregex_open(const UChar* pattern, int32_t patternLength, uint32_t flags, UErrorCode* status);
-func (pr *privateRegex) uregex_open(ctx context.Context, str UCharPtr, strlen int, flags uint32, uerr *UErrorCode) (ptr URegularExpressionPtr, err error) {
+// URegularExpression* uregex_open(const UChar* pattern, int32_t patternLength, uint32_t flags, UParseError* pe, UErrorCode* status);
+func (pr *privateRegex) uregex_open(ctx context.Context, str UCharPtr, strlen int, flags uint32, pe *ParseError, uerr *UErrorCode) (ptr URegularExpressionPtr, err error) {
+	// UParseError is 72 bytes: two int32_t fields followed by two UChar arrays of U_PARSE_CONTEXT_LEN (16)
 	origSP := pr.g_globalStackVar.Get()
-	pr.g_globalStackVar.Set(origSP - 16)
+	pr.g_globalStackVar.Set(origSP - 96)
 	defer func() { pr.g_globalStackVar.Set(origSP) }()
 	uerrAddr := origSP - 4
+	peAddr := origSP - 96
 	pr.mod.Memory().WriteUint32Le(uint32(uerrAddr), uint32(*uerr))
+	pr.mod.Memory().Write(uint32(peAddr), make([]byte, 72))
 	defer func() {
 		res, ok := pr.mod.Memory().ReadUint32Le(uint32(uerrAddr))
 		if !ok {
 			err = fmt.Errorf("could not read UErrorCode")
 		}
 		*uerr = UErrorCode(res)
+		peBytes, ok := pr.mod.Memory().Read(uint32(peAddr), 72)
+		if !ok {
+			err = fmt.Errorf("could not read UParseError")
+			return
+		}
+		pe.Line = int(int32(binary.LittleEndian.Uint32(peBytes[0:4])))
+		pe.Offset = int(int32(binary.LittleEndian.Uint32(peBytes[4:8])))
+		pe.PreContext = fromNullTerminatedUTF16(peBytes[8:40])
+		pe.PostContext = fromNullTerminatedUTF16(peBytes[40:72])
 	}()
 
-	copy(pr.callStack[:], []uint64{uint64(str), uint64(strlen), uint64(flags), uint64(0), uerrAddr})
+	copy(pr.callStack[:], []uint64{uint64(str), uint64(strlen), uint64(flags), peAddr, uerrAddr})
 	err = pr.f_uregex_open.CallWithStack(ctx, pr.callStack[:])
 	if err != nil {
 		return 0, err
@@ -330,7 +521,7 @@ func (pr *privateRegex) uregex_appendReplacement(ctx context.Context, p URegular
 }
 
 // int32_t uregex_appendTail(URegularExpression* regexp, UChar** destBuf, int32_t* destCapacity, UErrorCode* status)
-func (pr *privateRegex) uregex_appendTail(ctx context.Context, p URegularExpressionPtr, destBuf *UCharPtr, destCapacity *int, uerr *UErrorCode) (err error) {
+func (pr *privateRegex) uregex_appendTail(ctx context.Context, p URegularExpressionPtr, destBuf *UCharPtr, destCapacity *int, uerr *UErrorCode) (resultLength int, err error) {
 	origSP := pr.g_globalStackVar.Get()
 	pr.g_globalStackVar.Set(origSP - 16)
 	defer func() { pr.g_globalStackVar.Set(origSP) }()
@@ -366,7 +557,11 @@ func (pr *privateRegex) uregex_appendTail(ctx context.Context, p URegularExpress
 	}()
 
 	copy(pr.callStack[:], []uint64{uint64(p), destBufAddr, destCapacityAddr, uerrAddr})
-	return pr.f_uregex_appendTail.CallWithStack(ctx, pr.callStack[:])
+	err = pr.f_uregex_appendTail.CallWithStack(ctx, pr.callStack[:])
+	if err != nil {
+		return 0, err
+	}
+	return int(pr.callStack[0]), nil
 }
 
 // char* u_strToUTF8(char* dest, int32_t destCapacity, int32_t* pDestLength, const UChar* src, int32_t srcLength, UErrorCode* pErrorCode)
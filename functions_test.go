@@ -0,0 +1,87 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUErrorCode(t *testing.T) {
+	require.False(t, U_ZERO_ERROR.IsFailure())
+	require.False(t, U_ZERO_ERROR.IsWarning())
+	for _, code := range []UErrorCode{U_USING_DEFAULT_WARNING, U_STRING_NOT_TERMINATED_WARNING, U_PLUGIN_CHANGED_LEVEL_WARNING} {
+		require.False(t, code.IsFailure())
+		require.True(t, code.IsWarning())
+	}
+	for _, code := range []UErrorCode{U_ILLEGAL_ARGUMENT_ERROR, U_BUFFER_OVERFLOW_ERROR, U_REGEX_RULE_SYNTAX} {
+		require.True(t, code.IsFailure())
+		require.False(t, code.IsWarning())
+	}
+}
+
+func TestUErrorCodeWarning(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(0)
+	pr := regex.(*privateRegex)
+	require.NoError(t, regex.SetRegexString(ctx, `abc`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "abc"))
+
+	// Converting into a buffer that exactly fits the string leaves no room for the NULL terminator, which ICU reports
+	// as a warning rather than an error.
+	buff, err := pr.malloc(ctx, 3)
+	require.NoError(t, err)
+	var outlen int
+	var errorCode UErrorCode
+	require.NoError(t, pr.u_strToUTF8(ctx, CharPtr(buff), 3, &outlen, pr.matchStrUPtr, pr.matchStrUPtrLen, &errorCode))
+	require.Equal(t, U_STRING_NOT_TERMINATED_WARNING, errorCode)
+	require.False(t, errorCode.IsFailure())
+	require.Equal(t, 3, outlen)
+	require.NoError(t, pr.free(ctx, buff))
+
+	// A warning should not cause the following operations to fail
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.Close())
+}
+
+func TestUErrorCodeError(t *testing.T) {
+	err := newUErrorCodeError("uregex_setText", U_MEMORY_ALLOCATION_ERROR)
+	require.True(t, ErrOutOfMemory.Is(err))
+	require.Contains(t, err.Error(), "U_MEMORY_ALLOCATION_ERROR (7)")
+
+	err = newUErrorCodeError("uregex_setText", U_ILLEGAL_ARGUMENT_ERROR)
+	require.False(t, ErrOutOfMemory.Is(err))
+	uErr, ok := err.(*UErrorCodeError)
+	require.True(t, ok)
+	require.Equal(t, "uregex_setText", uErr.Function)
+	require.Equal(t, U_ILLEGAL_ARGUMENT_ERROR, uErr.Code)
+	require.Equal(t, "unexpected UErrorCode from uregex_setText: U_ILLEGAL_ARGUMENT_ERROR (1)", err.Error())
+
+	// ICU rejects a negative text length (other than -1), which lets us produce a real failure from uregex_setText
+	ctx := context.Background()
+	regex := CreateRegex(0)
+	pr := regex.(*privateRegex)
+	require.NoError(t, regex.SetRegexString(ctx, `abc`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "abc"))
+	var errorCode UErrorCode
+	require.NoError(t, pr.uregex_setText(ctx, pr.regexPtr, pr.matchStrUPtr, -2, &errorCode))
+	require.Equal(t, U_ILLEGAL_ARGUMENT_ERROR, errorCode)
+	require.Equal(t, "U_ILLEGAL_ARGUMENT_ERROR", errorCode.String())
+	require.NoError(t, regex.Close())
+}
@@ -5,6 +5,7 @@ go 1.23
 require (
 	github.com/stretchr/testify v1.8.2
 	github.com/tetratelabs/wazero v1.8.2
+	golang.org/x/text v0.21.0
 	gopkg.in/src-d/go-errors.v1 v1.0.0
 )
 
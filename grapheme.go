@@ -0,0 +1,63 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import "unicode"
+
+// zeroWidthJoiner joins emoji into a single grapheme cluster, such as the emoji for a family.
+const zeroWidthJoiner = '\u200D'
+
+// isGraphemeBoundary returns whether there is a grapheme cluster boundary before the rune at the given index. ICU's
+// break iterators require data that is not included in the WASM module (which also prevents \X from working), so this
+// approximates the rules from Unicode Standard Annex #29. Combining marks, joined emoji, emoji modifiers, tags, regional
+// indicator pairs (flags), and CRLF are kept together, while the less common rules (such as for Hangul syllables and
+// prepended characters) are not applied.
+func isGraphemeBoundary(runes []rune, idx int) bool {
+	if idx <= 0 || idx >= len(runes) {
+		return true
+	}
+	prev, next := runes[idx-1], runes[idx]
+	switch {
+	case prev == '\r' && next == '\n':
+		return false
+	case prev == '\r' || prev == '\n' || next == '\r' || next == '\n':
+		return true
+	case isGraphemeExtend(next):
+		return false
+	case prev == zeroWidthJoiner && unicode.Is(unicode.So, next):
+		return false
+	case isRegionalIndicator(prev) && isRegionalIndicator(next):
+		// Regional indicators pair up from the beginning of the sequence, so only an even count precedes a boundary
+		count := 0
+		for i := idx - 1; i >= 0 && isRegionalIndicator(runes[i]); i-- {
+			count++
+		}
+		return count%2 == 0
+	default:
+		return true
+	}
+}
+
+// isGraphemeExtend returns whether the rune extends the grapheme cluster that precedes it.
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) || r == zeroWidthJoiner ||
+		(r >= 0x1F3FB && r <= 0x1F3FF) || // emoji modifiers (skin tones)
+		(r >= 0xE0020 && r <= 0xE007F) // tags
+}
+
+// isRegionalIndicator returns whether the rune is a regional indicator, which form flags in pairs.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegexSubstringGrapheme(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	family := "\U0001F469\u200D\U0001F469\u200D\U0001F467"
+	text := "xe\u0301y" + family + "\U0001F1FA\U0001F1F8\U0001F1EB\U0001F1F7\r\n\U0001F44B\U0001F3FD"
+	require.NoError(t, regex.SetRegexString(ctx, `.`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, text))
+	tests := []struct {
+		start      int
+		occurrence int
+		match      string
+		grapheme   string
+	}{
+		{1, 1, "x", "x"},
+		{1, 2, "e", "e\u0301"},
+		// Beginning at a combining mark extends backward to its base character
+		{3, 1, "\u0301", "e\u0301"},
+		{1, 5, "\U0001F469", family},
+		{1, 7, "\U0001F469", family},
+		{1, 10, "\U0001F1FA", "\U0001F1FA\U0001F1F8"},
+		{1, 12, "\U0001F1EB", "\U0001F1EB\U0001F1F7"},
+		{1, 13, "\U0001F1F7", "\U0001F1EB\U0001F1F7"},
+		{1, 14, "\U0001F44B", "\U0001F44B\U0001F3FD"},
+	}
+	for _, test := range tests {
+		_, match, _, ok, err := regex.Partition(ctx, test.start, test.occurrence)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, test.match, match)
+		grapheme, ok, err := regex.SubstringGrapheme(ctx, test.start, test.occurrence)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, test.grapheme, grapheme, "start %d, occurrence %d", test.start, test.occurrence)
+	}
+	_, ok, err := regex.SubstringGrapheme(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// CRLF is a single grapheme cluster
+	require.NoError(t, regex.SetRegexString(ctx, `\r`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, text))
+	grapheme, ok, err := regex.SubstringGrapheme(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "\r\n", grapheme)
+}
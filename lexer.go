@@ -0,0 +1,315 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// ErrInvalidLexerPattern is returned when a pattern given to a Lexer could not be compiled.
+var ErrInvalidLexerPattern = errors.NewKind("the lexer pattern %q could not be compiled")
+
+// ErrUnrecognizedInput is returned when tokenizing reaches a position where no pattern matches.
+var ErrUnrecognizedInput = errors.NewKind("no lexer pattern matches the input at position %d")
+
+// NamedPattern is a pattern that is identified by name within a Lexer.
+type NamedPattern struct {
+	Name    string
+	Pattern string
+	Flags   RegexFlags
+}
+
+// LexerMode determines how a Lexer chooses between patterns when more than one matches at the same position.
+type LexerMode uint8
+
+const (
+	// The first pattern (in the order given) that matches is chosen.
+	LexerMode_First_Match LexerMode = iota
+
+	// The pattern with the longest match is chosen. When multiple patterns share the longest match, the first of them
+	// (in the order given) is chosen.
+	LexerMode_Longest_Match
+)
+
+// Token is a single token produced by Tokenize. Start and End are positions of the input in the same form as
+// MatchBounds, so Start begins at 1 and End is the position immediately following the token.
+type Token struct {
+	Name  string
+	Text  string
+	Start int
+	End   int
+}
+
+// Lexer matches a priority-ordered list of patterns against a specific position of an input, reporting which pattern
+// matched. This is a building block for tokenizers and small DSLs. As with Regex, it is imperative that a Lexer is
+// closed once it is finished, and it is intended for single-threaded use only.
+type Lexer struct {
+	patterns []NamedPattern
+	// The patterns are compiled within the module of this privateRegex, which does not have a regex of its own. As with
+	// MatchMatrix, the compiled patterns are not tracked by the privateRegex, so the Lexer frees them itself.
+	pr          *privateRegex
+	regexPtrs   []URegularExpressionPtr
+	patternPtrs []UCharPtr
+	mode        LexerMode
+	// The input is written once to the text buffer, where it is shared by all of the patterns
+	text     reusableBuffer
+	textLen  int
+	input    string
+	inputSet bool
+	// nextMatches holds the next match of each pattern within the current input
+	nextMatches []lexerMatch
+}
+
+// lexerMatch is the first match of a pattern that was found by searching the input from an index. No match of the
+// pattern begins between that index and the start of the match, so positions in between can be skipped without
+// searching again. All indexes are zero-based code unit offsets, and the end is exclusive.
+type lexerMatch struct {
+	searched bool
+	from     int
+	start    int
+	end      int
+}
+
+// NewLexer creates a Lexer from the given patterns. If any pattern fails to compile, then ErrInvalidLexerPattern is
+// returned (wrapping the cause), and no Lexer is created. All patterns are compiled within a single module, so
+// ErrMemoryLimitExceeded is returned if that module would exceed the global memory limit.
+func NewLexer(ctx context.Context, patterns []NamedPattern, mode LexerMode) (*Lexer, error) {
+	mod, err := modulePool.TryGet()
+	if err != nil {
+		return nil, err
+	}
+	lexer := &Lexer{
+		patterns:    patterns,
+		pr:          newPrivateRegex(mod, 0, modulePool.Put, nil),
+		regexPtrs:   make([]URegularExpressionPtr, 0, len(patterns)),
+		patternPtrs: make([]UCharPtr, 0, len(patterns)),
+		mode:        mode,
+	}
+	for _, pattern := range patterns {
+		utf16Pattern, patternLen := toUTF16(pattern.Pattern)
+		patternPtr, err := lexer.pr.writeString(ctx, 0, utf16Pattern)
+		if err != nil {
+			_ = lexer.Close()
+			return nil, err
+		}
+		lexer.patternPtrs = append(lexer.patternPtrs, patternPtr)
+		regexPtr, err := lexer.pr.compile(ctx, patternPtr, patternLen, pattern.Flags)
+		if err != nil {
+			// The error from compiling takes precedence, as closing should only fail if something is very wrong
+			_ = lexer.Close()
+			return nil, ErrInvalidLexerPattern.Wrap(err, pattern.Name)
+		}
+		lexer.regexPtrs = append(lexer.regexPtrs, regexPtr)
+	}
+	return lexer, nil
+}
+
+// Match attempts each pattern anchored at the given position of the input, and returns the name of the chosen pattern
+// along with the bounds of its match. Position starts at 1, not 0. Patterns are matched against the entire input, so
+// lookbehind may see text before the position, however a pattern beginning with "^" will only match at the start of
+// the input. If no pattern matches at the position, then ok is false.
+func (lexer *Lexer) Match(ctx context.Context, input string, at int) (name string, bounds MatchBounds, ok bool, err error) {
+	if lexer.pr == nil {
+		return "", MatchBounds{}, false, ErrClosed.New()
+	}
+	if err = lexer.setInput(ctx, input); err != nil {
+		return "", MatchBounds{}, false, err
+	}
+	chosen := -1
+	chosenEnd := 0
+	for i := range lexer.regexPtrs {
+		matchEnd, matched, err := lexer.lookingAt(ctx, i, at-1)
+		if err != nil {
+			return "", MatchBounds{}, false, err
+		}
+		if !matched || (chosen != -1 && matchEnd <= chosenEnd) {
+			continue
+		}
+		chosen = i
+		chosenEnd = matchEnd
+		if lexer.mode == LexerMode_First_Match {
+			break
+		}
+	}
+	if chosen == -1 {
+		return "", MatchBounds{}, false, nil
+	}
+	return lexer.patterns[chosen].Name, MatchBounds{Start: at, End: chosenEnd + 1}, true, nil
+}
+
+// Tokenize splits the entire input into tokens, matching at the start of the input and then continuing from the end of
+// each token, with patterns chosen according to the Lexer's mode. If no pattern matches at some position, or the only
+// match is empty (which would never advance), then ErrUnrecognizedInput is returned with that position.
+func (lexer *Lexer) Tokenize(ctx context.Context, input string) ([]Token, error) {
+	if lexer.pr == nil {
+		return nil, ErrClosed.New()
+	}
+	if err := lexer.setInput(ctx, input); err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	for at := 1; at <= lexer.textLen; {
+		name, bounds, ok, err := lexer.Match(ctx, input, at)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || bounds.End == bounds.Start {
+			return nil, ErrUnrecognizedInput.New(at)
+		}
+		text, err := lexer.slice(bounds.Start-1, bounds.End-1)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, Token{Name: name, Text: text, Start: bounds.Start, End: bounds.End})
+		at = bounds.End
+	}
+	return tokens, nil
+}
+
+// Close frees up the internal resources. This MUST be called, else a panic will occur at some non-deterministic time.
+func (lexer *Lexer) Close() (err error) {
+	if lexer.pr == nil {
+		return nil
+	}
+	ctx := context.Background()
+	// A module that has stopped cannot free anything, nor does it need to
+	if !lexer.pr.mod.IsClosed() {
+		for _, regexPtr := range lexer.regexPtrs {
+			if nErr := lexer.pr.uregex_close(ctx, regexPtr); err == nil {
+				err = nErr
+			}
+		}
+		for _, patternPtr := range lexer.patternPtrs {
+			if nErr := lexer.pr.free(ctx, uint32(patternPtr)); err == nil {
+				err = nErr
+			}
+		}
+		if nErr := lexer.pr.releaseBuffer(ctx, &lexer.text); err == nil {
+			err = nErr
+		}
+	}
+	if nErr := lexer.pr.Close(); err == nil {
+		err = nErr
+	}
+	lexer.pr = nil
+	lexer.regexPtrs = nil
+	lexer.patternPtrs = nil
+	lexer.inputSet = false
+	return err
+}
+
+// setInput writes the input to the module, and sets it on every pattern. This is skipped when the input has not
+// changed since the last call, so that matching successive positions of the same input only encodes the input once.
+func (lexer *Lexer) setInput(ctx context.Context, input string) error {
+	if lexer.inputSet && lexer.input == input {
+		return nil
+	}
+	lexer.inputSet = false
+	utf16Input, inputLen := toUTF16(input)
+	textPtr, err := lexer.pr.reserve(ctx, &lexer.text, uint32(len(utf16Input)))
+	if err != nil {
+		return err
+	}
+	lexer.pr.mod.Memory().Write(textPtr, utf16Input)
+	for _, regexPtr := range lexer.regexPtrs {
+		errorCode := UErrorCode(0)
+		if err = lexer.pr.uregex_setText(ctx, regexPtr, UCharPtr(textPtr), inputLen, &errorCode); err != nil {
+			return err
+		}
+		if errorCode.IsFailure() {
+			return newUErrorCodeError("uregex_setText", errorCode)
+		}
+	}
+	lexer.textLen = inputLen
+	lexer.nextMatches = make([]lexerMatch, len(lexer.regexPtrs))
+	lexer.input = input
+	lexer.inputSet = true
+	return nil
+}
+
+// lookingAt returns whether the given pattern matches the input beginning exactly at the given index, in the same way
+// as the privateRegex function of the same name. The start index and the returned end offset are zero-based, and the
+// end offset is exclusive. A search continues to the end of the input when the pattern does not match at the index,
+// so the match that it found is kept, and later calls between the index and that match do not search again. Without
+// this, tokenizing would rescan the rest of the input for every pattern at every token.
+func (lexer *Lexer) lookingAt(ctx context.Context, pattern int, startIdx int) (matchEnd int, ok bool, err error) {
+	next := &lexer.nextMatches[pattern]
+	if next.searched && next.from <= startIdx && startIdx <= next.start {
+		if next.start != startIdx {
+			return 0, false, nil
+		}
+		return next.end, true, nil
+	}
+	next.searched = false
+	matchStart, matchEnd, ok, err := lexer.find(ctx, pattern, startIdx)
+	if err != nil {
+		return 0, false, err
+	}
+	if !ok {
+		// There is no match from here to the end of the input
+		matchStart = math.MaxInt
+	}
+	*next = lexerMatch{searched: true, from: startIdx, start: matchStart, end: matchEnd}
+	if !ok || matchStart != startIdx {
+		return 0, false, nil
+	}
+	return matchEnd, true, nil
+}
+
+// find returns the first match of the given pattern, searching the input from the given index. The start index and the
+// returned offsets are zero-based, and the end offset is exclusive.
+func (lexer *Lexer) find(ctx context.Context, pattern int, startIdx int) (matchStart int, matchEnd int, ok bool, err error) {
+	regexPtr := lexer.regexPtrs[pattern]
+	var errorCode UErrorCode
+	ok, err = lexer.pr.uregex_find(ctx, regexPtr, startIdx, &errorCode)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if errorCode.IsFailure() {
+		return 0, 0, false, newUErrorCodeError("uregex_find", errorCode)
+	}
+	if !ok {
+		return 0, 0, false, nil
+	}
+	start, err := lexer.pr.uregex_start(ctx, regexPtr, 0, &errorCode)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	end, err := lexer.pr.uregex_end(ctx, regexPtr, 0, &errorCode)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if errorCode.IsFailure() {
+		return 0, 0, false, newUErrorCodeError("uregex_start/uregex_end", errorCode)
+	}
+	return int(start), int(end), true, nil
+}
+
+// slice returns the portion of the input that is between the given code unit offsets. The offsets are zero-based, and
+// the end offset is exclusive.
+func (lexer *Lexer) slice(startIdx int, endIdx int) (string, error) {
+	if endIdx <= startIdx {
+		return "", nil
+	}
+	strBytes, ok := lexer.pr.mod.Memory().Read(lexer.text.ptr+uint32(startIdx*2), uint32((endIdx-startIdx)*2))
+	if !ok {
+		return "", fmt.Errorf("somehow failed when retrieving a portion of the input")
+	}
+	return fromUTF16(strBytes), nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLexerMatch(t *testing.T) {
+	ctx := context.Background()
+	patterns := []NamedPattern{
+		{Name: "keyword", Pattern: `if|else`},
+		{Name: "identifier", Pattern: `[a-z]+`},
+		{Name: "number", Pattern: `\d+`},
+		{Name: "keyword_upper", Pattern: `if`, Flags: RegexFlags_Case_Insensitive},
+	}
+
+	lexer, err := NewLexer(ctx, patterns, LexerMode_First_Match)
+	require.NoError(t, err)
+	name, bounds, ok, err := lexer.Match(ctx, "iffy 42", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "keyword", name)
+	require.Equal(t, MatchBounds{Start: 1, End: 3}, bounds)
+	name, bounds, ok, err = lexer.Match(ctx, "iffy 42", 6)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "number", name)
+	require.Equal(t, MatchBounds{Start: 6, End: 8}, bounds)
+	// There's a match later in the input, but nothing matches at the space itself
+	_, _, ok, err = lexer.Match(ctx, "iffy 42", 5)
+	require.NoError(t, err)
+	require.False(t, ok)
+	name, _, ok, err = lexer.Match(ctx, "IF", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "keyword_upper", name)
+	require.NoError(t, lexer.Close())
+
+	lexer, err = NewLexer(ctx, patterns, LexerMode_Longest_Match)
+	require.NoError(t, err)
+	name, bounds, ok, err = lexer.Match(ctx, "iffy 42", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "identifier", name)
+	require.Equal(t, MatchBounds{Start: 1, End: 5}, bounds)
+	// Both "keyword" and "identifier" match "if", so the tie goes to the earlier pattern
+	name, bounds, ok, err = lexer.Match(ctx, "if 42", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "keyword", name)
+	require.Equal(t, MatchBounds{Start: 1, End: 3}, bounds)
+	require.NoError(t, lexer.Close())
+
+	_, err = NewLexer(ctx, []NamedPattern{{Name: "valid", Pattern: `a`}, {Name: "invalid", Pattern: `(a`}}, LexerMode_First_Match)
+	require.True(t, ErrInvalidLexerPattern.Is(err))
+	require.True(t, ErrInvalidRegex.Is(err))
+	_, _, _, err = lexer.Match(ctx, "if", 1)
+	require.True(t, ErrClosed.Is(err))
+}
+
+func TestLexerSharesModule(t *testing.T) {
+	ctx := context.Background()
+	defer SetGlobalMemoryLimit(0)
+	// Every pattern is compiled within the same module, so a limit that only allows one more module is enough
+	usage := GlobalMemoryUsage()
+	SetGlobalMemoryLimit(usage + icuMemoryPages*65536)
+	patterns := make([]NamedPattern, 16)
+	for i := range patterns {
+		patterns[i] = NamedPattern{Name: fmt.Sprintf("digit%d", i), Pattern: fmt.Sprintf("%d", i%10)}
+	}
+	lexer, err := NewLexer(ctx, patterns, LexerMode_First_Match)
+	require.NoError(t, err)
+	require.LessOrEqual(t, GlobalMemoryUsage(), usage+icuMemoryPages*65536)
+	tokens, err := lexer.Tokenize(ctx, "397")
+	require.NoError(t, err)
+	require.Equal(t, []Token{
+		{Name: "digit3", Text: "3", Start: 1, End: 2},
+		{Name: "digit9", Text: "9", Start: 2, End: 3},
+		{Name: "digit7", Text: "7", Start: 3, End: 4},
+	}, tokens)
+	require.NoError(t, lexer.Close())
+}
+
+func TestLexerTokenize(t *testing.T) {
+	ctx := context.Background()
+	lexer, err := NewLexer(ctx, []NamedPattern{
+		{Name: "number", Pattern: `\d+(?:\.\d+)?`},
+		{Name: "operator", Pattern: `[-+*/()]`},
+		{Name: "whitespace", Pattern: `\s+`},
+	}, LexerMode_Longest_Match)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, lexer.Close())
+	}()
+
+	tokens, err := lexer.Tokenize(ctx, "12 + 3.5*(4-5)")
+	require.NoError(t, err)
+	require.Equal(t, []Token{
+		{Name: "number", Text: "12", Start: 1, End: 3},
+		{Name: "whitespace", Text: " ", Start: 3, End: 4},
+		{Name: "operator", Text: "+", Start: 4, End: 5},
+		{Name: "whitespace", Text: " ", Start: 5, End: 6},
+		{Name: "number", Text: "3.5", Start: 6, End: 9},
+		{Name: "operator", Text: "*", Start: 9, End: 10},
+		{Name: "operator", Text: "(", Start: 10, End: 11},
+		{Name: "number", Text: "4", Start: 11, End: 12},
+		{Name: "operator", Text: "-", Start: 12, End: 13},
+		{Name: "number", Text: "5", Start: 13, End: 14},
+		{Name: "operator", Text: ")", Start: 14, End: 15},
+	}, tokens)
+
+	tokens, err = lexer.Tokenize(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	_, err = lexer.Tokenize(ctx, "1 + x")
+	require.True(t, ErrUnrecognizedInput.Is(err))
+	require.Contains(t, err.Error(), "position 5")
+
+	// Matches found while tokenizing are cached, which must not hide matches when moving back through the input
+	tokens, err = lexer.Tokenize(ctx, "1 +  22")
+	require.NoError(t, err)
+	require.Len(t, tokens, 5)
+	name, bounds, ok, err := lexer.Match(ctx, "1 +  22", 6)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "number", name)
+	require.Equal(t, MatchBounds{Start: 6, End: 8}, bounds)
+	name, bounds, ok, err = lexer.Match(ctx, "1 +  22", 5)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "whitespace", name)
+	require.Equal(t, MatchBounds{Start: 5, End: 6}, bounds)
+	name, _, ok, err = lexer.Match(ctx, "1 +  22", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "number", name)
+}
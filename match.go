@@ -0,0 +1,170 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import "unicode/utf16"
+
+// LazyMatch is a single match of a Regex, which retrieves the text of a group only once it has been requested, and
+// caches it for later requests. This avoids creating strings for groups that are never read, which matters for regexes
+// with many groups. The text is read from the Regex that created the match, therefore a LazyMatch is only valid until
+// that Regex's match string changes (such as through SetMatchString, RefreshText, or SetRegexString) or the Regex is
+// closed. Once invalid, groups that have not been read return an empty string. Groups that were already read remain
+// available.
+type LazyMatch struct {
+	bounds []MatchBounds
+	names  map[string]int
+	read   func(startIdx int, endIdx int) (string, bool)
+	cache  map[int]string
+}
+
+// newLazyMatch creates a *LazyMatch from the bounds of every group, where the bounds of non-participating groups are
+// zero. The read function returns the text between the given zero-based code unit offsets, or false if the match is no
+// longer valid.
+func newLazyMatch(bounds []MatchBounds, groups []patternGroup, read func(startIdx int, endIdx int) (string, bool)) *LazyMatch {
+	names := make(map[string]int)
+	for _, group := range groups {
+		if _, ok := names[group.name]; group.name != "" && !ok {
+			names[group.name] = group.number
+		}
+	}
+	return &LazyMatch{
+		bounds: bounds,
+		names:  names,
+		read:   read,
+		cache:  make(map[int]string),
+	}
+}
+
+// Group returns the text of the given group, where group 0 is the entire match. If the group does not exist, or did not
+// participate in the match, then an empty string is returned.
+func (m *LazyMatch) Group(n int) string {
+	if str, ok := m.cache[n]; ok {
+		return str
+	}
+	if n < 0 || n >= len(m.bounds) || m.bounds[n].Start == 0 {
+		return ""
+	}
+	str, ok := m.read(m.bounds[n].Start-1, m.bounds[n].End-1)
+	if !ok {
+		return ""
+	}
+	m.cache[n] = str
+	return str
+}
+
+// GroupByName returns the text of the group with the given name. If there is no group with the name, or it did not
+// participate in the match, then an empty string is returned.
+func (m *LazyMatch) GroupByName(name string) string {
+	n, ok := m.names[name]
+	if !ok {
+		return ""
+	}
+	return m.Group(n)
+}
+
+// ContextResult is a match along with the lines that surround it, as returned by MatchWithContext. Lines do not
+// include their line terminators, although lines that the match spans keep the terminators between them.
+type ContextResult struct {
+	// Match is the matched text.
+	Match string
+	// Bounds are the bounds of the match within the match string.
+	Bounds MatchBounds
+	// Lines is the full text of every line that the match spans.
+	Lines string
+	// LineNumber is the number of the line that the match begins on, starting at 1.
+	LineNumber int
+	// Before contains the lines preceding the match, in the order that they appear, which may be fewer than requested
+	// when the match is near the beginning of the match string.
+	Before []string
+	// After contains the lines following the match, in the order that they appear, which may be fewer than requested
+	// when the match is near the end of the match string.
+	After []string
+}
+
+// newContextResult creates a ContextResult for the match between the given zero-based code unit offsets of the text,
+// where the end offset is exclusive. A negative number of context lines is treated as zero.
+func newContextResult(text []uint16, matchStart int, matchEnd int, contextLines int, unixLines bool) ContextResult {
+	isTerminator := func(idx int) bool {
+		switch text[idx] {
+		case '\n':
+			return true
+		case '\v', '\f', '\r', 0x85, 0x2028, 0x2029:
+			return !unixLines
+		default:
+			return false
+		}
+	}
+	isCRLF := func(idx int) bool {
+		return !unixLines && idx+1 < len(text) && text[idx] == '\r' && text[idx+1] == '\n'
+	}
+	lineStart := func(idx int) int {
+		for idx > 0 && !isTerminator(idx-1) {
+			idx--
+		}
+		return idx
+	}
+	lineEnd := func(idx int) int {
+		for idx < len(text) && !isTerminator(idx) {
+			idx++
+		}
+		return idx
+	}
+	str := func(startIdx int, endIdx int) string {
+		return string(utf16.Decode(text[startIdx:endIdx]))
+	}
+
+	firstStart := lineStart(matchStart)
+	lastEnd := lineEnd(matchStart)
+	if matchEnd > matchStart {
+		// A match that ends with a line terminator does not extend into the next line
+		lastEnd = lineEnd(matchEnd - 1)
+	}
+	result := ContextResult{
+		Match:      str(matchStart, matchEnd),
+		Bounds:     MatchBounds{Start: matchStart + 1, End: matchEnd + 1},
+		Lines:      str(firstStart, lastEnd),
+		LineNumber: 1,
+	}
+	for idx := 0; idx < firstStart; idx++ {
+		if isTerminator(idx) && !isCRLF(idx) {
+			result.LineNumber++
+		}
+	}
+	for startIdx := firstStart; len(result.Before) < contextLines && startIdx > 0; {
+		// The preceding terminator may be a CRLF pair, which counts as a single terminator
+		endIdx := startIdx - 1
+		if endIdx > 0 && isCRLF(endIdx-1) {
+			endIdx--
+		}
+		startIdx = lineStart(endIdx)
+		result.Before = append(result.Before, str(startIdx, endIdx))
+	}
+	for i, j := 0, len(result.Before)-1; i < j; i, j = i+1, j-1 {
+		result.Before[i], result.Before[j] = result.Before[j], result.Before[i]
+	}
+	for endIdx := lastEnd; len(result.After) < contextLines && endIdx < len(text); {
+		startIdx := endIdx + 1
+		if isCRLF(endIdx) {
+			startIdx++
+		}
+		// A terminator at the very end does not begin another line
+		if startIdx >= len(text) {
+			break
+		}
+		endIdx = lineEnd(startIdx)
+		result.After = append(result.After, str(startIdx, endIdx))
+	}
+	return result
+}
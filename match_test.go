@@ -0,0 +1,79 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyMatch(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `(\d+)-(\d+)-(?<day>\d+)(x)?`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "on 2024-01-31 and 2025-12-01"))
+	match, ok, err := regex.FindLazy(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, match.cache)
+
+	// Only the requested groups are materialized
+	require.Equal(t, "01", match.Group(2))
+	require.Len(t, match.cache, 1)
+	require.Equal(t, "31", match.GroupByName("day"))
+	require.Equal(t, "01", match.Group(2))
+	require.Len(t, match.cache, 2)
+	require.Contains(t, match.cache, 2)
+	require.Contains(t, match.cache, 3)
+
+	// Non-participating, nonexistent, and unknown groups are empty
+	require.Equal(t, "", match.Group(4))
+	require.Equal(t, "", match.Group(5))
+	require.Equal(t, "", match.Group(-1))
+	require.Equal(t, "", match.GroupByName("month"))
+	require.Len(t, match.cache, 2)
+
+	next, ok, err := regex.FindLazy(ctx, 15)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "2025-12-01", next.Group(0))
+	_, ok, err = regex.FindLazy(ctx, 25)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Changing the text invalidates the match, although groups that were already read remain available
+	require.NoError(t, regex.SetMatchString(ctx, "on 1999-02-03 and 2025-12-01"))
+	require.Equal(t, "", match.Group(1))
+	require.Equal(t, "01", match.Group(2))
+	require.NoError(t, regex.Close())
+}
+
+func TestLazyMatchSerializedEngine(t *testing.T) {
+	ctx := context.Background()
+	engine := NewSerializedEngine()
+	regex, err := engine.CreateRegex(1024)
+	require.NoError(t, err)
+	require.NoError(t, regex.SetRegexString(ctx, `(?<key>\w+)=(?<value>\w+)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a=b c=d"))
+	match, ok, err := regex.FindLazy(ctx, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "c", match.GroupByName("key"))
+	require.Equal(t, "d", match.GroupByName("value"))
+	require.NoError(t, regex.Close())
+	require.NoError(t, engine.Close())
+}
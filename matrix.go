@@ -0,0 +1,108 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// ErrMatrixPattern is returned by MatchMatrix when one of its patterns fails to compile. The cause is the error from
+// compiling the pattern, which is usually ErrInvalidRegex.
+var ErrMatrixPattern = errors.NewKind("pattern %d (%q) failed to compile")
+
+// MatchMatrix determines whether each pattern matches each input, using the same flags for every pattern. The result is
+// indexed by pattern and then by input, so result[i][j] reports whether patterns[i] matches anywhere within inputs[j].
+// Every pattern is compiled once, and every input is written to WASM memory once, where it is shared by all of the
+// patterns, so this is considerably cheaper than creating a Regex for each pair. All patterns are compiled before any
+// matching is done, and the first pattern that fails to compile returns ErrMatrixPattern, which identifies the pattern.
+func MatchMatrix(ctx context.Context, patterns []string, inputs []string, flags RegexFlags) (results [][]bool, err error) {
+	mod, err := modulePool.TryGet()
+	if err != nil {
+		return nil, err
+	}
+	// The compiled patterns are not tracked by the privateRegex, so we're responsible for freeing them ourselves
+	pr := newPrivateRegex(mod, 0, modulePool.Put, nil)
+	regexPtrs := make([]URegularExpressionPtr, 0, len(patterns))
+	patternPtrs := make([]UCharPtr, 0, len(patterns))
+	var text reusableBuffer
+	defer func() {
+		for _, regexPtr := range regexPtrs {
+			if nErr := pr.uregex_close(ctx, regexPtr); err == nil {
+				err = nErr
+			}
+		}
+		for _, patternPtr := range patternPtrs {
+			if nErr := pr.free(ctx, uint32(patternPtr)); err == nil {
+				err = nErr
+			}
+		}
+		if nErr := pr.releaseBuffer(ctx, &text); err == nil {
+			err = nErr
+		}
+		if nErr := pr.Close(); err == nil {
+			err = nErr
+		}
+		if err != nil {
+			results = nil
+		}
+	}()
+
+	for i, pattern := range patterns {
+		utf16Pattern, patternLen := toUTF16(pattern)
+		patternPtr, err := pr.writeString(ctx, 0, utf16Pattern)
+		if err != nil {
+			return nil, err
+		}
+		patternPtrs = append(patternPtrs, patternPtr)
+		regexPtr, err := pr.compile(ctx, patternPtr, patternLen, flags)
+		if err != nil {
+			return nil, ErrMatrixPattern.Wrap(err, i, pattern)
+		}
+		regexPtrs = append(regexPtrs, regexPtr)
+	}
+
+	results = make([][]bool, len(patterns))
+	for i := range results {
+		results[i] = make([]bool, len(inputs))
+	}
+	for j, input := range inputs {
+		utf16Input, inputLen := toUTF16(input)
+		textPtr, err := pr.reserve(ctx, &text, uint32(len(utf16Input)))
+		if err != nil {
+			return nil, err
+		}
+		pr.mod.Memory().Write(textPtr, utf16Input)
+		for i, regexPtr := range regexPtrs {
+			errorCode := UErrorCode(0)
+			if err = pr.uregex_setText(ctx, regexPtr, UCharPtr(textPtr), inputLen, &errorCode); err != nil {
+				return nil, err
+			}
+			if errorCode.IsFailure() {
+				return nil, newUErrorCodeError("uregex_setText", errorCode)
+			}
+			ok, err := pr.uregex_find(ctx, regexPtr, 0, &errorCode)
+			if err != nil {
+				return nil, err
+			}
+			if errorCode.IsFailure() {
+				return nil, newUErrorCodeError("uregex_find", errorCode)
+			}
+			results[i][j] = ok
+		}
+	}
+	return results, nil
+}
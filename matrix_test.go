@@ -0,0 +1,85 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchMatrix(t *testing.T) {
+	ctx := context.Background()
+	results, err := MatchMatrix(ctx, []string{`^\d+$`, `error`, `^$`, `[a-z]`},
+		[]string{"12345", "an ERROR occurred", "", "error 42"}, RegexFlags_Case_Insensitive)
+	require.NoError(t, err)
+	require.Equal(t, [][]bool{
+		{true, false, false, false},
+		{false, true, false, true},
+		{false, false, true, false},
+		{false, true, false, true},
+	}, results)
+
+	results, err = MatchMatrix(ctx, nil, []string{"abc"}, RegexFlags_None)
+	require.NoError(t, err)
+	require.Empty(t, results)
+	results, err = MatchMatrix(ctx, []string{"abc"}, nil, RegexFlags_None)
+	require.NoError(t, err)
+	require.Equal(t, [][]bool{{}}, results)
+
+	_, err = MatchMatrix(ctx, []string{`abc`, `a(b`}, []string{"abc"}, RegexFlags_None)
+	require.True(t, ErrMatrixPattern.Is(err))
+	require.True(t, ErrInvalidRegex.Is(err))
+	require.Contains(t, err.Error(), `pattern 1 ("a(b") failed to compile`)
+}
+
+var matrixPatterns = []string{`^\d+$`, `error|fail`, `[A-Z]{3}-\d{4}`, `\bthe\b`, `@\w+\.com$`, `(ab)+c`}
+var matrixInputs = []string{"12345", "the job failed", "ticket ABC-1234 filed", "someone@example.com", "ababababc",
+	"nothing to see here", "error: the disk is full", "98765x"}
+
+func BenchmarkMatchMatrix(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := MatchMatrix(ctx, matrixPatterns, matrixInputs, RegexFlags_None); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatchMatrixNaive(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, pattern := range matrixPatterns {
+			for _, input := range matrixInputs {
+				regex := CreateRegex(0)
+				if err := regex.SetRegexString(ctx, pattern, RegexFlags_None); err != nil {
+					b.Fatal(err)
+				}
+				if err := regex.SetMatchString(ctx, input); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := regex.Matches(ctx, 0, 0); err != nil {
+					b.Fatal(err)
+				}
+				if err := regex.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// RegexOption configures optional behavior of a Regex. Options are given when creating the Regex.
+type RegexOption func(pr *privateRegex)
+
+// NormalizationForm is a Unicode normalization form, as defined in Unicode Standard Annex #15.
+type NormalizationForm uint8
+
+const (
+	// Do not normalize strings.
+	NormalizationForm_None NormalizationForm = iota
+
+	// Canonical decomposition, followed by canonical composition.
+	NormalizationForm_NFC
+
+	// Canonical decomposition.
+	NormalizationForm_NFD
+
+	// Compatibility decomposition, followed by canonical composition.
+	NormalizationForm_NFKC
+
+	// Compatibility decomposition.
+	NormalizationForm_NFKD
+)
+
+// WithNormalization normalizes the match string to the given form before it's handed to ICU, so that
+// canonically-equivalent strings (such as a precomposed "é" and an "e" followed by a combining acute accent) are matched
+// the same way. As the WASM module does not include ICU's normalization data, normalization is performed on the Go side.
+// Normalization may change the length of a string, therefore any positions given to or returned from the Regex refer to
+// the normalized match string, rather than the string that was originally given.
+//
+// The regex string is not normalized, as the syntax of a regex cannot be normalized without changing its meaning, so it
+// must already be written in the given form. SetRegexString returns ErrPatternNotNormalized for literal text, class
+// members, and escaped code points (such as \u00e9) that are not in the form, as they could never match. Every atom
+// still matches a single code point, so "." and "\p{L}" only match part of a character that the decomposed forms (NFD
+// and NFKD) split into multiple code points.
+func WithNormalization(form NormalizationForm) RegexOption {
+	return func(pr *privateRegex) {
+		pr.normalization = form
+	}
+}
+
+// ReplacementSyntax is the syntax of replacement strings, which determines how references to capture groups are
+// written.
+type ReplacementSyntax uint8
+
+const (
+	// ICU's syntax, where $N references group N (with $0 being the entire match), ${name} references a named group, and
+	// a backslash escapes the following character (such as \$ for a literal dollar sign).
+	ReplacementSyntax_ICU ReplacementSyntax = iota
+
+	// MySQL's syntax, where \N references group N (for a single digit N). A dollar sign has no special meaning, and a
+	// backslash followed by any other character represents that character.
+	ReplacementSyntax_MySQL
+)
+
+// WithReplacementSyntax sets the syntax of replacement strings given to the Regex. Replacement strings are translated
+// into ICU's syntax before they're handed to ICU.
+func WithReplacementSyntax(syntax ReplacementSyntax) RegexOption {
+	return func(pr *privateRegex) {
+		pr.replacementSyntax = syntax
+	}
+}
+
+// WithBufferGrowthFactor sets how much the buffers that are reused across calls (such as those holding replacement
+// strings and replacement results) grow by when they're too small, as a multiple of their previous size. The default of
+// 2 doubles the buffer, which keeps reallocations rare, but may allocate up to twice the memory that is needed. A
+// factor of 1 sizes the buffer exactly, which minimizes memory usage at the cost of reallocating whenever a larger
+// string is given. Factors less than 1 are treated as 1. Buffers are always at least as large as what's needed.
+func WithBufferGrowthFactor(f float64) RegexOption {
+	return func(pr *privateRegex) {
+		pr.bufferGrowthFactor = max(f, 1)
+	}
+}
+
+// WithRejectLoneSurrogates rejects regex strings and match strings that contain surrogate code points, returning
+// ErrInvalidUTF16. Surrogates cannot be encoded in valid UTF-8, however a Go string may still contain their encoding
+// (such as from text that was converted from invalid UTF-16), which would otherwise be replaced by U+FFFD before the
+// string is handed to ICU, silently changing what is matched. This applies to SetRegexString, SetMatchString, and
+// RefreshText.
+func WithRejectLoneSurrogates() RegexOption {
+	return func(pr *privateRegex) {
+		pr.rejectLoneSurrogates = true
+	}
+}
+
+// WithStrictFlags rejects regex strings whose inline flags contradict the RegexFlags given to SetRegexString,
+// returning ErrConflictingFlags. An inline flag contradicts the RegexFlags when it turns off a flag that is set, such as
+// "(?-i)" with RegexFlags_Case_Insensitive, or when it turns on a flag that is not set, such as "(?i)" without
+// RegexFlags_Case_Insensitive. This is intended for when the flags and the regex strings come from different sources,
+// so that unintended interactions between them are caught when the regex is set. Inline flags that agree with the
+// RegexFlags are allowed.
+func WithStrictFlags() RegexOption {
+	return func(pr *privateRegex) {
+		pr.strictFlags = true
+	}
+}
+
+// findSurrogate returns the byte offset of the first surrogate code point that has been encoded within the string, or
+// -1 if there are none. Encoded surrogates are invalid UTF-8, so they're only found among the invalid bytes.
+func findSurrogate(str string) int {
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		if r == utf8.RuneError && size == 1 && i+2 < len(str) &&
+			str[i] == 0xED && str[i+1] >= 0xA0 && str[i+1] <= 0xBF && str[i+2] >= 0x80 && str[i+2] <= 0xBF {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
+
+// translate returns the given replacement string translated from the syntax into ICU's syntax.
+func (syntax ReplacementSyntax) translate(replacementStr string) string {
+	if syntax != ReplacementSyntax_MySQL {
+		return replacementStr
+	}
+	sb := strings.Builder{}
+	sb.Grow(len(replacementStr))
+	for i := 0; i < len(replacementStr); i++ {
+		c := replacementStr[i]
+		switch {
+		case c == '$':
+			sb.WriteString(`\$`)
+		case c == '\\' && i+1 < len(replacementStr) && replacementStr[i+1] >= '0' && replacementStr[i+1] <= '9':
+			sb.WriteByte('$')
+			sb.WriteByte(replacementStr[i+1])
+			i++
+			// MySQL references use a single digit, while ICU would continue the group number with any digits that follow
+			if i+1 < len(replacementStr) && replacementStr[i+1] >= '0' && replacementStr[i+1] <= '9' {
+				sb.WriteByte('\\')
+			}
+		case c == '\\' && i+1 < len(replacementStr):
+			// ICU also treats a backslash as escaping the following character, so the pair carries over as-is
+			sb.WriteByte(c)
+			sb.WriteByte(replacementStr[i+1])
+			i++
+		case c == '\\':
+			// A trailing backslash has nothing to escape, so it is kept as a literal backslash
+			sb.WriteString(`\\`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// replacementTemplate is a replacement string (in ICU's syntax) reduced to what determines the length of its expansion:
+// the UTF-8 length of its literal text, and the number of every group that it references.
+type replacementTemplate struct {
+	literalLen int
+	references []int
+}
+
+// parseReplacementTemplate parses the given replacement string the same way that ICU's appendReplacement does. A
+// backslash escapes the following character, except for \uhhhh and \Uhhhhhhhh which are expanded to the character with
+// that code point. A numbered reference consumes digits while the group number stays within the number of groups, so
+// "$13" with twelve groups is group 1 followed by a literal "3". References to groups that do not exist return
+// ErrInvalidReplacement describing every invalid reference, as ICU would also fail.
+func parseReplacementTemplate(replacementStr string, groups []patternGroup) (replacementTemplate, error) {
+	var template replacementTemplate
+	var problems []string
+parse:
+	for i := 0; i < len(replacementStr); {
+		r, size := utf8.DecodeRuneInString(replacementStr[i:])
+		i += size
+		switch r {
+		case '\\':
+			if i >= len(replacementStr) {
+				// A trailing backslash produces nothing
+				continue
+			}
+			if r, size := unescapeReplacement(replacementStr[i:]); size > 0 {
+				// A lone surrogate cannot be represented in UTF-8, so it becomes the replacement character
+				if utf16.IsSurrogate(r) {
+					r = utf8.RuneError
+				}
+				template.literalLen += utf8.RuneLen(r)
+				i += size
+				continue
+			}
+			r, size = utf8.DecodeRuneInString(replacementStr[i:])
+			template.literalLen += utf8.RuneLen(r)
+			i += size
+		case '$':
+			rest := replacementStr[i:]
+			if strings.HasPrefix(rest, "{") {
+				end := strings.IndexByte(rest, '}')
+				if end == -1 {
+					problems = append(problems, fmt.Sprintf("%q is missing its closing brace", replacementStr[i-1:]))
+					// The rest of the string belongs to the unclosed reference
+					break parse
+				}
+				name := rest[1:end]
+				number := 0
+				for _, group := range groups {
+					if name != "" && group.name == name {
+						number = group.number
+						break
+					}
+				}
+				if number == 0 {
+					problems = append(problems, fmt.Sprintf("${%s} references a named group that does not exist", name))
+				}
+				template.references = append(template.references, number)
+				i += end + 1
+				continue
+			}
+			number, digits := 0, 0
+			for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' && number*10+int(rest[digits]-'0') <= len(groups) {
+				number = number*10 + int(rest[digits]-'0')
+				digits++
+			}
+			if digits == 0 {
+				if len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+					problems = append(problems, fmt.Sprintf("$%c references group %c, but the regex only has %d groups", rest[0], rest[0], len(groups)))
+					i++
+					continue
+				}
+				problems = append(problems, "$ must be followed by a group number or a name in braces (use \\$ for a literal dollar sign)")
+				continue
+			}
+			template.references = append(template.references, number)
+			i += digits
+		default:
+			// Invalid bytes have already become the replacement character, which is longer than the byte itself
+			template.literalLen += utf8.RuneLen(r)
+		}
+	}
+	if len(problems) > 0 {
+		return replacementTemplate{}, ErrInvalidReplacement.New(strings.Join(problems, "; "))
+	}
+	return template, nil
+}
+
+// unescapeReplacement returns the character of the \uhhhh or \Uhhhhhhhh escape that begins the given string (which
+// follows the backslash), along with the number of bytes that the escape occupies. A lead surrogate that is followed by
+// an escaped trail surrogate is combined with it. The size is zero when the string does not begin with such an escape.
+func unescapeReplacement(str string) (rune, int) {
+	digits := 0
+	switch {
+	case strings.HasPrefix(str, "u"):
+		digits = 4
+	case strings.HasPrefix(str, "U"):
+		digits = 8
+	default:
+		return 0, 0
+	}
+	if len(str) < digits+1 {
+		return 0, 0
+	}
+	value, err := strconv.ParseUint(str[1:digits+1], 16, 32)
+	if err != nil || value > utf8.MaxRune {
+		return 0, 0
+	}
+	r, size := rune(value), digits+1
+	if utf16.IsSurrogate(r) && r < 0xDC00 && strings.HasPrefix(str[size:], `\`) {
+		if trail, trailSize := unescapeReplacement(str[size+1:]); trailSize > 0 && utf16.DecodeRune(r, trail) != utf8.RuneError {
+			return utf16.DecodeRune(r, trail), size + 1 + trailSize
+		}
+	}
+	return r, size
+}
+
+// findUnnormalizedText returns the first text within the pattern that is not in the given form, along with its byte
+// offset. The match string is normalized before matching, so such text would never match. Literal text is checked in
+// runs, so that a character followed by a combining mark is found, while escaped code points (such as \u00e9) and the
+// members of a character class are checked individually. A named character (such as \N{LATIN SMALL LETTER E WITH
+// ACUTE}) cannot be resolved outside of ICU, so it is always returned. Comments are not checked.
+func (form NormalizationForm) findUnnormalizedText(pattern string, flags RegexFlags) (text string, offset int, ok bool) {
+	if form == NormalizationForm_None {
+		return "", 0, false
+	}
+	if flags&RegexFlags_Literal != 0 {
+		if form.normalize(pattern) != pattern {
+			return pattern, 0, true
+		}
+		return "", 0, false
+	}
+	comments := flags&RegexFlags_Comments != 0
+	// The run is the literal text since the last piece of syntax, while runStart is where the run began in the pattern
+	run := strings.Builder{}
+	runStart := 0
+	flush := func() bool {
+		if str := run.String(); form.normalize(str) != str {
+			text, offset, ok = str, runStart, true
+		}
+		run.Reset()
+		return ok
+	}
+	appendRun := func(start int, str string) {
+		if run.Len() == 0 {
+			runStart = start
+		}
+		run.WriteString(str)
+	}
+	// checkEscape reports whether the escape at the given position denotes a code point that is not in the form
+	checkEscape := func(start int, escape string) bool {
+		if len(escape) > 1 && escape[1] == 'N' {
+			text, offset, ok = escape, start, true
+			return true
+		}
+		if r, isCodePoint := escapedCodePoint(escape); isCodePoint && form.normalize(string(r)) != string(r) {
+			text, offset, ok = escape, start, true
+		}
+		return ok
+	}
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], `\Q`):
+			// Quoted text is literal, so it joins the run
+			end := strings.Index(pattern[i+2:], `\E`)
+			if end == -1 {
+				appendRun(i+2, pattern[i+2:])
+				i = len(pattern)
+			} else {
+				appendRun(i+2, pattern[i+2:i+2+end])
+				i += end + 4
+			}
+		case c == '\\':
+			end := i + escapeLen(pattern[i:])
+			if r, isCodePoint := escapedCodePoint(pattern[i:end]); isCodePoint {
+				// An escaped code point is literal, so it joins the run
+				appendRun(i, string(r))
+			} else if flush() || checkEscape(i, pattern[i:end]) {
+				return text, offset, ok
+			}
+			i = end
+		case c == '[':
+			if flush() {
+				return text, offset, ok
+			}
+			end := skipCharacterClass(pattern, i) + 1
+			for j := i + 1; j < end; {
+				if pattern[j] == '\\' {
+					escapeEnd := j + escapeLen(pattern[j:])
+					if checkEscape(j, pattern[j:escapeEnd]) {
+						return text, offset, ok
+					}
+					j = escapeEnd
+					continue
+				}
+				r, size := utf8.DecodeRuneInString(pattern[j:])
+				if form.normalize(string(r)) != string(r) {
+					return string(r), j, true
+				}
+				j += size
+			}
+			i = end
+		case strings.HasPrefix(pattern[i:], "(?#"), comments && c == '#':
+			if flush() {
+				return text, offset, ok
+			}
+			terminator := byte(')')
+			if c == '#' {
+				terminator = '\n'
+			}
+			if end := strings.IndexByte(pattern[i:], terminator); end != -1 {
+				i += end + 1
+			} else {
+				i = len(pattern)
+			}
+		case strings.IndexByte(`()|.^$?*+{}`, c) != -1, comments && strings.IndexByte(" \t\n\r\f\v", c) != -1:
+			if flush() {
+				return text, offset, ok
+			}
+			i++
+		default:
+			_, size := utf8.DecodeRuneInString(pattern[i:])
+			appendRun(i, pattern[i:i+size])
+			i += size
+		}
+	}
+	flush()
+	return text, offset, ok
+}
+
+// escapedCodePoint returns the code point that the given escape sequence denotes, such as \u00e9 or \., and whether the
+// escape denotes a single code point rather than a piece of syntax (such as \w or \b).
+func escapedCodePoint(escape string) (rune, bool) {
+	if len(escape) < 2 {
+		return 0, false
+	}
+	var digits string
+	base := 16
+	switch escape[1] {
+	case 'u', 'U':
+		digits = escape[2:]
+	case 'x':
+		digits = strings.TrimSuffix(strings.TrimPrefix(escape[2:], "{"), "}")
+	case '0':
+		digits, base = escape[1:], 8
+	default:
+		r, _ := utf8.DecodeRuneInString(escape[1:])
+		if r < utf8.RuneSelf && ('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return 0, false
+		}
+		return r, true
+	}
+	value, err := strconv.ParseUint(digits, base, 32)
+	if err != nil || value > utf8.MaxRune {
+		return 0, false
+	}
+	return rune(value), true
+}
+
+// escapeLen returns the length in bytes of the escape sequence that begins the given pattern, including the backslash.
+func escapeLen(pattern string) int {
+	if len(pattern) < 2 {
+		return len(pattern)
+	}
+	length := 2
+	switch pattern[1] {
+	case 'u':
+		length = 6
+	case 'U':
+		length = 10
+	case 'x':
+		length = 4
+		if pattern[2:3] == "{" {
+			length = strings.IndexByte(pattern, '}') + 1
+		}
+	case 'p', 'P', 'N':
+		length = 3
+		if pattern[2:3] == "{" {
+			length = strings.IndexByte(pattern, '}') + 1
+		}
+	case 'k':
+		if pattern[2:3] == "<" {
+			length = strings.IndexByte(pattern, '>') + 1
+		}
+	case 'c':
+		length = 3
+	case '0':
+		for length < 5 && length < len(pattern) && pattern[length] >= '0' && pattern[length] <= '7' {
+			length++
+		}
+	default:
+		_, size := utf8.DecodeRuneInString(pattern[1:])
+		length = 1 + size
+	}
+	if length <= 1 || length > len(pattern) {
+		return len(pattern)
+	}
+	return length
+}
+
+// normalize returns the given string normalized to the given form.
+func (form NormalizationForm) normalize(str string) string {
+	switch form {
+	case NormalizationForm_NFC:
+		return norm.NFC.String(str)
+	case NormalizationForm_NFD:
+		return norm.NFD.String(str)
+	case NormalizationForm_NFKC:
+		return norm.NFKC.String(str)
+	case NormalizationForm_NFKD:
+		return norm.NFKD.String(str)
+	default:
+		return str
+	}
+}
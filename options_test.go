@@ -0,0 +1,243 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithNormalization(t *testing.T) {
+	ctx := context.Background()
+	const cafeNFC = "caf\u00e9"
+	const cafeNFD = "cafe\u0301"
+
+	regex := CreateRegex(0)
+	require.NoError(t, regex.SetRegexString(ctx, `^`+cafeNFC+`$`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, cafeNFD))
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, regex.Close())
+
+	regex = CreateRegex(0, WithNormalization(NormalizationForm_NFC))
+	require.NoError(t, regex.SetRegexString(ctx, `^`+cafeNFC+`$`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, cafeNFD))
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	// The match string was normalized, so the returned text is the NFC form
+	_, match, _, ok, err := regex.Partition(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, cafeNFC, match)
+	require.NoError(t, regex.Close())
+
+	regex = CreateRegex(0, WithNormalization(NormalizationForm_NFD))
+	require.NoError(t, regex.SetRegexString(ctx, `^`+cafeNFD+`$`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, cafeNFC))
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.Close())
+
+	// The regex string is not normalized, so text that is not in the form is rejected as it could never match
+	rejected := []struct {
+		form    NormalizationForm
+		pattern string
+		flags   RegexFlags
+		text    string
+		offset  int
+	}{
+		{NormalizationForm_NFC, "^cafe\u0301$", RegexFlags_None, "cafe\u0301", 1},
+		{NormalizationForm_NFC, "^e\\u0301$", RegexFlags_None, "e\u0301", 1},
+		{NormalizationForm_NFC, "^(?:\\N{ANGSTROM SIGN})$", RegexFlags_None, "\\N{ANGSTROM SIGN}", 4},
+		{NormalizationForm_NFD, "^[\u00e9]$", RegexFlags_None, "\u00e9", 2},
+		{NormalizationForm_NFD, "^[^\u00e0-\u00ff]$", RegexFlags_None, "\u00e0", 3},
+		{NormalizationForm_NFD, "^[a\\x{e9}]$", RegexFlags_None, "\\x{e9}", 3},
+		{NormalizationForm_NFD, "^\\Q\u00e9.\\E{2}$", RegexFlags_None, "\u00e9.", 3},
+		{NormalizationForm_NFD, "caf\u00e9", RegexFlags_Literal, "caf\u00e9", 0},
+		{NormalizationForm_NFKC, "^\uff08a\uff09$", RegexFlags_None, "\uff08a\uff09", 1},
+		{NormalizationForm_NFKC, "^a\u00a0b$", RegexFlags_Comments, "a\u00a0b", 1},
+	}
+	for _, test := range rejected {
+		t.Run(test.pattern, func(t *testing.T) {
+			regex := CreateRegex(0, WithNormalization(test.form))
+			defer regex.Close()
+			err := regex.SetRegexString(ctx, test.pattern, test.flags)
+			require.True(t, ErrPatternNotNormalized.Is(err), "%v", err)
+			require.Equal(t, ErrPatternNotNormalized.New(test.text, test.offset).Error(), err.Error())
+		})
+	}
+
+	// Patterns that are already in the form are accepted, and comments are not checked
+	accepted := []struct {
+		form     NormalizationForm
+		pattern  string
+		flags    RegexFlags
+		matches  []string
+		failures []string
+	}{
+		{NormalizationForm_NFD, "^cafe\u0301+$", RegexFlags_None, []string{"caf\u00e9\u0301"}, []string{"cafe"}},
+		{NormalizationForm_NFD, "^[a-z]\\x{301}$", RegexFlags_None, []string{"\u00e9"}, []string{"e"}},
+		{NormalizationForm_NFKC, "^(A)[*]$", RegexFlags_None, []string{"A*", "\uff21\uff0a"}, []string{"AA"}},
+		{NormalizationForm_NFKC, "^a b # \uff09", RegexFlags_Comments, []string{"ab"}, []string{"a b", "a\u00a0b"}},
+		{NormalizationForm_NFKD, "(?#\uff09)^a$", RegexFlags_None, []string{"a", "\uff41"}, []string{"b"}},
+	}
+	for _, test := range accepted {
+		t.Run(test.pattern, func(t *testing.T) {
+			regex := CreateRegex(0, WithNormalization(test.form))
+			defer regex.Close()
+			require.NoError(t, regex.SetRegexString(ctx, test.pattern, test.flags))
+			for _, input := range test.matches {
+				require.NoError(t, regex.SetMatchString(ctx, input))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.True(t, ok, input)
+			}
+			for _, input := range test.failures {
+				require.NoError(t, regex.SetMatchString(ctx, input))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.False(t, ok, input)
+			}
+		})
+	}
+}
+
+func TestWithReplacementSyntax(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(0)
+	require.NoError(t, regex.SetRegexString(ctx, `(\w+)@(\w+)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "user@host"))
+	replaced, err := regex.Replace(ctx, `$2 at $1 costs \$5`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "host at user costs $5", replaced)
+	require.NoError(t, regex.Close())
+
+	regex = CreateRegex(0, WithReplacementSyntax(ReplacementSyntax_MySQL))
+	require.NoError(t, regex.SetRegexString(ctx, `(\w+)@(\w+)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "user@host"))
+	replaced, err = regex.Replace(ctx, `\2 at \1 costs $5`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "host at user costs $5", replaced)
+	replaced, err = regex.Replace(ctx, `[\0] \\1 \x $$ \`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, `[user@host] \1 x $$ \`, replaced)
+	require.NoError(t, regex.Close())
+
+	// A MySQL reference is a single digit, so the digits that follow it are literal even when more groups exist
+	regex = CreateRegex(0, WithReplacementSyntax(ReplacementSyntax_MySQL))
+	defer regex.Close()
+	require.NoError(t, regex.SetRegexString(ctx, strings.Repeat(`(\w)`, 12), RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "abcdefghijkl"))
+	replaced, err = regex.Replace(ctx, `\12`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "a2", replaced)
+	replaced, err = regex.Replace(ctx, `\1\2 \10`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "ab a0", replaced)
+	require.NoError(t, regex.ValidateReplacement(ctx, `\12`))
+}
+
+func TestWithRejectLoneSurrogates(t *testing.T) {
+	ctx := context.Background()
+	// This is how U+D800 would be encoded if UTF-8 allowed surrogates, which Go treats as three invalid bytes
+	loneSurrogate := "\xed\xa0\x80"
+	text := "ab" + loneSurrogate + "c"
+
+	// Without the option, each invalid byte silently becomes U+FFFD
+	regex := CreateRegex(0)
+	require.NoError(t, regex.SetRegexString(ctx, `b\x{FFFD}+c`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, text))
+	results, err := regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b\uFFFD\uFFFD\uFFFDc"}, results)
+	require.NoError(t, regex.Close())
+
+	regex = CreateRegex(0, WithRejectLoneSurrogates())
+	defer regex.Close()
+	err = regex.SetRegexString(ctx, "x"+loneSurrogate, RegexFlags_None)
+	require.True(t, ErrInvalidUTF16.Is(err))
+	require.Equal(t, "the string contains a lone surrogate at byte 1", err.Error())
+	require.NoError(t, regex.SetRegexString(ctx, `b`, RegexFlags_None))
+	require.True(t, ErrInvalidUTF16.Is(regex.SetMatchString(ctx, text)))
+	// Other invalid UTF-8 and astral characters (which are surrogate pairs in UTF-16) are still accepted
+	require.NoError(t, regex.SetMatchString(ctx, "ab\xffc😀"))
+	require.True(t, ErrInvalidUTF16.Is(regex.RefreshText(ctx, "a"+loneSurrogate)))
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestWithBufferGrowthFactor(t *testing.T) {
+	ctx := context.Background()
+	sizes := make(map[float64]uint32)
+	for _, factor := range []float64{2, 1.25, 1, 0.5} {
+		regex := CreateRegex(0, WithBufferGrowthFactor(factor))
+		require.NoError(t, regex.SetRegexString(ctx, `b`, RegexFlags_None))
+		require.NoError(t, regex.SetMatchString(ctx, "abc"))
+		// The replacement buffer grows for the second (larger) replacement, but not for the third (smaller) one
+		for _, length := range []int{1000, 1100, 1050} {
+			replaced, err := regex.Replace(ctx, strings.Repeat("x", length), 1, 0)
+			require.NoError(t, err)
+			require.Len(t, replaced, length+2)
+		}
+		sizes[factor] = regex.(*privateRegex).replacementStrBuffer.size
+		require.NoError(t, regex.Close())
+	}
+	// Doubling grows from 2000 bytes to 4000 bytes, while exact sizing only grows to the 2200 bytes that are needed
+	require.Equal(t, uint32(4000), sizes[2])
+	require.Equal(t, uint32(2500), sizes[1.25])
+	require.Equal(t, uint32(2200), sizes[1])
+	require.Equal(t, uint32(2200), sizes[0.5])
+}
+
+func TestWithStrictFlags(t *testing.T) {
+	ctx := context.Background()
+
+	// Without the option, the inline flag silently overrides the given flag
+	regex := CreateRegex(0)
+	require.NoError(t, regex.SetRegexString(ctx, `(?-i)abc`, RegexFlags_Case_Insensitive))
+	require.NoError(t, regex.SetMatchString(ctx, "ABC"))
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, regex.Close())
+
+	regex = CreateRegex(0, WithStrictFlags())
+	defer regex.Close()
+	err = regex.SetRegexString(ctx, `(?-i)abc`, RegexFlags_Case_Insensitive)
+	require.True(t, ErrConflictingFlags.Is(err))
+	require.Equal(t, "the inline flags (?-i) at offset 0 contradict the given RegexFlags", err.Error())
+	err = regex.SetRegexString(ctx, `ab(?i:c)`, RegexFlags_None)
+	require.True(t, ErrConflictingFlags.Is(err))
+	require.Equal(t, "the inline flags (?i) at offset 2 contradict the given RegexFlags", err.Error())
+	err = regex.SetRegexString(ctx, `(?s)a(?m-i)b`, RegexFlags_Case_Insensitive|RegexFlags_Dot_All)
+	require.True(t, ErrConflictingFlags.Is(err))
+	require.Equal(t, "the inline flags (?m-i) at offset 5 contradict the given RegexFlags", err.Error())
+
+	// Inline flags that agree with the given flags, and escaped or quoted flag groups, are allowed
+	require.NoError(t, regex.SetRegexString(ctx, `(?i)a(?-m:b)`, RegexFlags_Case_Insensitive))
+	require.NoError(t, regex.SetRegexString(ctx, `\(?-i\)[(?-i)]\Q(?-i)\E`, RegexFlags_Case_Insensitive))
+	require.NoError(t, regex.SetRegexString(ctx, `abc`, RegexFlags_Case_Insensitive))
+	require.NoError(t, regex.SetMatchString(ctx, "ABC"))
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
@@ -0,0 +1,720 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// ErrInlineFlagsNotHoistable is returned by StripInlineFlags when a pattern contains inline flags that cannot be
+// expressed as RegexFlags.
+var ErrInlineFlagsNotHoistable = errors.NewKind("the inline flags (?%s) at offset %d cannot be converted to RegexFlags")
+
+// inlineFlagValues are the RegexFlags that are equivalent to each inline flag.
+var inlineFlagValues = map[rune]RegexFlags{
+	'i': RegexFlags_Case_Insensitive,
+	'm': RegexFlags_Multiline,
+	's': RegexFlags_Dot_All,
+	'x': RegexFlags_Comments,
+	'w': RegexFlags_Unicode_Word,
+	'd': RegexFlags_Unix_Lines,
+}
+
+// QuoteMeta returns a pattern that matches the given text literally, by escaping every character that has a special
+// meaning in a pattern. Whitespace and "#" are escaped as well, so that the result is also literal when using
+// RegexFlags_Comments.
+func QuoteMeta(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		switch r {
+		case '\\', '.', '+', '*', '?', '(', ')', '|', '[', ']', '{', '}', '^', '$', '#', ' ', '\t', '\n', '\r', '\f', '\v':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// globToPattern translates a shell-style glob into an equivalent pattern that must match the entire string. A "*"
+// matches any sequence of characters, a "?" matches any single character, and character classes such as "[a-z]" are
+// passed through, where a leading "!" negates the class as it does in a shell. A backslash matches the following
+// character literally, and every other character also matches literally. A "[" without a closing "]" is literal.
+func globToPattern(glob string) string {
+	var sb strings.Builder
+	sb.WriteString(`\A(?:`)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				_, size := utf8.DecodeRuneInString(glob[i+1:])
+				sb.WriteString(QuoteMeta(glob[i+1 : i+1+size]))
+				i += size
+			} else {
+				sb.WriteString(QuoteMeta(`\`))
+			}
+		case '[':
+			// A closing bracket immediately following the opening bracket (or its negation) is a member of the class
+			end := i + 1
+			if end < len(glob) && (glob[end] == '!' || glob[end] == '^') {
+				end++
+			}
+			if end < len(glob) && glob[end] == ']' {
+				end++
+			}
+			closing := strings.IndexByte(glob[end:], ']')
+			if closing == -1 {
+				sb.WriteString(QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : end+closing]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i = end + closing
+		default:
+			_, size := utf8.DecodeRuneInString(glob[i:])
+			sb.WriteString(QuoteMeta(glob[i : i+size]))
+			i += size - 1
+		}
+	}
+	sb.WriteString(`)\z`)
+	return sb.String()
+}
+
+// isStartAnchored returns whether the pattern can only ever match at the beginning of the match string. This is true
+// when the pattern begins with \A, or with ^ while not in multiline mode, and there is no top-level alternation that
+// could begin elsewhere. The analysis is conservative, so a false result does not guarantee that the pattern is
+// unanchored.
+func isStartAnchored(pattern string, flags RegexFlags) bool {
+	// Literal patterns treat ^ and \A as regular characters, and comments may hide grouping characters from the scan
+	if flags&(RegexFlags_Literal|RegexFlags_Comments) != 0 {
+		return false
+	}
+	multiline := flags&RegexFlags_Multiline != 0
+	rest := pattern
+	// Leading flag groups, such as (?i), apply to the remainder of the pattern, so we skip them while tracking whether
+	// they change the multiline mode
+	for strings.HasPrefix(rest, "(?") {
+		flagList, ok := inlineFlagList(rest[1:])
+		if !ok || rest[len(flagList)+2] != ')' {
+			break
+		}
+		enabled, disabled, _ := strings.Cut(flagList, "-")
+		if strings.ContainsRune(enabled, 'x') {
+			return false
+		}
+		if strings.ContainsRune(enabled, 'm') {
+			multiline = true
+		}
+		if strings.ContainsRune(disabled, 'm') {
+			multiline = false
+		}
+		rest = rest[len(flagList)+3:]
+	}
+	switch anchorLen := leadingAnchorLen(rest); {
+	case anchorLen == 2:
+	case anchorLen == 1 && !multiline:
+	default:
+		return false
+	}
+	return !hasTopLevelAlternation(pattern)
+}
+
+// leadingAnchorLen returns the length of the \A or ^ that begins the given pattern, or 0 if it does not begin with one.
+// An anchor followed by a quantifier (such as ^? or ^{0}) is not counted, as ICU accepts it and it may then match
+// anywhere.
+func leadingAnchorLen(pattern string) int {
+	anchorLen := 0
+	switch {
+	case strings.HasPrefix(pattern, `\A`):
+		anchorLen = 2
+	case strings.HasPrefix(pattern, "^"):
+		anchorLen = 1
+	default:
+		return 0
+	}
+	if len(pattern) > anchorLen && strings.IndexByte("?*+{", pattern[anchorLen]) != -1 {
+		return 0
+	}
+	return anchorLen
+}
+
+// stripStartAnchor returns the pattern without its leading ^ or \A, while keeping any leading flag groups. Returns
+// false if the pattern does not begin with an anchor, or if it has a top-level alternation (where the anchor only
+// applies to the first alternative).
+func stripStartAnchor(pattern string) (string, bool) {
+	if hasTopLevelAlternation(pattern) {
+		return "", false
+	}
+	rest := pattern
+	for strings.HasPrefix(rest, "(?") {
+		flagList, ok := inlineFlagList(rest[1:])
+		if !ok || rest[len(flagList)+2] != ')' {
+			break
+		}
+		rest = rest[len(flagList)+3:]
+	}
+	prefix := pattern[:len(pattern)-len(rest)]
+	anchorLen := leadingAnchorLen(rest)
+	if anchorLen == 0 {
+		return "", false
+	}
+	return prefix + rest[anchorLen:], true
+}
+
+// stripEndAnchor returns the pattern without its trailing $, \z, or \Z. Returns false if the pattern does not end with
+// an anchor, or if it has a top-level alternation (where the anchor only applies to the last alternative).
+func stripEndAnchor(pattern string) (string, bool) {
+	if hasTopLevelAlternation(pattern) {
+		return "", false
+	}
+	// An anchor that is escaped is a literal, which we determine by counting the preceding backslashes
+	trailingBackslashes := func(s string) int {
+		count := 0
+		for i := len(s) - 1; i >= 0 && s[i] == '\\'; i-- {
+			count++
+		}
+		return count
+	}
+	switch {
+	case strings.HasSuffix(pattern, "$") && trailingBackslashes(pattern[:len(pattern)-1])%2 == 0:
+		return pattern[:len(pattern)-1], true
+	case (strings.HasSuffix(pattern, `\z`) || strings.HasSuffix(pattern, `\Z`)) && trailingBackslashes(pattern[:len(pattern)-1])%2 == 1:
+		return pattern[:len(pattern)-2], true
+	default:
+		return "", false
+	}
+}
+
+// inlineFlagList returns the flags of a flag group, when given the text immediately following the group's opening
+// parenthesis. For example, "?i-m)" and "?i-m:abc)" both return "i-m". Returns false if the text does not begin a
+// flag group.
+func inlineFlagList(s string) (string, bool) {
+	if !strings.HasPrefix(s, "?") {
+		return "", false
+	}
+	end := strings.IndexAny(s, ":)")
+	if end < 2 {
+		return "", false
+	}
+	for _, r := range s[1:end] {
+		switch r {
+		case 'i', 'm', 's', 'x', 'w', 'd', '-':
+		default:
+			return "", false
+		}
+	}
+	return s[1:end], true
+}
+
+// HasInlineFlags returns whether the pattern contains any inline flags, either as a flag group such as "(?i)", or as a
+// group with scoped flags such as "(?i:abc)". MySQL does not support inline flags, so this may be used to reject them.
+// Escaped parentheses, quoted sequences, and character classes are skipped.
+func HasInlineFlags(pattern string) bool {
+	_, _, ok := findInlineFlags(pattern)
+	return ok
+}
+
+// StripInlineFlags removes the inline flags from the pattern, and returns the remaining pattern along with the
+// RegexFlags that are equivalent to the removed inline flags, which should be combined with any other flags given to
+// SetRegexString. For example, "(?i)abc" returns "abc" and RegexFlags_Case_Insensitive. Inline flags can only be
+// converted when they apply to the entire pattern, meaning that they're either in flag groups at the beginning of the
+// pattern, or in a group with scoped flags that encloses the entire pattern. Flags that are turned off, such as
+// "(?-i)", cannot be converted either. All other inline flags return ErrInlineFlagsNotHoistable. A pattern without any
+// inline flags is returned unchanged.
+func StripInlineFlags(pattern string) (string, RegexFlags, error) {
+	flags := RegexFlags_None
+	rest := pattern
+	// The offset of the remaining pattern within the original pattern, which is used when reporting errors
+	offset := 0
+	for strings.HasPrefix(rest, "(?") {
+		flagList, ok := inlineFlagList(rest[1:])
+		if !ok {
+			break
+		}
+		enabled, disabled, _ := strings.Cut(flagList, "-")
+		if disabled != "" {
+			break
+		}
+		if rest[len(flagList)+2] == ')' {
+			rest = rest[len(flagList)+3:]
+		} else if closing := matchingParenthesis(rest, 0); closing == len(rest)-1 {
+			rest = rest[len(flagList)+3 : closing]
+		} else {
+			break
+		}
+		offset += len(flagList) + 3
+		for _, r := range enabled {
+			flags |= inlineFlagValues[r]
+		}
+	}
+	if idx, flagList, ok := findInlineFlags(rest); ok {
+		return "", RegexFlags_None, ErrInlineFlagsNotHoistable.New(flagList, offset+idx)
+	}
+	return rest, flags, nil
+}
+
+// findInlineFlags returns the index and flags of the first group within the pattern that contains inline flags.
+func findInlineFlags(pattern string) (idx int, flagList string, ok bool) {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i+1 < len(pattern) && pattern[i+1] == 'Q' {
+				end := strings.Index(pattern[i+2:], `\E`)
+				if end == -1 {
+					return 0, "", false
+				}
+				i += end + 3
+			} else {
+				i++
+			}
+		case '[':
+			i = skipCharacterClass(pattern, i)
+		case '(':
+			if flagList, ok := inlineFlagList(pattern[i+1:]); ok {
+				return i, flagList, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// findFlagConflict returns the index and flags of the first group within the pattern whose inline flags contradict the
+// given RegexFlags, either by turning off a flag that is set, or by turning on a flag that is not set.
+func findFlagConflict(pattern string, flags RegexFlags) (idx int, flagList string, ok bool) {
+	offset := 0
+	for {
+		idx, flagList, ok := findInlineFlags(pattern[offset:])
+		if !ok {
+			return 0, "", false
+		}
+		enabled, disabled, _ := strings.Cut(flagList, "-")
+		for _, r := range enabled {
+			if flags&inlineFlagValues[r] == 0 {
+				return offset + idx, flagList, true
+			}
+		}
+		for _, r := range disabled {
+			if flags&inlineFlagValues[r] != 0 {
+				return offset + idx, flagList, true
+			}
+		}
+		offset += idx + len(flagList) + 2
+	}
+}
+
+// matchingParenthesis returns the index of the closing parenthesis of the group that begins at the given index.
+// Escaped parentheses, quoted sequences, and character classes are skipped. Returns -1 if the group is never closed.
+func matchingParenthesis(pattern string, start int) int {
+	depth := 0
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i+1 < len(pattern) && pattern[i+1] == 'Q' {
+				end := strings.Index(pattern[i+2:], `\E`)
+				if end == -1 {
+					return -1
+				}
+				i += end + 3
+			} else {
+				i++
+			}
+		case '[':
+			i = skipCharacterClass(pattern, i)
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// hasTopLevelAlternation returns whether the pattern contains an alternation operator (|) that is not nested within a
+// group. Escaped characters, quoted sequences, and character classes are skipped. As comments may hide grouping
+// characters from the scan, patterns that enable comments mode are assumed to have an alternation.
+func hasTopLevelAlternation(pattern string) bool {
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i+1 < len(pattern) && pattern[i+1] == 'Q' {
+				end := strings.Index(pattern[i+2:], `\E`)
+				if end == -1 {
+					return false
+				}
+				i += end + 3
+			} else {
+				i++
+			}
+		case '[':
+			i = skipCharacterClass(pattern, i)
+		case '(':
+			if flagList, ok := inlineFlagList(pattern[i+1:]); ok {
+				if enabled, _, _ := strings.Cut(flagList, "-"); strings.ContainsRune(enabled, 'x') {
+					return true
+				}
+			}
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipCharacterClass returns the index of the closing bracket of the character class that begins at the given index.
+// Nested character classes are skipped as well. If the class is never closed, then the last index is returned.
+func skipCharacterClass(pattern string, start int) int {
+	depth := 0
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+			// A closing bracket immediately following the opening bracket (or its negation) is a literal
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+			}
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(pattern) - 1
+}
+
+// patternGroup is a capture group within a pattern.
+type patternGroup struct {
+	// number is the group's number, starting at 1.
+	number int
+	// name is the group's name, which is empty for unnamed groups.
+	name string
+	// parent is the number of the innermost capture group that contains this group, or 0 if there is none.
+	parent int
+	// offset is the byte offset of the group's opening parenthesis within the pattern.
+	offset int
+}
+
+// duplicateGroupName returns the first name that is given to multiple groups, along with the numbers of the first two
+// groups that have that name.
+func duplicateGroupName(groups []patternGroup) (name string, first int, second int, ok bool) {
+	numbers := make(map[string]int)
+	for _, group := range groups {
+		if group.name == "" {
+			continue
+		}
+		if number, exists := numbers[group.name]; exists {
+			return group.name, number, group.number, true
+		}
+		numbers[group.name] = group.number
+	}
+	return "", 0, 0, false
+}
+
+// stripCaptureGroups returns the pattern with every capture group rewritten as a non-capturing group, so that ICU does
+// not need to track group positions while matching. Patterns containing a backreference are returned unchanged, as the
+// referenced groups must continue to capture. The pattern is assumed to be valid, as with scanGroups.
+func stripCaptureGroups(pattern string, flags RegexFlags) string {
+	groups := scanGroups(pattern, flags)
+	if len(groups) == 0 || hasBackreference(pattern) {
+		return pattern
+	}
+	sb := strings.Builder{}
+	sb.Grow(len(pattern) + len(groups)*2)
+	last := 0
+	for _, group := range groups {
+		sb.WriteString(pattern[last : group.offset+1])
+		sb.WriteString("?:")
+		last = group.offset + 1
+		if group.name != "" {
+			// Skips the "?<name>" that follows the parenthesis
+			last += len(group.name) + 3
+		}
+	}
+	sb.WriteString(pattern[last:])
+	return sb.String()
+}
+
+// hasBackreference returns whether the pattern may contain a backreference, either by number (\1) or by name (\k<name>).
+// Escapes within character classes, quotes, and comments are also counted, so this may report a backreference that
+// does not exist, but it never misses one.
+func hasBackreference(pattern string) bool {
+	for i := 0; i+1 < len(pattern); i++ {
+		if pattern[i] != '\\' {
+			continue
+		}
+		if c := pattern[i+1]; (c >= '1' && c <= '9') || c == 'k' {
+			return true
+		}
+		i++
+	}
+	return false
+}
+
+// scanGroups returns every capture group within the pattern, in the order of their numbers. ICU's
+// uregex_groupCount and uregex_groupNumberFromName are not exported from the module, so this mirrors how ICU's
+// compiler identifies capture groups. The pattern is assumed to be valid, as it should have already been compiled.
+func scanGroups(pattern string, flags RegexFlags) []patternGroup {
+	return scanPattern(pattern, flags).groups
+}
+
+// patternScan is the result of scanning a pattern with scanPattern.
+type patternScan struct {
+	// groups are the capture groups within the pattern, in the order of their numbers.
+	groups []patternGroup
+	// commentsAtEnd is whether comments mode is in effect at the end of the pattern, whether from the flags or from
+	// inline flags, so that anything appended to the pattern could be swallowed by a trailing comment.
+	commentsAtEnd bool
+	// quotedAtEnd is whether the pattern ends within a \Q sequence that is never closed by \E.
+	quotedAtEnd bool
+}
+
+// scanPattern scans the pattern for its capture groups, along with the modes that are still in effect at its end. This
+// mirrors how ICU's compiler reads the pattern, as described in scanGroups.
+func scanPattern(pattern string, flags RegexFlags) patternScan {
+	if flags&RegexFlags_Literal != 0 {
+		return patternScan{}
+	}
+	type openGroup struct {
+		number   int // zero for groups that do not capture
+		comments bool
+	}
+	var groups []patternGroup
+	var stack []openGroup
+	comments := flags&RegexFlags_Comments != 0
+	quoted := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case comments && (c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'):
+		case comments && c == '#':
+			if end := strings.IndexByte(pattern[i:], '\n'); end != -1 {
+				i += end
+			} else {
+				i = len(pattern)
+			}
+		case c == '\\':
+			if i+1 < len(pattern) && pattern[i+1] == 'Q' {
+				if end := strings.Index(pattern[i+2:], `\E`); end != -1 {
+					i += end + 3
+				} else {
+					i = len(pattern)
+					quoted = true
+				}
+			} else {
+				i++
+			}
+		case c == '[':
+			i = skipCharacterClass(pattern, i)
+		case c == '(':
+			parent := 0
+			for j := len(stack) - 1; j >= 0; j-- {
+				if stack[j].number != 0 {
+					parent = stack[j].number
+					break
+				}
+			}
+			rest := pattern[i+1:]
+			switch {
+			case !strings.HasPrefix(rest, "?"):
+				groups = append(groups, patternGroup{number: len(groups) + 1, parent: parent, offset: i})
+				stack = append(stack, openGroup{number: len(groups), comments: comments})
+			case strings.HasPrefix(rest, "?<") && len(rest) > 2 && rest[2] != '=' && rest[2] != '!':
+				name := rest[2:]
+				if end := strings.IndexByte(name, '>'); end != -1 {
+					name = name[:end]
+				}
+				groups = append(groups, patternGroup{number: len(groups) + 1, name: name, parent: parent, offset: i})
+				stack = append(stack, openGroup{number: len(groups), comments: comments})
+			case strings.HasPrefix(rest, "?#"):
+				if end := strings.IndexByte(rest, ')'); end != -1 {
+					i += end + 1
+				} else {
+					i = len(pattern)
+				}
+			default:
+				stack = append(stack, openGroup{comments: comments})
+				// Flag groups change the mode either for the rest of the enclosing group, or only within themselves
+				if flagList, ok := inlineFlagList(rest); ok {
+					comments = applyCommentsFlag(comments, flagList)
+					if rest[len(flagList)+1] == ')' {
+						stack = stack[:len(stack)-1]
+						i += len(flagList) + 2
+					}
+				}
+			}
+		case c == ')':
+			if len(stack) > 0 {
+				comments = stack[len(stack)-1].comments
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return patternScan{groups: groups, commentsAtEnd: comments, quotedAtEnd: quoted}
+}
+
+// patternCut is a point at which a pattern may be cut short, so that the text before it is a prefix of the pattern.
+type patternCut struct {
+	// offset is the byte offset of the cut within the pattern.
+	offset int
+	// open is the number of groups that are still open at the cut, which must be closed for the prefix to be valid.
+	open int
+}
+
+// patternCuts returns the points between the tokens of the pattern at which it may be cut short, in order, so that the
+// prefix before each cut is a valid pattern once its open groups are closed. A cut is never made within an escape, a
+// quote, a character class, or the opening of a group, nor before a quantifier, as the quantifier belongs to the token
+// before it. Cuts are also not made directly after an opening parenthesis or "|", as the empty alternative that would
+// remain matches anywhere. The pattern is assumed to be valid, as with scanGroups.
+func patternCuts(pattern string, flags RegexFlags) []patternCut {
+	var cuts []patternCut
+	if flags&RegexFlags_Literal != 0 {
+		for i := range pattern {
+			if i > 0 {
+				cuts = append(cuts, patternCut{offset: i})
+			}
+		}
+		return cuts
+	}
+	// Each open group holds the comments mode to restore once it closes
+	var stack []bool
+	comments := flags&RegexFlags_Comments != 0
+	canCut := false
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		// Whitespace, comments, and flag groups are not tokens, so they neither receive a cut nor allow one after them
+		switch {
+		case comments && (c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'):
+			i++
+			continue
+		case comments && c == '#':
+			if end := strings.IndexByte(pattern[i:], '\n'); end != -1 {
+				i += end + 1
+			} else {
+				i = len(pattern)
+			}
+			continue
+		case strings.HasPrefix(pattern[i:], "(?#"):
+			if end := strings.IndexByte(pattern[i:], ')'); end != -1 {
+				i += end + 1
+			} else {
+				i = len(pattern)
+			}
+			continue
+		case c == '(':
+			if flagList, ok := inlineFlagList(pattern[i+1:]); ok && pattern[i+len(flagList)+2] == ')' {
+				comments = applyCommentsFlag(comments, flagList)
+				i += len(flagList) + 3
+				continue
+			}
+		case c == '?' || c == '*' || c == '+':
+			i++
+			continue
+		case c == '{':
+			if end := strings.IndexByte(pattern[i:], '}'); end != -1 {
+				i += end + 1
+			} else {
+				i = len(pattern)
+			}
+			continue
+		}
+		// Closing a group gives the same prefix as cutting just before it
+		if canCut && c != ')' {
+			cuts = append(cuts, patternCut{offset: i, open: len(stack)})
+		}
+		canCut = true
+		switch c {
+		case '\\':
+			if strings.HasPrefix(pattern[i:], `\Q`) {
+				if end := strings.Index(pattern[i+2:], `\E`); end != -1 {
+					i += end + 4
+				} else {
+					i = len(pattern)
+				}
+			} else {
+				i += escapeLen(pattern[i:])
+			}
+		case '[':
+			i = skipCharacterClass(pattern, i) + 1
+		case '(':
+			stack = append(stack, comments)
+			rest := pattern[i+1:]
+			switch {
+			case strings.HasPrefix(rest, "?<=") || strings.HasPrefix(rest, "?<!"):
+				i += 4
+			case strings.HasPrefix(rest, "?<"):
+				i += strings.IndexByte(rest, '>') + 2
+			case strings.HasPrefix(rest, "?:") || strings.HasPrefix(rest, "?=") || strings.HasPrefix(rest, "?!") ||
+				strings.HasPrefix(rest, "?>"):
+				i += 3
+			default:
+				if flagList, ok := inlineFlagList(rest); ok {
+					comments = applyCommentsFlag(comments, flagList)
+					i += len(flagList) + 3
+				} else {
+					i++
+				}
+			}
+			canCut = false
+		case ')':
+			if len(stack) > 0 {
+				comments = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			i++
+		case '|':
+			canCut = false
+			i++
+		default:
+			_, size := utf8.DecodeRuneInString(pattern[i:])
+			i += size
+		}
+	}
+	return cuts
+}
+
+// applyCommentsFlag returns whether comments mode is in effect after the given inline flag list, such as "x-i".
+func applyCommentsFlag(comments bool, flagList string) bool {
+	enabled, disabled, _ := strings.Cut(flagList, "-")
+	if strings.ContainsRune(enabled, 'x') {
+		comments = true
+	}
+	if strings.ContainsRune(disabled, 'x') {
+		comments = false
+	}
+	return comments
+}
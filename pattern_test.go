@@ -0,0 +1,120 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanGroups(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+	pr := regex.(*privateRegex)
+	tests := []struct {
+		pattern  string
+		flags    RegexFlags
+		matchStr string
+		groups   []patternGroup
+	}{
+		{`abc`, RegexFlags_None, "abc", nil},
+		{`(a)(b)`, RegexFlags_None, "ab", []patternGroup{{number: 1}, {number: 2, offset: 3}}},
+		{`(a(b)(?:c(d)))`, RegexFlags_None, "abcd", []patternGroup{{number: 1}, {number: 2, parent: 1, offset: 2}, {number: 3, parent: 1, offset: 9}}},
+		{`(?<first>a)(?<=a)(?<!c)(?=f)(?!e)(?>f)(?i:g)(?#(h)`, RegexFlags_None, "afg", []patternGroup{{number: 1, name: "first"}}},
+		{`\(a\)[(b)]\Q(c)\E(d)`, RegexFlags_None, "(a)b(c)d", []patternGroup{{number: 1, offset: 17}}},
+		{`[[(]\]](a)`, RegexFlags_None, "(a", []patternGroup{{number: 1, offset: 7}}},
+		{`(a) # (b)
+			(c)`, RegexFlags_Comments, "ac", []patternGroup{{number: 1}, {number: 2, offset: 13}}},
+		{`(?x)(a) # (b)
+			(c)`, RegexFlags_None, "ac", []patternGroup{{number: 1, offset: 4}, {number: 2, offset: 17}}},
+		{`(?x:(a) # (b)
+			)#(c)`, RegexFlags_None, "a#c", []patternGroup{{number: 1, offset: 4}, {number: 2, offset: 19}}},
+		{`(a)`, RegexFlags_Literal, "(a)", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			groups := scanGroups(test.pattern, test.flags)
+			require.Equal(t, test.groups, groups)
+			// ICU must agree on the number of groups
+			require.NoError(t, regex.SetRegexString(ctx, test.pattern, test.flags))
+			require.NoError(t, regex.SetMatchString(ctx, test.matchStr))
+			ok, err := regex.Matches(ctx, 0, 0)
+			require.NoError(t, err)
+			require.True(t, ok)
+			_, _, err = pr.groupBounds(ctx, len(groups))
+			require.NoError(t, err)
+			_, _, err = pr.groupBounds(ctx, len(groups)+1)
+			require.True(t, ErrInvalidGroup.Is(err))
+		})
+	}
+}
+
+func TestQuoteMeta(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+	require.Equal(t, `a\.b\+c`, QuoteMeta("a.b+c"))
+	for _, str := range []string{`a.b+c`, `\^$.|?*+()[]{}`, `a # b`, "tab\there\nnewline", `é😀\E\Q`} {
+		for _, flags := range []RegexFlags{RegexFlags_None, RegexFlags_Comments} {
+			require.NoError(t, regex.SetRegexString(ctx, `\A`+QuoteMeta(str)+`\z`, flags))
+			require.NoError(t, regex.SetMatchString(ctx, str))
+			ok, err := regex.Matches(ctx, 0, 0)
+			require.NoError(t, err)
+			require.True(t, ok, "%q", str)
+		}
+	}
+}
+
+func TestStripInlineFlags(t *testing.T) {
+	require.True(t, HasInlineFlags(`(?i)abc`))
+	require.True(t, HasInlineFlags(`a(?i:b)c`))
+	require.True(t, HasInlineFlags(`a(?-m)c`))
+	require.False(t, HasInlineFlags(`abc`))
+	require.False(t, HasInlineFlags(`(?:abc)(?<name>d)(?=e)(?#i)`))
+	require.False(t, HasInlineFlags(`\(?i\)[(?i)]\Q(?i)\E`))
+
+	tests := []struct {
+		pattern  string
+		residual string
+		flags    RegexFlags
+	}{
+		{`(?i)abc`, `abc`, RegexFlags_Case_Insensitive},
+		{`(?i)(?sm)a.c`, `a.c`, RegexFlags_Case_Insensitive | RegexFlags_Dot_All | RegexFlags_Multiline},
+		{`(?xw:a b)`, `a b`, RegexFlags_Comments | RegexFlags_Unicode_Word},
+		{`(?d)(?i:(a)|b)`, `(a)|b`, RegexFlags_Unix_Lines | RegexFlags_Case_Insensitive},
+		{`a(b)c`, `a(b)c`, RegexFlags_None},
+		{`(?i)[(?s)]\Q(?m)\E`, `[(?s)]\Q(?m)\E`, RegexFlags_Case_Insensitive},
+	}
+	for _, test := range tests {
+		residual, flags, err := StripInlineFlags(test.pattern)
+		require.NoError(t, err, test.pattern)
+		require.Equal(t, test.residual, residual, test.pattern)
+		require.Equal(t, test.flags, flags, test.pattern)
+	}
+
+	for pattern, message := range map[string]string{
+		`a(?i)b`:       `the inline flags (?i) at offset 1 cannot be converted to RegexFlags`,
+		`(?-i)abc`:     `the inline flags (?-i) at offset 0 cannot be converted to RegexFlags`,
+		`(?i:a)b`:      `the inline flags (?i) at offset 0 cannot be converted to RegexFlags`,
+		`(?s)a(?m:b)c`: `the inline flags (?m) at offset 5 cannot be converted to RegexFlags`,
+	} {
+		_, _, err := StripInlineFlags(pattern)
+		require.True(t, ErrInlineFlagsNotHoistable.Is(err), pattern)
+		require.Equal(t, message, err.Error(), pattern)
+	}
+}
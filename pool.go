@@ -19,14 +19,36 @@ import (
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"gopkg.in/src-d/go-errors.v1"
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 // modulePool is the pool that is used internally by the project.
 var modulePool = NewPool()
 
+// ErrMemoryLimitExceeded is returned when creating another module would exceed the limit set by SetGlobalMemoryLimit.
+var ErrMemoryLimitExceeded = errors.NewKind("another module would raise memory usage to %d bytes, exceeding the global limit of %d bytes")
+
+// ErrGuestMemoryLimitTooSmall is returned by SetMaxGuestMemoryPages when the limit is smaller than the memory that
+// every module requires.
+var ErrGuestMemoryLimitTooSmall = errors.NewKind("a limit of %d pages is smaller than the %d pages that each module requires")
+
+// icuMemoryPages is the number of pages in the memory of the ICU module, which is set by TOTAL_MEMORY in the build
+// script.
+const icuMemoryPages = 1024
+
+var (
+	// guestMemoryLimitPages is the limit that is set by SetMaxGuestMemoryPages, where zero means wazero's default.
+	guestMemoryLimitPages atomic.Uint32
+	// globalMemoryUsage is the total size of the memory of every live module, in bytes.
+	globalMemoryUsage atomic.Uint64
+	// globalMemoryLimit is the limit for globalMemoryUsage, where zero means that there is no limit.
+	globalMemoryLimit atomic.Uint64
+)
+
 // RuntimeTracker tracks all relevant information that the Pool needs regarding a runtime.
 type RuntimeTracker struct {
 	id       uint64
@@ -46,6 +68,10 @@ type Pool struct {
 	outstandingMods map[uintptr]uint64
 	nextId          uint64
 	maxFetch        uint64
+	maxRuntimes     uint64
+	creationSem     chan struct{}
+	// newRuntime creates each runtime after the first, which tests may replace to observe runtime creation.
+	newRuntime func(ctx context.Context) (wazero.Runtime, wazero.CompiledModule)
 }
 
 // NewPool creates a new *Pool.
@@ -64,41 +90,41 @@ func NewPool() *Pool {
 		outstandingMods: make(map[uintptr]uint64),
 		nextId:          2,
 		maxFetch:        128,
+		maxRuntimes:     0,
+		creationSem:     make(chan struct{}, 1),
+		newRuntime:      createRuntime,
 	}
 	return pool
 }
 
-// Get returns a new module from the pool.
+// Get returns a new module from the pool. This panics if a new module is needed, but creating it would exceed the limit
+// set by SetGlobalMemoryLimit. Use TryGet to receive an error instead.
 func (pool *Pool) Get() api.Module {
+	module, err := pool.TryGet()
+	if err != nil {
+		panic(err)
+	}
+	return module
+}
+
+// TryGet returns a new module from the pool. Returns ErrMemoryLimitExceeded if a new module is needed, but creating it
+// would exceed the limit set by SetGlobalMemoryLimit.
+func (pool *Pool) TryGet() (api.Module, error) {
 	pool.mutex.Lock()
 	defer pool.mutex.Unlock()
 
 	ctx := context.Background()
-	rtracker := pool.runtimes[len(pool.runtimes)-1]
-	rtracker.fetches++
-	// If we've used up the number of fetches allowed in this runtime, then we'll create a new one
-	if rtracker.fetches >= pool.maxFetch {
-		r, compiled := createRuntime(ctx)
-		rtracker = &RuntimeTracker{
-			id:       pool.nextId,
-			r:        r,
-			compiled: compiled,
-			modules:  make([]api.Module, 0, 16),
-			max:      0,
-			fetches:  0,
-		}
-		pool.runtimes = append(pool.runtimes, rtracker)
-		pool.nextId++
-	}
+	pool.runtimes[len(pool.runtimes)-1].fetches++
+	rtracker := pool.replaceExhaustedRuntime(ctx)
 	var module api.Module
 	// If the runtime has no modules remaining, then we need to create a new module
 	if len(rtracker.modules) == 0 {
-		rtracker.max++
 		var err error
-		module, err = rtracker.r.InstantiateModule(ctx, rtracker.compiled, icuConfig)
+		module, err = instantiateModule(ctx, rtracker.r, rtracker.compiled)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
+		rtracker.max++
 	} else {
 		// Pop the last module from the slice
 		module = rtracker.modules[len(rtracker.modules)-1]
@@ -109,7 +135,103 @@ func (pool *Pool) Get() api.Module {
 	runtime.SetFinalizer(module, func(module api.Module) {
 		pool.finalized(module)
 	})
-	return module
+	return module, nil
+}
+
+// replaceExhaustedRuntime creates a new runtime if the newest runtime has used up its fetches, and returns the newest
+// runtime afterward. Only one runtime may be created at a time, so if another caller is already creating one (or we're
+// at the runtime limit), then the current runtime is returned, and continues to be used until the new one is
+// available. Older runtimes that can be recycled are closed. The mutex must be held, however it is released while the
+// runtime is being created.
+func (pool *Pool) replaceExhaustedRuntime(ctx context.Context) *RuntimeTracker {
+	rtracker := pool.runtimes[len(pool.runtimes)-1]
+	if rtracker.fetches < pool.maxFetch || (pool.maxRuntimes != 0 && uint64(len(pool.runtimes)) >= pool.maxRuntimes) {
+		return rtracker
+	}
+	select {
+	case pool.creationSem <- struct{}{}:
+		r, compiled := pool.createRuntimeUnlocked(ctx)
+		rtracker = &RuntimeTracker{
+			id:       pool.nextId,
+			r:        r,
+			compiled: compiled,
+			modules:  make([]api.Module, 0, 16),
+			max:      0,
+			fetches:  0,
+		}
+		pool.runtimes = append(pool.runtimes, rtracker)
+		pool.nextId++
+		pool.closeExhaustedRuntimes(ctx)
+	default:
+	}
+	return rtracker
+}
+
+// createRuntimeUnlocked creates a new runtime while the mutex is released, as creating a runtime is expensive, and
+// other modules may be fetched and returned in the meantime. The caller must hold both the mutex and the creation
+// semaphore. The mutex is held again and the semaphore is released once this returns, even if creating the runtime
+// panics, so that the caller's deferred unlock remains valid and later runtimes may still be created.
+func (pool *Pool) createRuntimeUnlocked(ctx context.Context) (wazero.Runtime, wazero.CompiledModule) {
+	defer func() { <-pool.creationSem }()
+	pool.mutex.Unlock()
+	defer pool.mutex.Lock()
+	return pool.newRuntime(ctx)
+}
+
+// closeExhaustedRuntimes closes every runtime (other than the newest) that has used up its fetches and has all of its
+// modules back. The mutex must be held.
+func (pool *Pool) closeExhaustedRuntimes(ctx context.Context) {
+	for rtrackerIdx := 0; rtrackerIdx < len(pool.runtimes)-1; rtrackerIdx++ {
+		rtracker := pool.runtimes[rtrackerIdx]
+		if rtracker.fetches >= pool.maxFetch && uint64(len(rtracker.modules)) >= rtracker.max {
+			pool.closeRuntime(ctx, rtrackerIdx, rtracker)
+			rtrackerIdx--
+		}
+	}
+}
+
+// setMaxFetch sets the number of fetches that are allowed from a runtime before it is recycled. Lowering the maximum
+// applies immediately, rather than once a module is next fetched or returned, so runtimes that are now over the
+// maximum are replaced, and closed once all of their modules have been returned.
+func (pool *Pool) setMaxFetch(maxFetch uint64) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.maxFetch = maxFetch
+	ctx := context.Background()
+	pool.replaceExhaustedRuntime(ctx)
+	pool.closeExhaustedRuntimes(ctx)
+}
+
+// closeIdleModules closes modules that are waiting in the pool (rather than being used) until the global memory usage
+// no longer exceeds the given limit, or there are no more modules waiting. The mutex must be held.
+func (pool *Pool) closeIdleModules(ctx context.Context, limit uint64) {
+	for _, rtracker := range pool.runtimes {
+		for len(rtracker.modules) > 0 && globalMemoryUsage.Load() > limit {
+			module := rtracker.modules[len(rtracker.modules)-1]
+			rtracker.modules = rtracker.modules[:len(rtracker.modules)-1]
+			rtracker.max--
+			_ = closeModule(ctx, module)
+		}
+	}
+}
+
+// warm creates modules within the newest runtime until it holds at least the given number of idle modules. Returns
+// ErrMemoryLimitExceeded if creating a module would exceed the limit set by SetGlobalMemoryLimit, in which case the
+// modules that were already created are kept.
+func (pool *Pool) warm(ctx context.Context, count int) error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	rtracker := pool.runtimes[len(pool.runtimes)-1]
+	for len(rtracker.modules) < count {
+		module, err := instantiateModule(ctx, rtracker.r, rtracker.compiled)
+		if err != nil {
+			return err
+		}
+		rtracker.max++
+		rtracker.modules = append(rtracker.modules, module)
+	}
+	return nil
 }
 
 // Put returns the module to the pool.
@@ -141,24 +263,27 @@ func (pool *Pool) receivedModule(module api.Module, isPut bool) {
 	for rtrackerIdx := 0; rtrackerIdx < len(pool.runtimes); rtrackerIdx++ {
 		ctx := context.Background()
 		rtracker := pool.runtimes[rtrackerIdx]
+		// The newest runtime is the one that modules are fetched from, so it is never removed here
+		isNewest := rtrackerIdx == len(pool.runtimes)-1
 		// If this is a different runtime, then we still need to check whether it should be removed
 		if rtracker.id != runtimeId {
-			if rtracker.fetches >= pool.maxFetch && uint64(len(rtracker.modules)) >= rtracker.max {
+			if !isNewest && rtracker.fetches >= pool.maxFetch && uint64(len(rtracker.modules)) >= rtracker.max {
 				pool.closeRuntime(ctx, rtrackerIdx, rtracker)
 				rtrackerIdx--
 			}
 			continue
 		}
-		if isPut {
+		if isPut && !module.IsClosed() {
 			// Add the module back to the runtime when called from Put
 			rtracker.modules = append(rtracker.modules, module)
 		} else {
-			// We remove the module from the runtime altogether when called from the finalizer
+			// We remove the module from the runtime altogether when called from the finalizer, or when the module has
+			// stopped (such as from running out of memory), as it can no longer be used
 			rtracker.max--
-			_ = module.Close(ctx)
+			_ = closeModule(ctx, module)
 		}
 		// If this runtime has run out of fetches and all of its modules are back, then we need to close and remove it
-		if rtracker.fetches >= pool.maxFetch && uint64(len(rtracker.modules)) >= rtracker.max {
+		if !isNewest && rtracker.fetches >= pool.maxFetch && uint64(len(rtracker.modules)) >= rtracker.max {
 			pool.closeRuntime(ctx, rtrackerIdx, rtracker)
 		}
 		return
@@ -171,20 +296,63 @@ func (pool *Pool) receivedModule(module api.Module, isPut bool) {
 func (pool *Pool) closeRuntime(ctx context.Context, rtrackerIdx int, rtracker *RuntimeTracker) {
 	// First we'll close all the modules, then we'll close the runtime itself
 	for _, mod := range rtracker.modules {
-		_ = mod.Close(ctx)
+		_ = closeModule(ctx, mod)
 	}
 	_ = rtracker.r.Close(ctx)
 	// We then remove the runtime from the slice
 	newSlice := make([]*RuntimeTracker, len(pool.runtimes)-1)
 	copy(newSlice, pool.runtimes[:rtrackerIdx])
-	copy(newSlice, pool.runtimes[rtrackerIdx+1:])
+	copy(newSlice[rtrackerIdx:], pool.runtimes[rtrackerIdx+1:])
 	pool.runtimes = newSlice
 }
 
+// instantiateModule creates a new ICU module within the given runtime, which must have compiled the given module. The
+// module's memory counts toward the global memory usage until it is closed with closeModule. Returns
+// ErrMemoryLimitExceeded if the module's memory would exceed the global memory limit.
+func instantiateModule(ctx context.Context, r wazero.Runtime, compiled wazero.CompiledModule) (api.Module, error) {
+	// The module's memory is allocated in full when it's instantiated, so we reserve its size beforehand
+	var size uint64
+	for _, memory := range compiled.ExportedMemories() {
+		size += uint64(memory.Min()) * 65536
+	}
+	for {
+		usage := globalMemoryUsage.Load()
+		limit := globalMemoryLimit.Load()
+		if limit > 0 && usage+size > limit {
+			return nil, ErrMemoryLimitExceeded.New(usage+size, limit)
+		}
+		if globalMemoryUsage.CompareAndSwap(usage, usage+size) {
+			break
+		}
+	}
+	module, err := r.InstantiateModule(ctx, compiled, icuConfig)
+	if err != nil {
+		globalMemoryUsage.Add(-size)
+		return nil, err
+	}
+	// The memory should never differ from its minimum size, but we'll make sure that the usage reflects reality
+	if actual := uint64(module.Memory().Size()); actual != size {
+		globalMemoryUsage.Add(actual - size)
+	}
+	return module, nil
+}
+
+// closeModule closes a module that was created by instantiateModule, removing its memory from the global memory usage.
+func closeModule(ctx context.Context, module api.Module) error {
+	size := uint64(module.Memory().Size())
+	err := module.Close(ctx)
+	globalMemoryUsage.Add(-size)
+	return err
+}
+
 // createRuntime creates a new runtime, as well as compiling the ICU module. The compiled module is only valid with the
-// runtime that compiled it.
+// runtime that compiled it. The runtime uses the limit set by SetMaxGuestMemoryPages.
 func createRuntime(ctx context.Context) (wazero.Runtime, wazero.CompiledModule) {
-	r := wazero.NewRuntime(ctx)
+	config := wazero.NewRuntimeConfig()
+	if pages := guestMemoryLimitPages.Load(); pages > 0 {
+		config = config.WithMemoryLimitPages(pages)
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, config)
 	wasi_snapshot_preview1.MustInstantiate(ctx, r)
 	envBuilder := r.NewHostModuleBuilder("env")
 	noop_two := func(int32, int32) int32 { return -1 }
@@ -204,9 +372,64 @@ func createRuntime(ctx context.Context) (wazero.Runtime, wazero.CompiledModule)
 	return r, compiledIcuWasm
 }
 
-// SetPoolFetchMax determines how many fetches are allowed from the internal Pool before a runtime is recycled.
+// SetPoolFetchMax determines how many fetches are allowed from the internal Pool before a runtime is recycled. Lowering
+// the maximum takes effect immediately, so runtimes that have already exceeded it are recycled as soon as all of their
+// modules have been returned (which may be during this call).
 func SetPoolFetchMax(maxFetch uint64) {
+	modulePool.setMaxFetch(maxFetch)
+}
+
+// WarmPool creates modules within the internal Pool until it holds at least the given number of idle modules, so that
+// creating that many Regexes at once does not need to wait for modules to be created. Creating a module is far more
+// expensive than matching (see BenchmarkCreateRegex), which matters when a burst of Regexes is created concurrently,
+// such as when a server starts. The modules belong to the newest runtime, so they're discarded once it's recycled (see
+// SetPoolFetchMax). Each module holds 64MiB of memory, which counts toward the limit set by SetGlobalMemoryLimit, and
+// ErrMemoryLimitExceeded is returned if the limit would be exceeded.
+func WarmPool(count int) error {
+	return modulePool.warm(context.Background(), count)
+}
+
+// SetGlobalMemoryLimit sets the maximum number of bytes that the memory of all live modules may consume, across every
+// Regex, Pool, and SerializedEngine. Once the limit would be exceeded, new modules are refused, however modules that
+// already exist (including those waiting in a Pool) may still be used. Each module's memory is fixed at its creation,
+// so this is a hard limit on the memory that ICU may use. This does not account for the memory used by the runtimes
+// themselves, such as compiled code. A value of zero means that there is no limit. Lowering the limit below the current
+// usage closes modules that are waiting in the internal Pool until the usage fits within the limit, however modules that
+// are in use are never closed.
+func SetGlobalMemoryLimit(bytes uint64) {
+	globalMemoryLimit.Store(bytes)
+	if bytes > 0 && globalMemoryUsage.Load() > bytes {
+		modulePool.mutex.Lock()
+		defer modulePool.mutex.Unlock()
+		modulePool.closeIdleModules(context.Background(), bytes)
+	}
+}
+
+// SetMaxGuestMemoryPages sets the maximum number of 64KiB pages that the memory of a single module may grow to, which
+// applies to runtimes that are created afterward (runtimes in the internal Pool are periodically recycled, see
+// SetPoolFetchMax). A value of zero uses wazero's default limit. The ICU module is built with a fixed memory of 1024
+// pages (64MiB) that is allocated in full and never grows, so that is already the effective limit, and smaller limits
+// return ErrGuestMemoryLimitTooSmall. Once a module's memory has been exhausted, allocations fail with ErrOutOfMemory
+// rather than growing the host's memory.
+func SetMaxGuestMemoryPages(pages uint32) error {
+	if pages != 0 && pages < icuMemoryPages {
+		return ErrGuestMemoryLimitTooSmall.New(pages, icuMemoryPages)
+	}
+	guestMemoryLimitPages.Store(pages)
+	return nil
+}
+
+// GlobalMemoryUsage returns the number of bytes that the memory of all live modules is consuming. This is the same
+// usage that SetGlobalMemoryLimit applies to.
+func GlobalMemoryUsage() uint64 {
+	return globalMemoryUsage.Load()
+}
+
+// SetPoolMaxRuntimes determines the maximum number of runtimes that the internal Pool may hold at once. Once this
+// limit has been reached, modules continue to be fetched from the newest runtime (even beyond the fetch maximum) until
+// an older runtime has been recycled. A value of zero means that there is no limit.
+func SetPoolMaxRuntimes(maxRuntimes uint64) {
 	modulePool.mutex.Lock()
 	defer modulePool.mutex.Unlock()
-	modulePool.maxFetch = maxFetch
+	modulePool.maxRuntimes = maxRuntimes
 }
@@ -0,0 +1,301 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestPoolConcurrentRuntimeCreation(t *testing.T) {
+	pool := NewPool()
+	closePoolOnCleanup(t, pool)
+	pool.maxFetch = 2
+	pool.maxRuntimes = 3
+	// Creation is slowed down so that overlapping creations would be observed
+	var creating, maxCreating, created atomic.Int32
+	pool.newRuntime = func(ctx context.Context) (wazero.Runtime, wazero.CompiledModule) {
+		current := creating.Add(1)
+		defer creating.Add(-1)
+		for peak := maxCreating.Load(); current > peak && !maxCreating.CompareAndSwap(peak, current); peak = maxCreating.Load() {
+		}
+		created.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return createRuntime(ctx)
+	}
+
+	const numGets = 16
+	modules := make([]api.Module, numGets)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numGets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			modules[i] = pool.Get()
+		}(i)
+	}
+	wg.Wait()
+	// Nothing has been returned yet, so the current runtime count is also the peak runtime count
+	require.LessOrEqual(t, len(pool.runtimes), 3)
+	require.GreaterOrEqual(t, len(pool.runtimes), 1)
+	// Runtimes are only ever created one at a time
+	require.Positive(t, created.Load())
+	require.Equal(t, int32(1), maxCreating.Load())
+
+	for _, module := range modules {
+		pool.Put(module)
+	}
+	// All exhausted runtimes should be recycled once their modules have returned, leaving only the newest
+	require.Len(t, pool.runtimes, 1)
+	require.Empty(t, pool.outstandingMods)
+}
+
+func TestPoolRuntimeCreationPanic(t *testing.T) {
+	pool := NewPool()
+	closePoolOnCleanup(t, pool)
+	pool.maxFetch = 2
+	first := pool.Get()
+	defer pool.Put(first)
+	pool.newRuntime = func(ctx context.Context) (wazero.Runtime, wazero.CompiledModule) {
+		panic("creation failed")
+	}
+	require.PanicsWithValue(t, "creation failed", func() { pool.Get() })
+
+	// The mutex and the creation semaphore are both released, so the next runtime can still be created
+	pool.newRuntime = createRuntime
+	second := pool.Get()
+	defer pool.Put(second)
+	require.Len(t, pool.runtimes, 2)
+	require.Empty(t, pool.creationSem)
+}
+
+func TestPoolSetMaxFetch(t *testing.T) {
+	pool := NewPool()
+	closePoolOnCleanup(t, pool)
+	pool.setMaxFetch(1000)
+	modules := make([]api.Module, 8)
+	for i := range modules {
+		modules[i] = pool.Get()
+	}
+	require.Len(t, pool.runtimes, 1)
+
+	// The runtime is now over the lowered limit, so it is replaced immediately, and recycled once its modules are back
+	pool.setMaxFetch(4)
+	require.Len(t, pool.runtimes, 2)
+	for _, module := range modules {
+		pool.Put(module)
+	}
+	require.Len(t, pool.runtimes, 1)
+	require.Equal(t, uint64(2), pool.runtimes[0].id)
+
+	// A runtime that already has all of its modules back is recycled during the call
+	pool.setMaxFetch(1000)
+	for i := range modules {
+		modules[i] = pool.Get()
+	}
+	for _, module := range modules {
+		pool.Put(module)
+	}
+	pool.setMaxFetch(4)
+	require.Len(t, pool.runtimes, 1)
+	require.Equal(t, uint64(3), pool.runtimes[0].id)
+	require.Empty(t, pool.outstandingMods)
+}
+
+func TestGlobalMemoryLimit(t *testing.T) {
+	defer SetGlobalMemoryLimit(0)
+	pool := NewPool()
+	closePoolOnCleanup(t, pool)
+	// Every module that the new pool creates adds to the usage, so no new modules may be created with this limit
+	SetGlobalMemoryLimit(GlobalMemoryUsage() + 1)
+	_, err := pool.TryGet()
+	require.True(t, ErrMemoryLimitExceeded.Is(err))
+	require.Panics(t, func() { pool.Get() })
+
+	// Raising the limit allows exactly one more module
+	SetGlobalMemoryLimit(0)
+	module, err := pool.TryGet()
+	require.NoError(t, err)
+	moduleSize := uint64(module.Memory().Size())
+	pool.Put(module)
+	SetGlobalMemoryLimit(GlobalMemoryUsage() + moduleSize)
+	modules := make([]api.Module, 2)
+	for i := range modules {
+		// The first module is reused from the pool, so it does not count against the limit
+		modules[i], err = pool.TryGet()
+		require.NoError(t, err)
+	}
+	usage := GlobalMemoryUsage()
+	_, err = pool.TryGet()
+	require.True(t, ErrMemoryLimitExceeded.Is(err))
+	require.Equal(t, usage, GlobalMemoryUsage())
+	for _, module := range modules {
+		pool.Put(module)
+	}
+
+	// Closing a runtime releases the memory of its modules. This fetch creates a new runtime with one module, which
+	// allows the previous runtime (and its two modules) to be closed once the new module is returned.
+	pool.maxFetch = 0
+	SetGlobalMemoryLimit(0)
+	module, err = pool.TryGet()
+	require.NoError(t, err)
+	pool.Put(module)
+	require.Equal(t, usage-moduleSize, GlobalMemoryUsage())
+}
+
+func TestGlobalMemoryLimitClosesIdleModules(t *testing.T) {
+	defer SetGlobalMemoryLimit(0)
+	inUse := CreateRegex(0)
+	defer inUse.Close()
+	idle := []Regex{CreateRegex(0), CreateRegex(0)}
+	for _, regex := range idle {
+		require.NoError(t, regex.Close())
+	}
+	usage := GlobalMemoryUsage()
+	SetGlobalMemoryLimit(1)
+	require.Less(t, GlobalMemoryUsage(), usage)
+	modulePool.mutex.Lock()
+	for _, rtracker := range modulePool.runtimes {
+		require.Empty(t, rtracker.modules)
+	}
+	modulePool.mutex.Unlock()
+
+	// The module that is in use remains usable
+	ctx := context.Background()
+	require.NoError(t, inUse.SetRegexString(ctx, `a`, RegexFlags_None))
+	require.NoError(t, inUse.SetMatchString(ctx, "a"))
+	ok, err := inUse.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestTryCreateRegex(t *testing.T) {
+	defer SetGlobalMemoryLimit(0)
+	// Take every module that the pool holds, so that the next regex must create a new module
+	var regexes []Regex
+	defer func() {
+		for _, regex := range regexes {
+			require.NoError(t, regex.Close())
+		}
+	}()
+	SetGlobalMemoryLimit(1)
+	for {
+		regex, err := TryCreateRegex(0)
+		if err != nil {
+			require.True(t, ErrMemoryLimitExceeded.Is(err))
+			break
+		}
+		regexes = append(regexes, regex)
+	}
+	_, errs := CompileAll(context.Background(), []string{`a`}, RegexFlags_None)
+	require.True(t, ErrMemoryLimitExceeded.Is(errs[0]))
+}
+
+func TestMaxGuestMemoryPages(t *testing.T) {
+	ctx := context.Background()
+	defer func() { require.NoError(t, SetMaxGuestMemoryPages(0)) }()
+	// A cap below the module's fixed memory could never be satisfied, so it is refused rather than failing every module
+	require.True(t, ErrGuestMemoryLimitTooSmall.Is(SetMaxGuestMemoryPages(16)))
+	require.NoError(t, SetMaxGuestMemoryPages(icuMemoryPages))
+	r, compiled := createRuntime(ctx)
+	for _, memory := range compiled.ExportedMemories() {
+		require.Equal(t, uint32(icuMemoryPages), memory.Min())
+		maxPages, _ := memory.Max()
+		require.Equal(t, uint32(icuMemoryPages), maxPages)
+	}
+	require.NoError(t, r.Close(ctx))
+
+	// The engine's runtime is created under the cap. Each replacement grows the result far beyond the module's memory,
+	// which must return an error rather than grow.
+	engine := NewSerializedEngine()
+	defer engine.Close()
+	capped, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	defer capped.Close()
+	require.NoError(t, capped.SetRegexString(ctx, `a`, RegexFlags_None))
+	require.NoError(t, capped.SetMatchString(ctx, strings.Repeat("a", 200000)))
+	_, err = capped.Replace(ctx, strings.Repeat("b", 200), 1, 0)
+	require.True(t, ErrOutOfMemory.Is(err))
+	_, _, err = capped.ReplaceAllWithSpans(ctx, strings.Repeat("b", 200))
+	require.True(t, ErrOutOfMemory.Is(err))
+	ok, err := capped.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The same holds for the internal Pool
+	regex := CreateRegex(0)
+	require.NoError(t, regex.SetRegexString(ctx, `a`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, strings.Repeat("a", 200000)))
+	_, err = regex.Replace(ctx, strings.Repeat("b", 200), 1, 0)
+	require.True(t, ErrOutOfMemory.Is(err))
+	// The result is built within a buffer that we allocate, so the failed allocation leaves the module usable
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.Close())
+
+	// The module is returned to the pool, and works for another regex
+	regex = CreateRegex(0)
+	defer regex.Close()
+	require.NoError(t, regex.SetRegexString(ctx, `a`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "bab"))
+	replaced, err := regex.Replace(ctx, "c", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "bcb", replaced)
+}
+
+func TestWarmPool(t *testing.T) {
+	pool := NewPool()
+	closePoolOnCleanup(t, pool)
+	usage := GlobalMemoryUsage()
+	require.NoError(t, pool.warm(context.Background(), 3))
+	require.Len(t, pool.runtimes[0].modules, 3)
+	require.Equal(t, uint64(3), pool.runtimes[0].max)
+	require.Greater(t, GlobalMemoryUsage(), usage)
+
+	// Warming again only creates the modules that are missing, and fetching uses the warmed modules
+	module := pool.Get()
+	require.NoError(t, pool.warm(context.Background(), 3))
+	require.Len(t, pool.runtimes[0].modules, 3)
+	require.Equal(t, uint64(4), pool.runtimes[0].max)
+	pool.Put(module)
+
+	// The modules that were created before reaching the memory limit are kept
+	defer SetGlobalMemoryLimit(0)
+	SetGlobalMemoryLimit(GlobalMemoryUsage() + 1)
+	require.True(t, ErrMemoryLimitExceeded.Is(pool.warm(context.Background(), 5)))
+	require.Len(t, pool.runtimes[0].modules, 4)
+	SetGlobalMemoryLimit(0)
+}
+
+// closePoolOnCleanup closes every runtime of the given pool once the test has finished, so that the memory of the pool's
+// modules no longer counts toward the global memory usage.
+func closePoolOnCleanup(t *testing.T, pool *Pool) {
+	t.Cleanup(func() {
+		pool.mutex.Lock()
+		defer pool.mutex.Unlock()
+		for len(pool.runtimes) > 0 {
+			pool.closeRuntime(context.Background(), 0, pool.runtimes[0])
+		}
+	})
+}
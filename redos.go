@@ -0,0 +1,731 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// ErrPatternNotAnalyzable is returned by AnalyzeReDoS when the pattern's structure could not be parsed.
+var ErrPatternNotAnalyzable = errors.NewKind("the pattern could not be analyzed: %s at offset %d")
+
+// RiskSeverity is how likely a pattern is to backtrack catastrophically, as determined by AnalyzeReDoS.
+type RiskSeverity uint8
+
+const (
+	// No risky constructs were found.
+	RiskSeverity_None RiskSeverity = iota
+
+	// A construct was found that may backtrack excessively on some inputs, although it often does not.
+	RiskSeverity_Medium
+
+	// A construct was found that is known to backtrack exponentially on some inputs.
+	RiskSeverity_High
+)
+
+// String returns the name of the severity.
+func (severity RiskSeverity) String() string {
+	switch severity {
+	case RiskSeverity_None:
+		return "none"
+	case RiskSeverity_Medium:
+		return "medium"
+	case RiskSeverity_High:
+		return "high"
+	default:
+		return "RiskSeverity(" + strconv.Itoa(int(severity)) + ")"
+	}
+}
+
+// RiskKind is the kind of construct that a RiskFinding describes.
+type RiskKind uint8
+
+const (
+	// A repeated expression contains another quantifier that repeats without a bound, such as "(a+)+".
+	RiskKind_NestedQuantifier RiskKind = iota
+
+	// A repeated alternation has branches that may begin with the same character, such as "(a|ab)*".
+	RiskKind_OverlappingAlternation
+
+	// A repeated expression contains an optional or variable-length part, or may match nothing, such as "(a?)*".
+	RiskKind_OptionalInRepetition
+)
+
+// RiskFinding is a single risky construct within a pattern.
+type RiskFinding struct {
+	Kind     RiskKind
+	Severity RiskSeverity
+	// Expression is the repeated sub-expression (including its quantifier) that contains the construct.
+	Expression string
+	// Offset is the zero-based byte offset of the expression within the pattern.
+	Offset int
+}
+
+// RiskReport is the result of AnalyzeReDoS.
+type RiskReport struct {
+	// Severity is the highest severity among the findings, or RiskSeverity_None when there are no findings.
+	Severity RiskSeverity
+	// Findings are the risky constructs, in the order that they appear in the pattern.
+	Findings []RiskFinding
+}
+
+// redosRepeatThreshold is the maximum count at which a bounded quantifier is treated as though it were unbounded, as a
+// large bound backtracks just as badly in practice.
+const redosRepeatThreshold = 10
+
+// AnalyzeReDoS statically inspects the pattern for constructs that are known to cause catastrophic backtracking (a
+// regular expression denial of service), without compiling or running it. This allows risky patterns to be rejected
+// before they're given to SetRegexString, complementing a runtime limit on matching. The constructs that are detected
+// are quantifiers nested within unbounded repetition (such as "(a+)+"), repeated alternations whose branches overlap
+// (such as "(a|a)*"), and repeated expressions that contain optional parts (such as "(a?b?)*"). Atomic groups and
+// possessive quantifiers do not backtrack, so they're never reported. This is a heuristic, so a pattern without
+// findings is not guaranteed to be safe, and some findings may not be exploitable in practice. Inline flags are
+// ignored, and the pattern is assumed to not use RegexFlags_Literal or RegexFlags_Comments. Returns
+// ErrPatternNotAnalyzable if the pattern's structure could not be parsed, such as from unbalanced parentheses.
+func AnalyzeReDoS(pattern string) (RiskReport, error) {
+	parser := redosParser{pattern: pattern}
+	root, err := parser.parseAlternation()
+	if err != nil {
+		return RiskReport{}, err
+	}
+	if parser.pos < len(pattern) {
+		return RiskReport{}, ErrPatternNotAnalyzable.New("unmatched closing parenthesis", parser.pos)
+	}
+	report := RiskReport{}
+	root.walk(func(node *redosNode) {
+		if finding, ok := node.analyze(pattern); ok {
+			report.Findings = append(report.Findings, finding)
+			report.Severity = max(report.Severity, finding.Severity)
+		}
+	})
+	return report, nil
+}
+
+// redosNodeKind is the kind of a redosNode.
+type redosNodeKind uint8
+
+const (
+	// Matches a single character from a set.
+	redosNodeKind_Char redosNodeKind = iota
+	// Matches one of several sequences.
+	redosNodeKind_Group
+	// Matches its child some number of times.
+	redosNodeKind_Repeat
+	// Matches without consuming anything, such as an anchor or a lookaround.
+	redosNodeKind_Assertion
+	// Matches the text of a previous group, which may have any length.
+	redosNodeKind_Backreference
+)
+
+// redosNode is a node within the simplified syntax tree that AnalyzeReDoS builds from a pattern.
+type redosNode struct {
+	kind redosNodeKind
+	// start and end are the byte offsets of the node within the pattern, where end is exclusive.
+	start int
+	end   int
+	// chars is the set of characters that a Char node matches.
+	chars redosCharSet
+	// branches are the sequences of a Group node, or of an Assertion node that is a lookaround.
+	branches [][]*redosNode
+	// child is the repeated node of a Repeat node.
+	child *redosNode
+	// min and max are the bounds of a Repeat node, where a max of -1 is unbounded.
+	min int
+	max int
+	// atomic is true for atomic groups and possessive quantifiers, which never backtrack into their contents.
+	atomic bool
+}
+
+// walk calls the function with the node and every node that it contains.
+func (node *redosNode) walk(f func(node *redosNode)) {
+	f(node)
+	if node.child != nil {
+		node.child.walk(f)
+	}
+	for _, branch := range node.branches {
+		for _, item := range branch {
+			item.walk(f)
+		}
+	}
+}
+
+// analyze returns the finding for the node, which only applies to repetition that may backtrack.
+func (node *redosNode) analyze(pattern string) (RiskFinding, bool) {
+	if node.kind != redosNodeKind_Repeat || node.atomic || !node.repeatsLong() || !node.child.canConsume() {
+		return RiskFinding{}, false
+	}
+	finding := RiskFinding{Expression: pattern[node.start:node.end], Offset: node.start}
+	switch {
+	case node.child.containsRepeat(func(inner *redosNode) bool { return inner.repeatsLong() }):
+		finding.Kind = RiskKind_NestedQuantifier
+		finding.Severity = RiskSeverity_High
+	case node.child.hasOverlappingBranches():
+		finding.Kind = RiskKind_OverlappingAlternation
+		finding.Severity = RiskSeverity_High
+	case node.child.canBeEmpty() ||
+		node.child.containsRepeat(func(inner *redosNode) bool { return inner.max != inner.min }):
+		finding.Kind = RiskKind_OptionalInRepetition
+		finding.Severity = RiskSeverity_Medium
+	default:
+		return RiskFinding{}, false
+	}
+	return finding, true
+}
+
+// repeatsLong returns whether a Repeat node is unbounded, or has a bound that is large enough to be treated as such.
+func (node *redosNode) repeatsLong() bool {
+	return node.max == -1 || node.max >= redosRepeatThreshold
+}
+
+// containsRepeat returns whether the node contains a Repeat node that satisfies the given function, and that consumes
+// characters. Atomic groups, possessive quantifiers, and assertions are not searched, as they do not backtrack.
+func (node *redosNode) containsRepeat(f func(inner *redosNode) bool) bool {
+	if node.atomic || node.kind == redosNodeKind_Assertion {
+		return false
+	}
+	if node.kind == redosNodeKind_Repeat {
+		if f(node) && node.child.canConsume() {
+			return true
+		}
+		return node.child.containsRepeat(f)
+	}
+	for _, branch := range node.branches {
+		for _, item := range branch {
+			if item.containsRepeat(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasOverlappingBranches returns whether the node is a group with at least two branches that may begin with the same
+// character. Groups that only wrap another group are looked through.
+func (node *redosNode) hasOverlappingBranches() bool {
+	if node.kind != redosNodeKind_Group || node.atomic {
+		return false
+	}
+	if len(node.branches) == 1 {
+		if len(node.branches[0]) == 1 {
+			return node.branches[0][0].hasOverlappingBranches()
+		}
+		return false
+	}
+	firsts := make([]redosCharSet, len(node.branches))
+	for i, branch := range node.branches {
+		firsts[i] = sequenceFirstChars(branch)
+		for j := 0; j < i; j++ {
+			if firsts[i].overlaps(firsts[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canBeEmpty returns whether the node may match without consuming any characters.
+func (node *redosNode) canBeEmpty() bool {
+	switch node.kind {
+	case redosNodeKind_Char:
+		return false
+	case redosNodeKind_Repeat:
+		return node.min == 0 || node.child.canBeEmpty()
+	case redosNodeKind_Group:
+		for _, branch := range node.branches {
+			if sequenceCanBeEmpty(branch) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// canConsume returns whether the node may match at least one character.
+func (node *redosNode) canConsume() bool {
+	switch node.kind {
+	case redosNodeKind_Char, redosNodeKind_Backreference:
+		return true
+	case redosNodeKind_Repeat:
+		return node.max != 0 && node.child.canConsume()
+	case redosNodeKind_Group:
+		for _, branch := range node.branches {
+			for _, item := range branch {
+				if item.canConsume() {
+					return true
+				}
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// firstChars returns the set of characters that a match of the node may begin with.
+func (node *redosNode) firstChars() redosCharSet {
+	switch node.kind {
+	case redosNodeKind_Char:
+		return node.chars
+	case redosNodeKind_Repeat:
+		return node.child.firstChars()
+	case redosNodeKind_Group:
+		var chars redosCharSet
+		for _, branch := range node.branches {
+			chars = chars.union(sequenceFirstChars(branch))
+		}
+		return chars
+	case redosNodeKind_Backreference:
+		return redosCharSet{any: true}
+	default:
+		return redosCharSet{}
+	}
+}
+
+// sequenceCanBeEmpty returns whether every node within the sequence may match without consuming any characters.
+func sequenceCanBeEmpty(sequence []*redosNode) bool {
+	for _, item := range sequence {
+		if !item.canBeEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+// sequenceFirstChars returns the set of characters that a match of the sequence may begin with.
+func sequenceFirstChars(sequence []*redosNode) redosCharSet {
+	var chars redosCharSet
+	for _, item := range sequence {
+		chars = chars.union(item.firstChars())
+		if !item.canBeEmpty() {
+			break
+		}
+	}
+	return chars
+}
+
+// redosCharRange is an inclusive range of characters.
+type redosCharRange struct {
+	lo rune
+	hi rune
+}
+
+// redosCharSet is an approximation of a set of characters, which is used to determine whether alternations overlap.
+// Sets that are difficult to represent, such as negated classes and Unicode properties, match any character.
+type redosCharSet struct {
+	any    bool
+	ranges []redosCharRange
+}
+
+// Approximations of the shorthand classes, which only cover ASCII, as that is enough to find overlaps in practice.
+var (
+	redosDigits     = []redosCharRange{{'0', '9'}}
+	redosWordChars  = []redosCharRange{{'0', '9'}, {'A', 'Z'}, {'_', '_'}, {'a', 'z'}}
+	redosWhitespace = []redosCharRange{{'\t', '\r'}, {' ', ' '}}
+)
+
+// union returns a set containing the characters of both sets.
+func (set redosCharSet) union(other redosCharSet) redosCharSet {
+	if set.any || other.any {
+		return redosCharSet{any: true}
+	}
+	ranges := make([]redosCharRange, 0, len(set.ranges)+len(other.ranges))
+	ranges = append(ranges, set.ranges...)
+	ranges = append(ranges, other.ranges...)
+	return redosCharSet{ranges: ranges}
+}
+
+// overlaps returns whether the sets have any characters in common.
+func (set redosCharSet) overlaps(other redosCharSet) bool {
+	if (set.any && (other.any || len(other.ranges) > 0)) || (other.any && len(set.ranges) > 0) {
+		return true
+	}
+	for _, a := range set.ranges {
+		for _, b := range other.ranges {
+			if a.lo <= b.hi && b.lo <= a.hi {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redosParser builds a tree of redosNode from a pattern.
+type redosParser struct {
+	pattern string
+	pos     int
+}
+
+// parseAlternation parses branches separated by "|", stopping at a closing parenthesis or the end of the pattern.
+func (p *redosParser) parseAlternation() (*redosNode, error) {
+	group := &redosNode{kind: redosNodeKind_Group, start: p.pos}
+	for {
+		sequence, err := p.parseSequence()
+		if err != nil {
+			return nil, err
+		}
+		group.branches = append(group.branches, sequence)
+		if p.pos >= len(p.pattern) || p.pattern[p.pos] != '|' {
+			break
+		}
+		p.pos++
+	}
+	group.end = p.pos
+	return group, nil
+}
+
+// parseSequence parses quantified atoms until a "|", a closing parenthesis, or the end of the pattern.
+func (p *redosParser) parseSequence() ([]*redosNode, error) {
+	var sequence []*redosNode
+	for p.pos < len(p.pattern) && p.pattern[p.pos] != '|' && p.pattern[p.pos] != ')' {
+		atoms, err := p.parseAtoms()
+		if err != nil {
+			return nil, err
+		}
+		// A quantifier only applies to the last atom, such as the last character of a quoted sequence
+		if len(atoms) > 0 {
+			atoms[len(atoms)-1] = p.parseQuantifiers(atoms[len(atoms)-1])
+		}
+		sequence = append(sequence, atoms...)
+	}
+	return sequence, nil
+}
+
+// parseQuantifiers wraps the atom in any quantifiers that follow it.
+func (p *redosParser) parseQuantifiers(atom *redosNode) *redosNode {
+	for p.pos < len(p.pattern) {
+		minCount, maxCount, length, ok := parseQuantifier(p.pattern[p.pos:])
+		if !ok {
+			break
+		}
+		p.pos += length
+		repeat := &redosNode{kind: redosNodeKind_Repeat, start: atom.start, child: atom, min: minCount, max: maxCount}
+		if p.pos < len(p.pattern) && p.pattern[p.pos] == '+' {
+			repeat.atomic = true
+			p.pos++
+		} else if p.pos < len(p.pattern) && p.pattern[p.pos] == '?' {
+			p.pos++
+		}
+		repeat.end = p.pos
+		atom = repeat
+	}
+	return atom
+}
+
+// parseQuantifier parses a quantifier at the beginning of the text, returning its bounds and length. A maximum of -1
+// is unbounded. Returns false if the text does not begin with a quantifier.
+func parseQuantifier(text string) (minCount int, maxCount int, length int, ok bool) {
+	switch text[0] {
+	case '*':
+		return 0, -1, 1, true
+	case '+':
+		return 1, -1, 1, true
+	case '?':
+		return 0, 1, 1, true
+	case '{':
+		end := strings.IndexByte(text, '}')
+		if end == -1 {
+			return 0, 0, 0, false
+		}
+		lower, upper, hasComma := strings.Cut(text[1:end], ",")
+		var err error
+		if minCount, err = strconv.Atoi(lower); err != nil {
+			return 0, 0, 0, false
+		}
+		switch {
+		case !hasComma:
+			maxCount = minCount
+		case upper == "":
+			maxCount = -1
+		default:
+			if maxCount, err = strconv.Atoi(upper); err != nil {
+				return 0, 0, 0, false
+			}
+		}
+		return minCount, maxCount, end + 1, true
+	default:
+		return 0, 0, 0, false
+	}
+}
+
+// parseAtoms parses the next atom, which is a character, a character class, an escape, or a group. A quoted sequence
+// returns an atom for each of its characters. Returns no atoms for constructs that do not match anything and may not
+// be quantified, such as comments and flag groups.
+func (p *redosParser) parseAtoms() ([]*redosNode, error) {
+	start := p.pos
+	var node *redosNode
+	var err error
+	switch c := p.pattern[p.pos]; c {
+	case '(':
+		node, err = p.parseGroup()
+	case '[':
+		end := skipCharacterClass(p.pattern, p.pos)
+		if p.pattern[end] != ']' {
+			return nil, ErrPatternNotAnalyzable.New("unclosed character class", start)
+		}
+		p.pos = end + 1
+		node = &redosNode{kind: redosNodeKind_Char, start: start, end: p.pos, chars: classChars(p.pattern[start+1 : end])}
+	case '\\':
+		if strings.HasPrefix(p.pattern[p.pos:], `\Q`) {
+			return p.parseQuoted(), nil
+		}
+		node, err = p.parseEscape()
+	case '.':
+		p.pos++
+		node = &redosNode{kind: redosNodeKind_Char, start: start, end: p.pos, chars: redosCharSet{any: true}}
+	case '^', '$':
+		p.pos++
+		node = &redosNode{kind: redosNodeKind_Assertion, start: start, end: p.pos}
+	case '*', '+', '?':
+		return nil, ErrPatternNotAnalyzable.New("quantifier without anything to repeat", start)
+	default:
+		r, size := utf8.DecodeRuneInString(p.pattern[p.pos:])
+		p.pos += size
+		node = &redosNode{kind: redosNodeKind_Char, start: start, end: p.pos, chars: redosCharSet{ranges: []redosCharRange{{r, r}}}}
+	}
+	if err != nil || node == nil {
+		return nil, err
+	}
+	return []*redosNode{node}, nil
+}
+
+// parseQuoted parses a quoted sequence, such as "\Qa+b\E", returning an atom for each quoted character.
+func (p *redosParser) parseQuoted() []*redosNode {
+	p.pos += 2
+	quoted := p.pattern[p.pos:]
+	end := strings.Index(quoted, `\E`)
+	if end != -1 {
+		quoted = quoted[:end]
+	}
+	var nodes []*redosNode
+	for i, r := range quoted {
+		nodes = append(nodes, &redosNode{kind: redosNodeKind_Char, start: p.pos + i, end: p.pos + i + utf8.RuneLen(r),
+			chars: redosCharSet{ranges: []redosCharRange{{r, r}}}})
+	}
+	p.pos += len(quoted)
+	if end != -1 {
+		p.pos += 2
+	}
+	return nodes
+}
+
+// parseGroup parses a group, including its parentheses.
+func (p *redosParser) parseGroup() (*redosNode, error) {
+	start := p.pos
+	rest := p.pattern[p.pos+1:]
+	kind := redosNodeKind_Group
+	atomic := false
+	switch {
+	case strings.HasPrefix(rest, "?#"):
+		end := strings.IndexByte(rest, ')')
+		if end == -1 {
+			return nil, ErrPatternNotAnalyzable.New("unclosed comment", start)
+		}
+		p.pos += end + 2
+		return nil, nil
+	case strings.HasPrefix(rest, "?:"):
+		p.pos += 3
+	case strings.HasPrefix(rest, "?>"):
+		atomic = true
+		p.pos += 3
+	case strings.HasPrefix(rest, "?="), strings.HasPrefix(rest, "?!"):
+		kind = redosNodeKind_Assertion
+		p.pos += 3
+	case strings.HasPrefix(rest, "?<="), strings.HasPrefix(rest, "?<!"):
+		kind = redosNodeKind_Assertion
+		p.pos += 4
+	case strings.HasPrefix(rest, "?<"):
+		end := strings.IndexByte(rest, '>')
+		if end == -1 {
+			return nil, ErrPatternNotAnalyzable.New("unclosed group name", start)
+		}
+		p.pos += end + 2
+	case strings.HasPrefix(rest, "?"):
+		flagList, ok := inlineFlagList(rest)
+		if !ok {
+			return nil, ErrPatternNotAnalyzable.New("unknown group type", start)
+		}
+		p.pos += len(flagList) + 2
+		// A flag group without a colon only changes the flags, and does not contain anything
+		if p.pattern[p.pos] == ')' {
+			p.pos++
+			return nil, nil
+		}
+		p.pos++
+	default:
+		p.pos++
+	}
+	inner, err := p.parseAlternation()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos >= len(p.pattern) {
+		return nil, ErrPatternNotAnalyzable.New("unclosed group", start)
+	}
+	p.pos++
+	return &redosNode{kind: kind, start: start, end: p.pos, branches: inner.branches, atomic: atomic}, nil
+}
+
+// parseEscape parses an escape sequence, including its backslash.
+func (p *redosParser) parseEscape() (*redosNode, error) {
+	start := p.pos
+	if p.pos+1 >= len(p.pattern) {
+		return nil, ErrPatternNotAnalyzable.New("trailing backslash", start)
+	}
+	p.pos += 2
+	node := &redosNode{kind: redosNodeKind_Char, start: start}
+	switch c := p.pattern[start+1]; c {
+	case 'd':
+		node.chars.ranges = redosDigits
+	case 'w':
+		node.chars.ranges = redosWordChars
+	case 's':
+		node.chars.ranges = redosWhitespace
+	case 'D', 'W', 'S', 'X', 'R', 'h', 'H', 'v', 'V':
+		node.chars.any = true
+	case 'p', 'P', 'N':
+		node.chars.any = true
+		p.skipBraces()
+	case 'x':
+		if p.pos < len(p.pattern) && p.pattern[p.pos] == '{' {
+			p.skipBraces()
+		} else {
+			p.pos = min(p.pos+2, len(p.pattern))
+		}
+		node.chars.any = true
+	case 'u':
+		p.pos = min(p.pos+4, len(p.pattern))
+		node.chars.any = true
+	case 'U':
+		p.pos = min(p.pos+8, len(p.pattern))
+		node.chars.any = true
+	case 'b', 'B', 'A', 'z', 'Z', 'G':
+		node.kind = redosNodeKind_Assertion
+	case 'k':
+		if end := strings.IndexByte(p.pattern[p.pos:], '>'); end != -1 {
+			p.pos += end + 1
+		}
+		node.kind = redosNodeKind_Backreference
+	default:
+		switch {
+		case c >= '1' && c <= '9':
+			for p.pos < len(p.pattern) && p.pattern[p.pos] >= '0' && p.pattern[p.pos] <= '9' {
+				p.pos++
+			}
+			node.kind = redosNodeKind_Backreference
+		case c == 'c' || c == '0':
+			// These encode a character using what follows, which we don't need to be exact about
+			node.chars.any = true
+		case c < utf8.RuneSelf:
+			r := rune(c)
+			switch c {
+			case 't':
+				r = '\t'
+			case 'n':
+				r = '\n'
+			case 'r':
+				r = '\r'
+			case 'f':
+				r = '\f'
+			case 'a':
+				r = '\a'
+			case 'e':
+				r = '\x1b'
+			}
+			node.chars.ranges = []redosCharRange{{r, r}}
+		default:
+			r, size := utf8.DecodeRuneInString(p.pattern[start+1:])
+			p.pos = start + 1 + size
+			node.chars.ranges = []redosCharRange{{r, r}}
+		}
+	}
+	node.end = p.pos
+	return node, nil
+}
+
+// skipBraces moves past a braced argument, such as the "{Lu}" of "\p{Lu}", if the pattern continues with one.
+func (p *redosParser) skipBraces() {
+	if p.pos < len(p.pattern) && p.pattern[p.pos] == '{' {
+		if end := strings.IndexByte(p.pattern[p.pos:], '}'); end != -1 {
+			p.pos += end + 1
+			return
+		}
+	}
+	// A single-letter property, such as \pL
+	if p.pos < len(p.pattern) {
+		p.pos++
+	}
+}
+
+// classChars returns the set of characters within the contents of a character class (without its brackets).
+// Negations, nested classes, set operations, and properties are approximated as matching any character.
+func classChars(contents string) redosCharSet {
+	if strings.HasPrefix(contents, "^") || strings.ContainsAny(contents, "[") ||
+		strings.Contains(contents, "&&") || strings.Contains(contents, "--") {
+		return redosCharSet{any: true}
+	}
+	var set redosCharSet
+	var prev rune = -1
+	for i := 0; i < len(contents); {
+		r, size := utf8.DecodeRuneInString(contents[i:])
+		switch {
+		case r == '\\' && i+1 < len(contents):
+			switch contents[i+1] {
+			case 'd':
+				set.ranges = append(set.ranges, redosDigits...)
+			case 'w':
+				set.ranges = append(set.ranges, redosWordChars...)
+			case 's':
+				set.ranges = append(set.ranges, redosWhitespace...)
+			case 'n':
+				set.ranges = append(set.ranges, redosCharRange{'\n', '\n'})
+			case 't':
+				set.ranges = append(set.ranges, redosCharRange{'\t', '\t'})
+			case 'r':
+				set.ranges = append(set.ranges, redosCharRange{'\r', '\r'})
+			default:
+				escaped, escapedSize := utf8.DecodeRuneInString(contents[i+1:])
+				if escaped < utf8.RuneSelf && (escaped >= 'a' && escaped <= 'z' || escaped >= 'A' && escaped <= 'Z') {
+					// Other letters are classes or encoded characters, which we don't need to be exact about
+					return redosCharSet{any: true}
+				}
+				set.ranges = append(set.ranges, redosCharRange{escaped, escaped})
+				prev = escaped
+				i += 1 + escapedSize
+				continue
+			}
+			prev = -1
+			i += 2
+		case r == '-' && prev != -1 && i+1 < len(contents):
+			hi, hiSize := utf8.DecodeRuneInString(contents[i+1:])
+			if hi == '\\' {
+				return redosCharSet{any: true}
+			}
+			set.ranges[len(set.ranges)-1].hi = hi
+			prev = -1
+			i += 1 + hiSize
+		default:
+			set.ranges = append(set.ranges, redosCharRange{r, r})
+			prev = r
+			i += size
+		}
+	}
+	return set
+}
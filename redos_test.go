@@ -0,0 +1,80 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeReDoS(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		severity RiskSeverity
+		findings []RiskFinding
+	}{
+		// Nested quantifiers
+		{`(a+)+`, RiskSeverity_High, []RiskFinding{{RiskKind_NestedQuantifier, RiskSeverity_High, `(a+)+`, 0}}},
+		{`^(a*)*$`, RiskSeverity_High, []RiskFinding{{RiskKind_NestedQuantifier, RiskSeverity_High, `(a*)*`, 1}}},
+		{`^(\w+\s?)*$`, RiskSeverity_High, []RiskFinding{{RiskKind_NestedQuantifier, RiskSeverity_High, `(\w+\s?)*`, 1}}},
+		{`x(?:[a-z]{1,20}\d)+y`, RiskSeverity_High, []RiskFinding{{RiskKind_NestedQuantifier, RiskSeverity_High, `(?:[a-z]{1,20}\d)+`, 1}}},
+		{`((ab)+c)+`, RiskSeverity_High, []RiskFinding{{RiskKind_NestedQuantifier, RiskSeverity_High, `((ab)+c)+`, 0}}},
+		// Overlapping alternations
+		{`(a|a)*`, RiskSeverity_High, []RiskFinding{{RiskKind_OverlappingAlternation, RiskSeverity_High, `(a|a)*`, 0}}},
+		{`^(a|ab)+$`, RiskSeverity_High, []RiskFinding{{RiskKind_OverlappingAlternation, RiskSeverity_High, `(a|ab)+`, 1}}},
+		{`(\d|[0-5x])*z`, RiskSeverity_High, []RiskFinding{{RiskKind_OverlappingAlternation, RiskSeverity_High, `(\d|[0-5x])*`, 0}}},
+		{`(?:.|\n){1,100}`, RiskSeverity_High, []RiskFinding{{RiskKind_OverlappingAlternation, RiskSeverity_High, `(?:.|\n){1,100}`, 0}}},
+		// Optional parts within repetition
+		{`(a?b?)*c`, RiskSeverity_Medium, []RiskFinding{{RiskKind_OptionalInRepetition, RiskSeverity_Medium, `(a?b?)*`, 0}}},
+		{`(ab{1,3})+`, RiskSeverity_Medium, []RiskFinding{{RiskKind_OptionalInRepetition, RiskSeverity_Medium, `(ab{1,3})+`, 0}}},
+		// Safe patterns
+		{`[a-z]+@[a-z]+\.com`, RiskSeverity_None, nil},
+		{`^\d{3}-\d{4}$`, RiskSeverity_None, nil},
+		{`(abc)+`, RiskSeverity_None, nil},
+		{`(a|b)*`, RiskSeverity_None, nil},
+		{`(a{3})+`, RiskSeverity_None, nil},
+		{`(a+)?`, RiskSeverity_None, nil},
+		{`(?>a+)+`, RiskSeverity_None, nil},
+		{`(a++)+`, RiskSeverity_None, nil},
+		{`(a+)++`, RiskSeverity_None, nil},
+		{`\Q(a+)+\E`, RiskSeverity_None, nil},
+		{`[(a+)+]`, RiskSeverity_None, nil},
+		{`(?#(a+ is not a group)x`, RiskSeverity_None, nil},
+		{`(?i)(?<word>\w+)\s(?=\k<word>)`, RiskSeverity_None, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			report, err := AnalyzeReDoS(test.pattern)
+			require.NoError(t, err)
+			require.Equal(t, test.severity, report.Severity)
+			require.Equal(t, test.findings, report.Findings)
+		})
+	}
+
+	// Each repetition is reported separately
+	report, err := AnalyzeReDoS(`(a|a)+x(b+)*`)
+	require.NoError(t, err)
+	require.Equal(t, []RiskFinding{
+		{RiskKind_OverlappingAlternation, RiskSeverity_High, `(a|a)+`, 0},
+		{RiskKind_NestedQuantifier, RiskSeverity_High, `(b+)*`, 7},
+	}, report.Findings)
+	require.Equal(t, "high", report.Severity.String())
+
+	for _, pattern := range []string{`(a`, `a)`, `[a`, `*a`, `a\`} {
+		_, err = AnalyzeReDoS(pattern)
+		require.True(t, ErrPatternNotAnalyzable.Is(err), pattern)
+	}
+}
@@ -17,8 +17,12 @@ package regex
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"runtime"
+	"strings"
 	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/tetratelabs/wazero/api"
 	"gopkg.in/src-d/go-errors.v1"
@@ -28,33 +32,356 @@ import (
 // imperative that Regex is closed once it is finished.
 type Regex interface {
 	// SetRegexString sets the string that will later be matched against. This must be called at least once before any other
-	// calls are made (except for Close).
+	// calls are made (except for Close). This also clears the match string, so SetMatchString must be called again.
 	SetRegexString(ctx context.Context, regexStr string, flags RegexFlags) error
 	// SetMatchString sets the string that we will either be matching against, or executing the replacements on. This
 	// must be called after SetRegexString, but before any other calls.
 	SetMatchString(ctx context.Context, matchStr string) error
+	// SetMatchUText sets the match string from the chunks supplied by the provider, which allows text that is held in a
+	// non-contiguous structure (such as a rope) to be matched against, and is otherwise the same as SetMatchString.
+	// ICU's uregex_setUText is not exported from the WASM module (nor can ICU call back into Go to request chunks), so
+	// the chunks are read in order and flattened into a single match string. Chunks may split a character.
+	SetMatchUText(ctx context.Context, provider ChunkProvider) error
+	// RefreshText replaces the contents of the match string without resetting the state of the matcher, so that
+	// matching may continue from the previous position over the new text. This is intended for streaming scenarios, such
+	// as a ring buffer that has shifted. The new text must have the same length (in UTF-16 code units) as the current
+	// match string. Must call SetRegexString and SetMatchString before this function.
+	RefreshText(ctx context.Context, text string) error
+	// SetRegion limits all matching to the region of the match string between the given positions, measured in UTF-16
+	// code units. Start is the position of the first code unit of the region, and end is the position immediately after
+	// the last code unit. Position starts at 1, not 0. Text outside the region is never matched, and the region's
+	// boundaries behave as the beginning and end of the text for anchors such as ^ and $, however all positions given to
+	// and returned from the other functions still refer to the entire match string. Setting the match string resets the
+	// region to the entire match string. Must call SetRegexString and SetMatchString before this function.
+	SetRegion(ctx context.Context, start int, end int) error
+	// SetRegionBytes is the same as SetRegion, except that the positions are measured in UTF-8 bytes of the match
+	// string. A start position that falls within a character is moved to the beginning of that character, and an end
+	// position that falls within a character is moved to the end of that character, so that the region includes every
+	// character that it partially covers. Position starts at 1, not 0. Must call SetRegexString and SetMatchString
+	// before this function.
+	SetRegionBytes(ctx context.Context, fromByte int, toByte int) error
+	// RegionBytes returns the bounds of the current region, measured in UTF-8 bytes of the match string. From is the
+	// position of the first byte of the region, and to is the position immediately after the last byte. Position starts
+	// at 1, not 0. Must call SetRegexString and SetMatchString before this function.
+	RegionBytes() (from int, to int, err error)
+	// Region returns the bounds of the current region, measured in UTF-16 code units. Start is the position of the first
+	// code unit of the region, and end is the position immediately after the last code unit. Position starts at 1, not
+	// 0. If a region has not been set, then the region covers the entire match string. Must call SetRegexString and
+	// SetMatchString before this function.
+	Region(ctx context.Context) (start int, end int, err error)
+	// SetMaxScanLength limits every search to at most n UTF-16 code units, beginning from the position that the search
+	// starts at (or the beginning of the region, if the search starts before it). This is a coarse, but cheap, bound on
+	// the cost of searching a large match string, as it does not depend on ICU's step accounting. Matches that do not
+	// end within the limit are not found, and the end of the limit behaves as the end of the region for anchors such as
+	// $. A limit of zero or less removes the limit, which is the default. This applies to functions that search for
+	// matches and to Replace, and remains in effect until it is changed.
+	SetMaxScanLength(n int)
 	// Matches returns whether the previously-set regex matches the previously-set match string. Must call
 	// SetRegexString and SetMatchString before this function.
 	Matches(ctx context.Context, start int, occurrence int) (bool, error)
+	// MatchesWithFlags returns whether the previously-set regex, compiled with the given flags instead of its own, matches
+	// anywhere within the given input. ICU cannot change the flags of a compiled regex, so each flag variant is compiled
+	// once within this Regex's module and cached until the regex string changes or this Regex is closed, while the
+	// regex's own flags use the regex as it is. This does not change the match string of this Regex, although a search
+	// that was in progress (such as through occurrences) begins again. Must call SetRegexString before this function.
+	MatchesWithFlags(ctx context.Context, input string, flags RegexFlags) (bool, error)
+	// MatchesInRegions returns whether the previously-set regex matches within each of the given regions of the
+	// previously-set match string. Each region is a pair of positions measured in UTF-16 code units, using the same
+	// convention as SetRegion: the first is the position of the first code unit of the region, and the second is the
+	// position immediately after the last code unit. Position starts at 1, not 0. The match string is only encoded once,
+	// so this is cheaper than calling SetRegion and Matches for each region. The current region is restored afterward.
+	// Must call SetRegexString and SetMatchString before this function.
+	MatchesInRegions(ctx context.Context, regions [][2]int) ([]bool, error)
+	// IsStartAnchored returns whether the regex may only match at the beginning of the match string, such as a regex
+	// that begins with \A, or with ^ while not in multiline mode. The detection is conservative, so some anchored
+	// regexes may still return false. Must call SetRegexString before this function.
+	IsStartAnchored(ctx context.Context) (bool, error)
 	// Replace returns a new string with the replacement string occupying the matched portions of the match string,
-	// based on the regex. Position starts at 1, not 0. Must call SetRegexString and SetMatchString before this function.
+	// based on the regex. The search for matches begins at the given position, so matches before the position are never
+	// replaced, although the text before the position is still included in the result. Position starts at 1, not 0, and
+	// positions less than 1 are treated as 1. A position immediately after the end of the match string has nothing to
+	// replace, while positions beyond that return an error. An occurrence of 0 replaces every match, otherwise only the
+	// given occurrence is replaced, counting from the first match at or after the position. When nothing is replaced,
+	// the result has the same content as the match string, which cannot be distinguished from a replacement that
+	// happened to produce the same text, so use ReplaceAllString when that matters. Must call SetRegexString and
+	// SetMatchString before this function.
 	Replace(ctx context.Context, replacementStr string, position int, occurrence int) (string, error)
+	// ReplaceAllString is the same as Replace when replacing every match from the beginning of the match string, except
+	// that it also returns whether any match was replaced, so that callers may skip work (such as a write) when nothing
+	// changed. Within the module, ICU hands back the original text when there is no match rather than copying it,
+	// however the result is always a newly-built string that never shares memory with the string given to
+	// SetMatchString. Must call SetRegexString and SetMatchString before this function.
+	ReplaceAllString(ctx context.Context, replacementStr string) (result string, replaced bool, err error)
+	// ReplaceAllSizeDelta returns how many bytes longer (or shorter, when negative) the UTF-8 result of ReplaceAllString
+	// would be than the match string, along with the number of matches that would be replaced, without building the
+	// result. This allows callers to size a buffer for the result, or to reject a result that would be too large. The
+	// replacement string is expanded the same way that ICU expands it, and references to groups that do not exist
+	// return ErrInvalidReplacement. Must call SetRegexString and SetMatchString before this function.
+	ReplaceAllSizeDelta(ctx context.Context, replacementStr string) (deltaBytes int, matches int, err error)
+	// Partition finds the given occurrence of the regex, beginning the search at the given start position, and returns
+	// the text before the match, the matched text, and the text after the match. Position starts at 1, not 0. If there
+	// is no match, then ok is false and all strings are empty. Must call SetRegexString and SetMatchString before this
+	// function.
+	Partition(ctx context.Context, start int, occurrence int) (before string, match string, after string, ok bool, err error)
+	// SubstringFrom finds the given occurrence of the regex, beginning the search at the given start position, and
+	// returns the matched text along with the position immediately after the match, which may be given as the start
+	// position of a later call to resume matching, as with MySQL's REGEXP_SUBSTR. Positions start at 1, not 0. If there
+	// is no match, then ok is false. Must call SetRegexString and SetMatchString before this function.
+	SubstringFrom(ctx context.Context, start int, occurrence int) (text string, endPos int, ok bool, err error)
+	// SubstringGrapheme finds the given occurrence of the regex, beginning the search at the given start position, and
+	// returns the matched text extended outward to the nearest grapheme cluster boundaries. ICU matches code points, so
+	// "." may match a base character without its combining marks, or part of an emoji sequence, and this ensures that
+	// the returned text never contains partial characters as a user would see them. Grapheme clusters are approximated,
+	// as ICU's break iterators are not available within the WASM module. Position starts at 1, not 0. If there is no
+	// match, then ok is false. Must call SetRegexString and SetMatchString before this function.
+	SubstringGrapheme(ctx context.Context, start int, occurrence int) (substring string, ok bool, err error)
+	// NamedGroupsOrdered finds the given occurrence of the regex, beginning the search at the given start position, and
+	// returns the name and text of every named group in the order that the groups appear in the regex, which a map
+	// would not preserve. Unnamed groups are skipped, while named groups that did not participate in the match have
+	// empty text. Position starts at 1, not 0. If there is no match, then ok is false. Must call SetRegexString and
+	// SetMatchString before this function.
+	NamedGroupsOrdered(ctx context.Context, start int, occurrence int) (groups []NamedGroup, ok bool, err error)
+	// GroupTree finds the given occurrence of the regex, beginning the search at the given start position, and returns
+	// the entire match as group 0 with every participating group nested beneath the innermost enclosing group, so that
+	// the groups may be used like a parse tree. A group is only placed beneath an enclosing group when its span also
+	// lies within that group's span, as a group within a repetition keeps its capture from an earlier iteration when a
+	// later iteration does not set it. Children are ordered by group number. Position starts at 1, not 0. If there is
+	// no match, then ok is false. Must call SetRegexString and SetMatchString before this function.
+	GroupTree(ctx context.Context, start int, occurrence int) (root *GroupNode, ok bool, err error)
+	// ReplaceAllWithSpans replaces every match with the replacement string, and returns the result along with the
+	// bounds of every replaced match within the original match string. Must call SetRegexString and SetMatchString
+	// before this function.
+	ReplaceAllWithSpans(ctx context.Context, replacementStr string) (result string, originalSpans []MatchBounds, err error)
+	// FindAllString returns the text of every match, beginning the search at the given start position. Position starts
+	// at 1, not 0. A limit less than 1 returns every match. Must call SetRegexString and SetMatchString before this
+	// function.
+	FindAllString(ctx context.Context, start int, limit int) ([]string, error)
+	// FindAllRuneBounds returns the bounds of every match, beginning the search at the given start position, where both
+	// the start position and the returned bounds are measured in runes (code points) rather than UTF-16 code units,
+	// which is how text editors usually index text. Positions start at 1, not 0. A limit less than 1 returns every
+	// match. Must call SetRegexString and SetMatchString before this function.
+	FindAllRuneBounds(ctx context.Context, start int, limit int) ([]MatchBounds, error)
+	// MatchReaderAll returns the bounds of every match within the text read from the reader, where the bounds are
+	// measured in bytes from the beginning of the text. Positions start at 1, not 0. Rather than reading all of the text
+	// at once, the text is read and matched in windows of the given number of bytes, where the last overlap bytes of each
+	// window are carried over to the beginning of the next, so that matches crossing the boundary between windows are
+	// still found as long as they are no longer than the overlap. Longer matches that cross a boundary may be missed or
+	// shortened. Each window is matched without the text around it, so the boundaries behave as the beginning and end
+	// of the text for everything that looks at neighboring text: anchors such as ^ and $, word boundaries (\b and \B),
+	// and lookahead and lookbehind. Near a boundary, such patterns may miss matches or report matches that do not exist
+	// in the full text (\b may match in the middle of a word that a boundary splits). The window must be larger than the
+	// overlap. This sets the match string to each window in turn, replacing any previous match string. Must call
+	// SetRegexString before this function.
+	MatchReaderAll(ctx context.Context, r io.Reader, window int, overlap int) ([]MatchBounds, error)
+	// AllGroup scans the entire match string, and returns the text of the given group from each match. If the group did
+	// not participate in a match, then that match contributes an empty string. A limit less than 1 returns the group
+	// from every match. Must call SetRegexString and SetMatchString before this function.
+	AllGroup(ctx context.Context, group int, limit int) ([]string, error)
+	// AllGroupParticipating is the same as AllGroup, except that matches in which the group did not participate are
+	// skipped, rather than contributing an empty string. Must call SetRegexString and SetMatchString before this
+	// function.
+	AllGroupParticipating(ctx context.Context, group int, limit int) ([]string, error)
+	// FindAllSubmatchColumnar returns every match, beginning the search at the given start position, in a columnar
+	// layout rather than a slice per match. The bounds of the i-th match are matchStarts[i] and matchEnds[i], measured in
+	// UTF-16 code units, where the end is the position immediately after the match. The text of group g within the i-th
+	// match is groups[g][i], where group 0 is the entire match, so there is a column for every group from 0 through
+	// NumSubexp(). Groups that did not participate in a match have empty text. Positions start at 1, not 0. A limit less
+	// than 1 returns every match. Must call SetRegexString and SetMatchString before this function.
+	FindAllSubmatchColumnar(ctx context.Context, start int, limit int) (matchStarts []int, matchEnds []int, groups [][]string, err error)
+	// FindLazy finds the first match at or after the given position, and returns a LazyMatch that only retrieves the
+	// text of a group once it is requested. Position starts at 1, not 0. If there is no match, then ok is false. Must
+	// call SetRegexString and SetMatchString before this function.
+	FindLazy(ctx context.Context, start int) (match *LazyMatch, ok bool, err error)
+	// FindFrom returns the bounds of the first match at or after the given position, without depending on any previous
+	// search. Position starts at 1, not 0. To find the next match, pass the End of the returned bounds (or End+1 when
+	// the match was empty, as the same empty match would otherwise be found again), or pass Start+1 to also find
+	// overlapping matches. If there is no match, including when the position is past the end of the match string, then
+	// ok is false. Must call SetRegexString and SetMatchString before this function.
+	FindFrom(ctx context.Context, pos int) (bounds MatchBounds, ok bool, err error)
+	// ExplainNonMatch returns a description of why the regex does not match the match string, intended to help with
+	// debugging. This is a best-effort diagnostic that tries variations of the regex, such as ignoring case, removing
+	// anchors, and trimming the regex to find the longest prefix that matches, so the hints are not guaranteed to be
+	// the actual cause. If the regex does match, then the description states where. Must call SetRegexString and
+	// SetMatchString before this function.
+	ExplainNonMatch(ctx context.Context) (string, error)
+	// LongestPrefixMatch returns the length, in UTF-16 code units, of the match that begins at the start of the match
+	// string (or the start of the region, if one has been set), which is intended for highlighting how much of the input
+	// a partially-typed regex matches. The match ends immediately before position 1+length (relative to the start of the
+	// region). If the regex does not match at the start, then the length is 0. Must call SetRegexString and
+	// SetMatchString before this function.
+	LongestPrefixMatch(ctx context.Context) (length int, err error)
+	// GroupCount returns the number of capture groups within the regex, which does not include group 0 (the entire
+	// match), matching ICU's uregex_groupCount. Non-capturing groups, such as "(?:a)", are not counted. Therefore, a
+	// slice that holds every group including group 0 must have a length of GroupCount()+1. Must call SetRegexString
+	// before this function.
+	GroupCount() (int, error)
+	// NumSubexp is the same as GroupCount, except that it returns 0 rather than an error when the regex has not been
+	// set, which matches the shape of NumSubexp from Go's regexp package.
+	NumSubexp() int
+	// SubexpNames returns the name of each capture group, indexed by the group number, where groups without a name
+	// (including group 0, the entire match) have an empty name. This matches SubexpNames from Go's regexp package, and
+	// has a length of NumSubexp()+1. Returns nil if the regex has not been set.
+	SubexpNames() []string
+	// NamedGroupCount returns the number of distinct names given to capture groups within the regex, such as
+	// "(?<year>\d+)". Unnamed groups are not counted. A regex cannot use the same name for multiple groups, which
+	// SetRegexString reports with ErrDuplicateGroupName. Must call SetRegexString before this function.
+	NamedGroupCount(ctx context.Context) (int, error)
+	// ValidateReplacement checks that every group referenced by the replacement string exists in the regex, using the
+	// replacement syntax that the Regex was created with. ICU does not report invalid references while replacing, and
+	// the replacement instead results in an empty string, so this may be used to catch mistakes beforehand. Returns
+	// ErrInvalidReplacement describing every invalid reference. Must call SetRegexString before this function.
+	ValidateReplacement(ctx context.Context, replacementStr string) error
+	// Pattern returns the regex string and flags that were given to SetRegexString, which may be stored and later given
+	// to CompileFrom to recreate the regex. Must call SetRegexString before this function.
+	Pattern() (pattern string, flags RegexFlags, err error)
+	// MatchWithContext finds the given occurrence of the regex, beginning the search at the given start position, and
+	// returns the match along with the lines that it spans and up to contextLines lines on either side, similar to
+	// grep's -C option. Lines are taken from the entire match string, even when a region has been set. Line terminators
+	// are the same ones that ICU recognizes, unless the regex was set with RegexFlags_Unix_Lines, in which case only
+	// '\n' ends a line. Position starts at 1, not 0. If there is no match, then ok is false. Must call SetRegexString
+	// and SetMatchString before this function.
+	MatchWithContext(ctx context.Context, start int, occurrence int, contextLines int) (result ContextResult, ok bool, err error)
+	// Clone creates a new Regex with the same regex, flags, options, and string buffer size, which may be used
+	// concurrently with this Regex. The match string is not copied, so SetMatchString must be called on the clone. As
+	// compiled regexes cannot be shared between modules (and ICU's uregex_clone is not exported), the clone compiles
+	// the regex again within its own module, however it reuses the encoded regex string and the analysis of the regex.
+	// The clone must be closed separately. Must call SetRegexString before this function.
+	Clone(ctx context.Context) (Regex, error)
+	// AsStdlib returns an adapter whose methods are named and shaped like those of Go's regexp.Regexp, using the given
+	// context for every call. The adapter sets the match string of this Regex whenever it is used. Must call
+	// SetRegexString before using the adapter.
+	AsStdlib(ctx context.Context) StdlibCompat
 	// StringBufferSize returns the size of the string buffers, in bytes. If the string buffer is not being used, then
 	// this returns zero.
 	StringBufferSize() uint32
 	// Close frees up the internal resources. This MUST be called, else a panic will occur at some non-deterministic time.
+	// Once closed, functions that return an error return ErrClosed, and closing again does nothing.
 	Close() error
 }
 
+// GroupIndexer finds the position of a group across every match. Every Regex created by this package implements it,
+// however it is kept separate from Regex so that types outside of this package that implement Regex (such as mocks) do
+// not need to implement it as well. Use a type assertion to access it from a Regex.
+type GroupIndexer interface {
+	// GroupIndexAcrossMatches scans the entire match string, and returns the position of the given occurrence of the
+	// group, counting only the matches in which the group participated. If endIndex is true, then the position
+	// immediately after the group is returned instead. Position starts at 1, not 0. If the group does not participate in
+	// enough matches, then 0 is returned. Must call SetRegexString and SetMatchString before this function.
+	GroupIndexAcrossMatches(ctx context.Context, group int, occurrence int, endIndex bool) (int, error)
+}
+
 var (
 	// ErrRegexNotYetSet is returned when attempting to use another function before the regex has been initialized.
 	ErrRegexNotYetSet = errors.NewKind("SetRegexString must be called before any other function")
+	// ErrClosed is returned when attempting to use a Regex after it has been closed.
+	ErrClosed = errors.NewKind("the Regex has been closed")
 	// ErrMatchNotYetSet is returned when attempting to use another function before the match string has been set.
 	ErrMatchNotYetSet = errors.NewKind("SetMatchString must be called as there is nothing to match against")
-	// ErrInvalidRegex is returned when an invalid regex is given
+	// ErrInvalidRegex is returned when an invalid regex is given. The error's Cause is a *ParseError, which describes
+	// where the regex is invalid.
 	ErrInvalidRegex = errors.NewKind("the given regular expression is invalid")
+	// ErrInvalidGroup is returned when a group is requested that does not exist in the regex.
+	ErrInvalidGroup = errors.NewKind("the group %d does not exist in the regular expression")
+	// ErrTextLengthMismatch is returned when refreshing the match string with text of a different length.
+	ErrTextLengthMismatch = errors.NewKind("the new text has a length of %d, which does not match the current length of %d")
+	// ErrInvalidRegion is returned when a region is given that does not fit within the match string.
+	ErrInvalidRegion = errors.NewKind("the region from %d to %d does not fit within the match string")
+	// ErrInvalidUTF16 is returned when a string contains a surrogate code point while using WithRejectLoneSurrogates.
+	ErrInvalidUTF16 = errors.NewKind("the string contains a lone surrogate at byte %d")
+	// ErrInvalidReplacement is returned when a replacement string references groups that do not exist in the regex.
+	ErrInvalidReplacement = errors.NewKind("the replacement string is invalid: %s")
+	// ErrConflictingFlags is returned when the inline flags within a regex contradict the RegexFlags that were given
+	// alongside it while using WithStrictFlags.
+	ErrConflictingFlags = errors.NewKind("the inline flags (?%s) at offset %d contradict the given RegexFlags")
+	// ErrDuplicateGroupName is returned when a regex gives the same name to multiple capture groups, which ICU does not
+	// allow.
+	ErrDuplicateGroupName = errors.NewKind("the group name %q is used by both group %d and group %d")
+	// ErrInvalidWindow is returned when the window given to MatchReaderAll is not larger than the overlap.
+	ErrInvalidWindow = errors.NewKind("the window of %d bytes must be larger than the overlap of %d bytes")
+	// ErrPatternNotNormalized is returned when a regex string contains text that is not in the form given to
+	// WithNormalization.
+	ErrPatternNotNormalized = errors.NewKind("the text %q at offset %d of the regex string is not in the normalization form, so it can never match")
+	// ErrOutOfMemory is returned when ICU could not allocate memory. This is not a problem with the inputs, so the
+	// operation may succeed if retried later (such as with a new Regex).
+	ErrOutOfMemory = errors.NewKind("ICU ran out of memory")
 )
 
+// UErrorCodeError is returned when an ICU function reports an unexpected failure.
+type UErrorCodeError struct {
+	Function string
+	Code     UErrorCode
+}
+
+var _ error = (*UErrorCodeError)(nil)
+
+// Error implements the interface error.
+func (err *UErrorCodeError) Error() string {
+	return fmt.Sprintf("unexpected UErrorCode from %s: %s (%d)", err.Function, err.Code.String(), int32(err.Code))
+}
+
+// newUErrorCodeError returns an error for the given failing UErrorCode, which was returned from the given function(s).
+// Memory allocation failures are wrapped in ErrOutOfMemory, so that they may be distinguished from other failures.
+func newUErrorCodeError(function string, code UErrorCode) error {
+	err := &UErrorCodeError{Function: function, Code: code}
+	if code == U_MEMORY_ALLOCATION_ERROR {
+		return ErrOutOfMemory.Wrap(err)
+	}
+	return err
+}
+
+// ParseError describes where ICU found a regex to be invalid.
+type ParseError struct {
+	// Code is the reason that the regex is invalid, such as U_REGEX_MISMATCHED_PAREN.
+	Code UErrorCode
+	// Line is the line of the regex that contains the error, starting at 1. Only regexes that contain newlines will
+	// have lines past the first.
+	Line int
+	// Offset is the position of the offending character within its line, measured in code points. Offset starts at 1,
+	// not 0.
+	Offset int
+	// PreContext is the text of the regex that immediately precedes the error, up to 15 code units.
+	PreContext string
+	// PostContext is the text of the regex that immediately follows the error, up to 15 code units.
+	PostContext string
+}
+
+var _ error = (*ParseError)(nil)
+
+// Error implements the interface error.
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("%s at line %d, offset %d, between %q and %q", err.Code.String(), err.Line, err.Offset, err.PreContext, err.PostContext)
+}
+
+// ChunkProvider supplies text in chunks, which are read in order from the beginning of the text.
+type ChunkProvider interface {
+	// NextChunk returns the next chunk of text. Once there are no chunks remaining, it returns io.EOF.
+	NextChunk() (string, error)
+}
+
+// NamedGroup is the name and text of a named group from a match, as returned by NamedGroupsOrdered.
+type NamedGroup = struct {
+	Name  string
+	Value string
+}
+
+// GroupNode is a capture group from a match along with the groups nested within it, as returned by GroupTree. The name
+// is empty for unnamed groups.
+type GroupNode struct {
+	Number   int
+	Name     string
+	Bounds   MatchBounds
+	Text     string
+	Children []*GroupNode
+}
+
+// MatchBounds are the bounds of a match within the match string, measured in UTF-16 code units. Start is the position
+// of the first code unit of the match, and End is the position immediately after the last code unit, so End-Start is
+// the length of the match, and End is where matching would resume. Positions start at 1, not 0.
+type MatchBounds struct {
+	Start int
+	End   int
+}
+
 // ShouldPanic determines whether the finalizer will panic if it finds a Regex that has not been closed.
 var ShouldPanic bool = true
 
@@ -93,6 +420,13 @@ const (
 	// Unicode word boundaries. If set, \b uses the Unicode TR 29 definition of word boundaries. Warning: Unicode word
 	// boundaries are quite different from traditional regular expression word boundaries.
 	// See http://unicode.org/reports/tr29/#Word_Boundaries
+	//
+	// ICU implements these boundaries using its break iterator, which requires ICU's data. The WASM module does not
+	// include ICU's data, so any attempt to evaluate \b under this flag fails with U_MISSING_RESOURCE_ERROR. ICU also
+	// does not allow choosing the locale (or break iterator) that \b uses, so locale-specific boundaries (such as those
+	// needed for Thai or Japanese) are not possible either. As a workaround, boundaries may be expressed in the pattern
+	// using lookaround and Unicode properties, such as (?<![\p{L}\p{M}\p{N}_]) and (?![\p{L}\p{M}\p{N}_]), or the
+	// text may be segmented beforehand with a separator that the pattern can match.
 	RegexFlags_Unicode_Word RegexFlags = 256
 
 	// Error on Unrecognized backslash escapes. If set, fail with an error on patterns that contain backslash-escaped
@@ -106,19 +440,203 @@ const (
 // zero will force all strings to be allocated and deallocated. The buffer is defined for one string, therefore double
 // the amount given will actually be consumed (regex and match strings). Once the Regex is done with, you must remember
 // to call Close. This Regex is intended for single-threaded use only, therefore it is advised for each thread to use
-// its own Regex when one is needed.
-func CreateRegex(stringBufferInBytes uint32) Regex {
-	mod := modulePool.Get()
+// its own Regex when one is needed. Any options are applied in the order given. This panics if the Regex requires a new
+// module, but creating it would exceed the limit set by SetGlobalMemoryLimit. Use TryCreateRegex to receive an error
+// instead.
+func CreateRegex(stringBufferInBytes uint32, opts ...RegexOption) Regex {
+	return newPrivateRegex(modulePool.Get(), stringBufferInBytes, modulePool.Put, opts)
+}
+
+// TryCreateRegex is the same as CreateRegex, except that it returns ErrMemoryLimitExceeded rather than panicking when
+// the limit set by SetGlobalMemoryLimit would be exceeded.
+func TryCreateRegex(stringBufferInBytes uint32, opts ...RegexOption) (Regex, error) {
+	mod, err := modulePool.TryGet()
+	if err != nil {
+		return nil, err
+	}
+	return newPrivateRegex(mod, stringBufferInBytes, modulePool.Put, opts), nil
+}
+
+// CompileAll creates a Regex for each of the given patterns, using the same flags for each one. Rather than stopping at
+// the first invalid pattern, every pattern is attempted, and the results are returned as parallel slices. For each
+// pattern, either the Regex is non-nil and the error is nil, or the Regex is nil and the error is non-nil. Invalid
+// patterns return ErrInvalidRegex, whose Cause is a *ParseError, and patterns that would exceed the global memory limit
+// return ErrMemoryLimitExceeded. The caller must Close every non-nil Regex. The returned Regex objects do not use a
+// string buffer.
+func CompileAll(ctx context.Context, patterns []string, flags RegexFlags) ([]Regex, []error) {
+	regexes := make([]Regex, len(patterns))
+	errs := make([]error, len(patterns))
+	for i, pattern := range patterns {
+		regex, err := TryCreateRegex(0)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if err = regex.SetRegexString(ctx, pattern, flags); err != nil {
+			// The error from SetRegexString takes precedence, as closing should only fail if something is very wrong
+			_ = regex.Close()
+			errs[i] = err
+			continue
+		}
+		regexes[i] = regex
+	}
+	return regexes, errs
+}
+
+// CompileGlob creates a Regex that matches strings against a shell-style glob, such as "*.txt" or "data_?.csv". A "*"
+// matches any sequence of characters, a "?" matches any single character, and character classes such as "[a-z]" are
+// supported, where a leading "!" negates the class. All other characters match literally, including those that are
+// special within a regex, and a backslash may be used to match "*", "?", or "[" literally. The glob must match the
+// entire string. As with CreateRegex, the returned Regex must be closed, and does not use a string buffer.
+func CompileGlob(glob string, flags RegexFlags) (Regex, error) {
+	return CompileFrom(globToPattern(glob), flags)
+}
+
+// CompileFrom creates a Regex from a pattern and flags, which are intended to be those returned by Pattern. ICU cannot
+// serialize a compiled regex, so the pattern and flags are the persistable form of a Regex, and CompileFrom compiles
+// them once more. Options are not part of the persisted form, so they would need to be given again (using CreateRegex
+// and SetRegexString). As with CreateRegex, the returned Regex must be closed, and does not use a string buffer.
+func CompileFrom(pattern string, flags RegexFlags) (Regex, error) {
+	regex, err := TryCreateRegex(0)
+	if err != nil {
+		return nil, err
+	}
+	if err = regex.SetRegexString(context.Background(), pattern, flags); err != nil {
+		// The error from SetRegexString takes precedence, as closing should only fail if something is very wrong
+		_ = regex.Close()
+		return nil, err
+	}
+	return regex, nil
+}
+
+// CompileFullMatch creates a Regex that only matches when the pattern matches the entire match string (or the entire
+// region, if one has been set), so that Matches reports whether the whole input is valid. The pattern is wrapped as
+// \A(?:pattern)\z, as wrapping it with ^ and $ fails for alternations (where "^a|b$" allows either half to match
+// alone) and with RegexFlags_Multiline (where ^ and $ also match at line terminators). Pattern therefore returns the
+// wrapped pattern, while the offsets within a ParseError refer to the pattern as it was given. As with CreateRegex, the
+// returned Regex must be closed, and does not use a string buffer.
+func CompileFullMatch(ctx context.Context, pattern string, flags RegexFlags) (Regex, error) {
+	// A literal pattern cannot be wrapped, so we escape it instead
+	if flags&RegexFlags_Literal != 0 {
+		pattern = QuoteMeta(pattern)
+		flags &^= RegexFlags_Literal
+	}
+	// A \Q that is never closed, or a comment at the end of the pattern, would otherwise continue through the closing
+	// parenthesis. Comments may be enabled by inline flags as well as by the given flags.
+	scan := scanPattern(pattern, flags)
+	if scan.quotedAtEnd {
+		pattern += `\E`
+	}
+	if scan.commentsAtEnd {
+		pattern += "\n"
+	}
+	regex, err := TryCreateRegex(0)
+	if err != nil {
+		return nil, err
+	}
+	if err = regex.SetRegexString(ctx, fullMatchPrefix+pattern+`)\z`, flags); err != nil {
+		// The error from SetRegexString takes precedence, as closing should only fail if something is very wrong
+		_ = regex.Close()
+		return nil, unwrapFullMatchError(err)
+	}
+	return regex, nil
+}
+
+// fullMatchPrefix is the text that CompileFullMatch places before the pattern.
+const fullMatchPrefix = `\A(?:`
+
+// unwrapFullMatchError moves the position of a ParseError from CompileFullMatch so that it refers to the pattern as it
+// was given, rather than the wrapped pattern. Only the first line contains the prefix. The closing suffix may still
+// appear in the PostContext, as it is what an unbalanced pattern fails against.
+func unwrapFullMatchError(err error) error {
+	goErr, ok := err.(*errors.Error)
+	if !ok {
+		return err
+	}
+	parseErr, ok := goErr.Cause().(*ParseError)
+	if !ok || parseErr.Line != 1 {
+		return err
+	}
+	unwrapped := *parseErr
+	prefixLen := utf8.RuneCountInString(fullMatchPrefix)
+	unwrapped.Offset = max(parseErr.Offset-prefixLen, 1)
+	// The PreContext holds the code units immediately before the error, so it only overlaps the prefix when the error is
+	// near the start of the pattern. The prefix is ASCII, so its code points and code units line up.
+	if overlap := prefixLen - (parseErr.Offset - 1 - len(utf16.Encode([]rune(parseErr.PreContext)))); overlap > 0 {
+		unwrapped.PreContext = parseErr.PreContext[min(overlap, len(parseErr.PreContext)):]
+	}
+	return ErrInvalidRegex.Wrap(&unwrapped)
+}
+
+// CompileExists creates a Regex that is only intended for checking whether a match exists, such as with Matches. Every
+// capture group is compiled as a non-capturing group, which spares ICU from tracking group positions while matching, so
+// the returned Regex cannot be used to extract groups, and replacements cannot reference them. Pattern returns the
+// rewritten pattern. Patterns with a backreference are compiled unchanged, since the referenced groups must still
+// capture. The pattern is validated as given, so any ParseError refers to the original pattern. As with CreateRegex, the
+// returned Regex must be closed, and does not use a string buffer.
+func CompileExists(pattern string, flags RegexFlags) (Regex, error) {
+	regex, err := CompileFrom(pattern, flags)
+	if err != nil {
+		return nil, err
+	}
+	pattern, flags, err = regex.Pattern()
+	if err == nil {
+		if stripped := stripCaptureGroups(pattern, flags); stripped != pattern {
+			err = regex.SetRegexString(context.Background(), stripped, flags)
+		}
+	}
+	if err != nil {
+		// The error from SetRegexString takes precedence, as closing should only fail if something is very wrong
+		_ = regex.Close()
+		return nil, err
+	}
+	return regex, nil
+}
+
+// FindSubmatchString compiles the pattern, and returns the text of the first match within the input followed by the
+// text of each capture group, in the same shape as FindStringSubmatch from Go's regexp package. Groups that did not
+// participate in the match are empty strings. Returns nil if there is no match. An invalid pattern returns
+// ErrInvalidRegex. The Regex is created and closed within this function, so this is intended for one-off matches, while
+// patterns that are used repeatedly should keep their Regex.
+func FindSubmatchString(ctx context.Context, pattern string, input string, flags RegexFlags) (results []string, err error) {
+	regex, err := CompileFrom(pattern, flags)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cErr := regex.Close(); err == nil {
+			err = cErr
+		}
+	}()
+	if err = regex.SetMatchString(ctx, input); err != nil {
+		return nil, err
+	}
+	match, ok, err := regex.FindLazy(ctx, 1)
+	if err != nil || !ok {
+		return nil, err
+	}
+	results = make([]string, regex.NumSubexp()+1)
+	for i := range results {
+		results[i] = match.Group(i)
+	}
+	return results, nil
+}
+
+// newPrivateRegex creates a *privateRegex that operates on the given module. The release function is called with the
+// module once the regex has been closed.
+func newPrivateRegex(mod api.Module, stringBufferInBytes uint32, release func(api.Module), opts []RegexOption) *privateRegex {
 	pr := &privateRegex{
 		mod:             mod,
+		release:         release,
 		regexPtr:        0,
 		regexStrUPtr:    0,
 		matchStrUPtr:    0,
 		matchStrUPtrLen: 0,
 
-		bufferSize:     stringBufferInBytes,
-		regexStrBuffer: 0,
-		matchStrBuffer: 0,
+		bufferSize:         stringBufferInBytes,
+		regexStrBuffer:     0,
+		matchStrBuffer:     0,
+		bufferGrowthFactor: 2,
 
 		g_globalStackVar: mod.ExportedGlobal("globalStackVar").(api.MutableGlobal),
 
@@ -140,6 +658,10 @@ func CreateRegex(stringBufferInBytes uint32) Regex {
 		f_u_strToUTF8:              mod.ExportedFunction("u_strToUTF8_68"),
 		f_u_strFromUTF8:            mod.ExportedFunction("u_strFromUTF8_68"),
 	}
+	pr.opts = opts
+	for _, opt := range opts {
+		opt(pr)
+	}
 	// If we're creating string buffers, then we'll preallocate them
 	if stringBufferInBytes > 0 {
 		ctx := context.Background()
@@ -174,16 +696,43 @@ func CreateRegex(stringBufferInBytes uint32) Regex {
 // privateRegex is the private implementation of the Regex interface.
 type privateRegex struct {
 	mod             api.Module
+	release         func(api.Module)
+	closed          bool
 	regexPtr        URegularExpressionPtr
 	regexStrUPtr    UCharPtr
 	matchStrUPtr    UCharPtr
 	matchStrUPtrLen int
-	callStack       [8]uint64
+	regionStart     int
+	regionEnd       int
+	// scanEnd is the end of the text that ICU was last given, which is before the end of the region while the scan is
+	// limited by maxScanLength.
+	scanEnd         int
+	maxScanLength   int
+	matchStrVersion uint64
+	regexStr        string
+	regexStrUTF16   []byte
+	regexFlags      RegexFlags
+	groups          []patternGroup
+	startAnchored   bool
+	// flagVariants are the regex compiled under other flags within this module, which are created by MatchesWithFlags.
+	flagVariants map[RegexFlags]URegularExpressionPtr
+	callStack    [8]uint64
+
+	// Options
+	opts                 []RegexOption
+	normalization        NormalizationForm
+	replacementSyntax    ReplacementSyntax
+	rejectLoneSurrogates bool
+	strictFlags          bool
+	bufferGrowthFactor   float64
 
 	// Buffer details
-	bufferSize     uint32
-	regexStrBuffer UCharPtr
-	matchStrBuffer UCharPtr
+	bufferSize           uint32
+	regexStrBuffer       UCharPtr
+	matchStrBuffer       UCharPtr
+	replacementStrBuffer reusableBuffer
+	replaceDestBuffer    reusableBuffer
+	flagVariantText      reusableBuffer
 
 	// Global Variables
 	g_globalStackVar api.MutableGlobal
@@ -208,36 +757,85 @@ type privateRegex struct {
 }
 
 var _ Regex = (*privateRegex)(nil)
+var _ GroupIndexer = (*privateRegex)(nil)
 
 // SetRegexString implements the interface Regex.
 func (pr *privateRegex) SetRegexString(ctx context.Context, regexStr string, flags RegexFlags) (err error) {
-	// Free any previously-set regex strings
-	if err = pr.closeRegexPtrs(); err != nil {
+	if pr.closed {
+		return ErrClosed.New()
+	}
+	if err = pr.checkSurrogates(regexStr); err != nil {
 		return err
 	}
+	if pr.strictFlags {
+		if idx, flagList, ok := findFlagConflict(regexStr, flags); ok {
+			return ErrConflictingFlags.New(flagList, idx)
+		}
+	}
 
-	// Convert regexStr to UTF16LE and then copy it to WASM memory
-	utf16RegexStr, regexStrULen := toUTF16(regexStr)
-	if uint32(regexStrULen*2) <= pr.bufferSize {
-		pr.regexStrUPtr = pr.regexStrBuffer
-	} else {
-		regexStrUPtr, err := pr.malloc(ctx, uint32(regexStrULen*2))
-		if err != nil {
-			return err
+	if text, offset, ok := pr.normalization.findUnnormalizedText(regexStr, flags); ok {
+		return ErrPatternNotNormalized.New(text, offset)
+	}
+
+	// Convert regexStr to UTF16LE, which is kept so that clones do not need to convert it again
+	utf16RegexStr, _ := toUTF16(regexStr)
+	// ICU rejects duplicate group names as a generic syntax error, so we check for them first to give a clearer error
+	groups := scanGroups(regexStr, flags)
+	if name, first, second, ok := duplicateGroupName(groups); ok {
+		return ErrDuplicateGroupName.New(name, first, second)
+	}
+	if err = pr.setEncodedRegex(ctx, utf16RegexStr, flags); err != nil {
+		return err
+	}
+	pr.regexStr = regexStr
+	pr.regexStrUTF16 = utf16RegexStr
+	pr.regexFlags = flags
+	pr.groups = groups
+	pr.startAnchored = isStartAnchored(regexStr, flags)
+	return nil
+}
+
+// regexNotSetError returns the error for when the regex pointer has not been set, which is either because the regex
+// has been closed, or because SetRegexString has not been called.
+func (pr *privateRegex) regexNotSetError() error {
+	if pr.closed {
+		return ErrClosed.New()
+	}
+	return ErrRegexNotYetSet.New()
+}
+
+// checkSurrogates returns ErrInvalidUTF16 if the string contains a surrogate code point while rejecting them.
+func (pr *privateRegex) checkSurrogates(str string) error {
+	if pr.rejectLoneSurrogates {
+		if idx := findSurrogate(str); idx != -1 {
+			return ErrInvalidUTF16.New(idx)
 		}
-		pr.regexStrUPtr = UCharPtr(regexStrUPtr)
 	}
-	pr.mod.Memory().Write(uint32(pr.regexStrUPtr), utf16RegexStr)
+	return nil
+}
+
+// setEncodedRegex copies the given UTF16LE regex string to WASM memory, and creates the URegularExpression* from it.
+// This does not set any of the details that are derived from the regex string.
+func (pr *privateRegex) setEncodedRegex(ctx context.Context, utf16RegexStr []byte, flags RegexFlags) (err error) {
+	// Free any previously-set regex strings. The match string was only given to the previous regex, so we also reset
+	// it to ensure that it's set again, rather than allowing the new regex to silently match against nothing.
+	if err = pr.closeRegexPtrs(); err != nil {
+		return err
+	}
+	if err = pr.closeMatchPtr(); err != nil {
+		return err
+	}
+
+	// Copy the regex string to WASM memory
+	if pr.regexStrUPtr, err = pr.writeString(ctx, pr.regexStrBuffer, utf16RegexStr); err != nil {
+		return err
+	}
 
 	// Create the URegularExpression*
-	errorCode := UErrorCode(0)
-	regex, err := pr.uregex_open(ctx, pr.regexStrUPtr, regexStrULen, uint32(flags), &errorCode)
+	regex, err := pr.compile(ctx, pr.regexStrUPtr, len(utf16RegexStr)/2, flags)
 	if err != nil {
 		return err
 	}
-	if errorCode > 0 {
-		return ErrInvalidRegex.New()
-	}
 	pr.regexPtr = regex
 	return nil
 }
@@ -246,7 +844,11 @@ func (pr *privateRegex) SetRegexString(ctx context.Context, regexStr string, fla
 func (pr *privateRegex) SetMatchString(ctx context.Context, matchStr string) (err error) {
 	// Check for the regex pointer first
 	if pr.regexPtr == 0 {
-		return ErrRegexNotYetSet.New()
+		return pr.regexNotSetError()
+	}
+
+	if err = pr.checkSurrogates(matchStr); err != nil {
+		return err
 	}
 
 	// Reset the match string pointer if necessary
@@ -255,18 +857,14 @@ func (pr *privateRegex) SetMatchString(ctx context.Context, matchStr string) (er
 	}
 
 	// Convert matchStr to UTF16LE and then copy it to WASM memory
-	utf16MatchStr, matchStrULen := toUTF16(matchStr)
-	if uint32(matchStrULen*2) <= pr.bufferSize {
-		pr.matchStrUPtr = pr.matchStrBuffer
-	} else {
-		matchStrUPtr, err := pr.malloc(ctx, uint32(matchStrULen*2))
-		if err != nil {
-			return err
-		}
-		pr.matchStrUPtr = UCharPtr(matchStrUPtr)
+	utf16MatchStr, matchStrULen := toUTF16(pr.normalization.normalize(matchStr))
+	if pr.matchStrUPtr, err = pr.writeString(ctx, pr.matchStrBuffer, utf16MatchStr); err != nil {
+		return err
 	}
 	pr.matchStrUPtrLen = matchStrULen
-	pr.mod.Memory().Write(uint32(pr.matchStrUPtr), utf16MatchStr)
+	pr.regionStart = 0
+	pr.regionEnd = matchStrULen
+	pr.scanEnd = matchStrULen
 
 	// Set the text on the URegularExpression*
 	errorCode := UErrorCode(0)
@@ -274,158 +872,1764 @@ func (pr *privateRegex) SetMatchString(ctx context.Context, matchStr string) (er
 	if err != nil {
 		return err
 	}
-	if errorCode > 0 {
-		return fmt.Errorf("unexpected UErrorCode from uregex_setText: %d", errorCode)
+	if errorCode.IsFailure() {
+		return newUErrorCodeError("uregex_setText", errorCode)
 	}
 	return nil
 }
 
-// Matches implements the interface Regex.
-func (pr *privateRegex) Matches(ctx context.Context, start int, occurrence int) (ok bool, err error) {
+// SetMatchUText implements the interface Regex.
+func (pr *privateRegex) SetMatchUText(ctx context.Context, provider ChunkProvider) error {
 	// Check for the regex pointer first
 	if pr.regexPtr == 0 {
-		return false, ErrRegexNotYetSet.New()
-	}
-
-	// Check that the match string has been set
-	if pr.matchStrUPtr == 0 {
-		return false, ErrMatchNotYetSet.New()
+		return pr.regexNotSetError()
 	}
 
-	// Return if we found a match
-	var errorCode UErrorCode
-	ok, err = pr.uregex_find(ctx, pr.regexPtr, start, &errorCode)
+	matchStr, err := readChunks(provider)
 	if err != nil {
-		return false, err
+		return err
 	}
-	for i := 1; i < occurrence && ok; i++ {
-		ok, err = pr.uregex_findNext(ctx, pr.regexPtr, &errorCode)
+	return pr.SetMatchString(ctx, matchStr)
+}
+
+// readChunks reads every chunk from the provider, and returns them joined into a single string.
+func readChunks(provider ChunkProvider) (string, error) {
+	var sb strings.Builder
+	for {
+		chunk, err := provider.NextChunk()
+		if err == io.EOF {
+			return sb.String(), nil
+		}
 		if err != nil {
-			return false, err
+			return "", err
 		}
+		sb.WriteString(chunk)
 	}
-	if errorCode > 0 {
-		return false, fmt.Errorf("unexpected UErrorCode from uregex_find/uregex_findNext: %d", errorCode)
-	}
-	return ok, err
 }
 
-// Replace implements the interface Regex.
-func (pr *privateRegex) Replace(ctx context.Context, replacementStr string, start int, occurrence int) (replacedStr string, err error) {
+// RefreshText implements the interface Regex.
+func (pr *privateRegex) RefreshText(ctx context.Context, text string) error {
 	// Check for the regex pointer first
 	if pr.regexPtr == 0 {
-		return "", ErrRegexNotYetSet.New()
+		return pr.regexNotSetError()
 	}
 
 	// Check that the match string has been set
 	if pr.matchStrUPtr == 0 {
-		return "", ErrMatchNotYetSet.New()
+		return ErrMatchNotYetSet.New()
 	}
 
-	// Convert replacementStr to UTF16LE and then copy it to WASM memory
-	//TODO: should probably copy this once and enforce that it has been set before running (also free & reset in Close)
-	utf16ReplacementStr, replacementStrULen := toUTF16(replacementStr)
-	replacementStrUPtr, err := pr.malloc(ctx, uint32(replacementStrULen*2))
-	if err != nil {
-		return "", err
+	if err := pr.checkSurrogates(text); err != nil {
+		return err
 	}
-	defer func() {
-		if fErr := pr.free(ctx, replacementStrUPtr); err == nil {
-			err = fErr
-		}
-	}()
-	pr.mod.Memory().Write(replacementStrUPtr, utf16ReplacementStr)
 
-	// Move to the starting position
-	var returnSize int
-	returnStr, err := pr.replace(ctx, pr.regexPtr, UCharPtr(replacementStrUPtr), replacementStrULen, pr.matchStrUPtr, pr.matchStrUPtrLen, start-1, occurrence, &returnSize)
-	if err != nil {
-		return "", err
+	// ICU reads the text directly from the buffer that was given to uregex_setText, so we only need to overwrite the
+	// buffer's contents for ICU to see the new text.
+	utf16Text, textULen := toUTF16(pr.normalization.normalize(text))
+	if textULen != pr.matchStrUPtrLen {
+		return ErrTextLengthMismatch.New(textULen, pr.matchStrUPtrLen)
 	}
-	defer func() {
-		if fErr := pr.free(ctx, uint32(returnStr)); err == nil {
-			err = fErr
-		}
-	}()
-	returnStrBytes, ok := pr.mod.Memory().Read(uint32(returnStr), uint32(returnSize*2))
-	if !ok {
-		return "", fmt.Errorf("somehow failed when retrieving the string with replacements")
+	if !pr.mod.Memory().Write(uint32(pr.matchStrUPtr), utf16Text) {
+		return fmt.Errorf("somehow failed when writing the refreshed text")
 	}
-	return fromUTF16(returnStrBytes), nil
+	pr.matchStrVersion++
+	return nil
 }
 
-// StringBufferSize implements the interface Regex.
-func (pr *privateRegex) StringBufferSize() uint32 {
-	return pr.bufferSize
+// SetRegion implements the interface Regex.
+func (pr *privateRegex) SetRegion(ctx context.Context, start int, end int) error {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return ErrMatchNotYetSet.New()
+	}
+
+	if start < 1 || start > end || end > pr.matchStrUPtrLen+1 {
+		return ErrInvalidRegion.New(start, end)
+	}
+	return pr.setRegion(ctx, start-1, end-1)
 }
 
-// Close implements the interface Regex.
-func (pr *privateRegex) Close() (err error) {
-	if pr == nil || pr.mod == nil {
-		return nil
+// SetRegionBytes implements the interface Regex.
+func (pr *privateRegex) SetRegionBytes(ctx context.Context, fromByte int, toByte int) error {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return pr.regexNotSetError()
 	}
-	err = pr.closeRegexPtrs()
-	if nErr := pr.closeMatchPtr(); err == nil {
-		err = nErr
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return ErrMatchNotYetSet.New()
 	}
-	// As we do not free the buffers in the other close functions (since they may be called without intending to close
-	// the regex as a whole), we take care of freeing them here.
-	if pr.bufferSize > 0 {
-		ctx := context.Background()
-		if nErr := pr.free(ctx, uint32(pr.regexStrBuffer)); err == nil {
-			err = nErr
+
+	matchStr, err := pr.matchStrSlice(0, pr.matchStrUPtrLen)
+	if err != nil {
+		return err
+	}
+	if fromByte < 1 || fromByte > toByte || toByte > len(matchStr)+1 {
+		return ErrInvalidRegion.New(fromByte, toByte)
+	}
+	// We walk the string one character at a time, so that positions within a character are rounded to its boundaries
+	startIdx, endIdx := -1, -1
+	codeUnitIdx := 0
+	for byteIdx, r := range matchStr {
+		runeEnd := byteIdx + utf8.RuneLen(r)
+		if startIdx == -1 && fromByte-1 < runeEnd {
+			startIdx = codeUnitIdx
 		}
-		if nErr := pr.free(ctx, uint32(pr.matchStrBuffer)); err == nil {
-			err = nErr
+		if endIdx == -1 && toByte-1 <= byteIdx {
+			endIdx = codeUnitIdx
 		}
+		codeUnitIdx += utf16.RuneLen(r)
 	}
-	if pr.mod != nil {
-		modulePool.Put(pr.mod)
-		pr.mod = nil
-		runtime.SetFinalizer(pr, nil)
+	if startIdx == -1 {
+		startIdx = codeUnitIdx
 	}
-	return err
+	if endIdx == -1 {
+		endIdx = codeUnitIdx
+	}
+	return pr.setRegion(ctx, startIdx, endIdx)
 }
 
-// closeRegexPtr closes the regex pointers if they exist. This will not free the string buffer if it is being used.
-func (pr *privateRegex) closeRegexPtrs() (err error) {
-	ctx := context.Background()
-	if pr.regexPtr != 0 {
-		err = pr.uregex_close(ctx, pr.regexPtr)
+// RegionBytes implements the interface Regex.
+func (pr *privateRegex) RegionBytes() (from int, to int, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, 0, pr.regexNotSetError()
 	}
-	if pr.regexStrUPtr != pr.regexStrBuffer && pr.regexStrUPtr != 0 {
-		if freeErr := pr.free(ctx, uint32(pr.regexStrUPtr)); err == nil {
-			err = freeErr
-		}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return 0, 0, ErrMatchNotYetSet.New()
 	}
-	pr.regexPtr = 0
-	pr.regexStrUPtr = 0
-	return err
+
+	// The region always falls on character boundaries, so the byte lengths of the surrounding text give the positions
+	before, err := pr.matchStrSlice(0, pr.regionStart)
+	if err != nil {
+		return 0, 0, err
+	}
+	region, err := pr.matchStrSlice(pr.regionStart, pr.regionEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(before) + 1, len(before) + len(region) + 1, nil
 }
 
-// closeMatchPtr closes the match string pointer if it exists. This will not free the string buffer if it is being used.
-func (pr *privateRegex) closeMatchPtr() (err error) {
-	if pr.matchStrUPtr != pr.matchStrBuffer && pr.matchStrUPtr != 0 {
-		err = pr.free(context.Background(), uint32(pr.matchStrUPtr))
+// Region implements the interface Regex.
+func (pr *privateRegex) Region(ctx context.Context) (start int, end int, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, 0, pr.regexNotSetError()
 	}
-	pr.matchStrUPtr = 0
-	pr.matchStrUPtrLen = 0
-	return err
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return 0, 0, ErrMatchNotYetSet.New()
+	}
+
+	// ICU's uregex_regionStart and uregex_regionEnd are not exported from the module, and ICU would report the bounds of
+	// the text that we gave it anyway, so we return the region that we're tracking
+	return pr.regionStart + 1, pr.regionEnd + 1, nil
 }
 
-// toUTF16 returns a byte slice that contains the given string converted to UTF16LE, which is required for use with the
-// ICU library. The length returned is the length that should be passed to ICU functions.
-func toUTF16(str string) (convertedString []byte, length int) {
-	// ICU complains about the lack of NULL-termination, but it works anyway. Adding NULL at the end seems to
-	// prevent some matches (both a single NULL and two NULLs since it's a char16_t array). We just ignore the warning.
-	utf16Raw := utf16.Encode([]rune(str))
-	length = len(utf16Raw)
-	convertedString = make([]byte, length*2)
-	for i := 0; i < length; i++ {
-		convertedString[2*i] = byte(utf16Raw[i])
-		convertedString[(2*i)+1] = byte(utf16Raw[i] >> 8)
+// SetMaxScanLength implements the interface Regex.
+func (pr *privateRegex) SetMaxScanLength(n int) {
+	pr.maxScanLength = n
+}
+
+// Matches implements the interface Regex.
+func (pr *privateRegex) Matches(ctx context.Context, start int, occurrence int) (ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return false, pr.regexNotSetError()
 	}
-	return
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return false, ErrMatchNotYetSet.New()
+	}
+
+	// A start-anchored regex can only match once, at the beginning of the match string, so there's no need to search.
+	// ICU already limits its search to the beginning when given such a regex, but skipped occurrences still rescan.
+	if pr.startAnchored && (start > pr.regionStart || occurrence > 1) {
+		return false, nil
+	}
+
+	// Return if we found a match
+	return pr.findOccurrence(ctx, start, occurrence)
+}
+
+// MatchesWithFlags implements the interface Regex.
+func (pr *privateRegex) MatchesWithFlags(ctx context.Context, input string, flags RegexFlags) (ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return false, pr.regexNotSetError()
+	}
+	if err = pr.checkSurrogates(input); err != nil {
+		return false, err
+	}
+
+	// The regex string remains in the module while the regex is set, so each variant is compiled from it
+	regexPtr := pr.regexPtr
+	if flags != pr.regexFlags {
+		var found bool
+		if regexPtr, found = pr.flagVariants[flags]; !found {
+			if regexPtr, err = pr.compile(ctx, pr.regexStrUPtr, len(pr.regexStrUTF16)/2, flags); err != nil {
+				return false, err
+			}
+			if pr.flagVariants == nil {
+				pr.flagVariants = make(map[RegexFlags]URegularExpressionPtr)
+			}
+			pr.flagVariants[flags] = regexPtr
+		}
+	}
+
+	utf16Input, inputULen := toUTF16(pr.normalization.normalize(input))
+	inputUPtr, err := pr.reserve(ctx, &pr.flagVariantText, uint32(len(utf16Input)))
+	if err != nil {
+		return false, err
+	}
+	pr.mod.Memory().Write(inputUPtr, utf16Input)
+	errorCode := UErrorCode(0)
+	if err = pr.uregex_setText(ctx, regexPtr, UCharPtr(inputUPtr), inputULen, &errorCode); err != nil {
+		return false, err
+	}
+	if errorCode.IsFailure() {
+		return false, newUErrorCodeError("uregex_setText", errorCode)
+	}
+	if ok, err = pr.uregex_find(ctx, regexPtr, 0, &errorCode); err != nil {
+		return false, err
+	}
+	if errorCode.IsFailure() {
+		return false, newUErrorCodeError("uregex_find", errorCode)
+	}
+	// Our own regex is given back the text that it had, so that the match string is unchanged
+	if regexPtr == pr.regexPtr && pr.matchStrUPtr != 0 {
+		err = pr.uregex_setText(ctx, pr.regexPtr, pr.matchStrUPtr+UCharPtr(pr.regionStart*2), pr.scanEnd-pr.regionStart, &errorCode)
+		if err != nil {
+			return false, err
+		}
+		if errorCode.IsFailure() {
+			return false, newUErrorCodeError("uregex_setText", errorCode)
+		}
+	}
+	return ok, nil
+}
+
+// MatchesInRegions implements the interface Regex.
+func (pr *privateRegex) MatchesInRegions(ctx context.Context, regions [][2]int) (results []bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, ErrMatchNotYetSet.New()
+	}
+
+	// Validate every region before we change anything, so that an invalid region doesn't leave partial results
+	for _, region := range regions {
+		if region[0] < 1 || region[0] > region[1] || region[1] > pr.matchStrUPtrLen+1 {
+			return nil, ErrInvalidRegion.New(region[0], region[1])
+		}
+	}
+
+	// Each region only repoints ICU at a different portion of the already-written text, so we restore the caller's
+	// region the same way once we're done
+	prevStart, prevEnd := pr.regionStart, pr.regionEnd
+	defer func() {
+		if nErr := pr.setRegion(ctx, prevStart, prevEnd); nErr != nil && err == nil {
+			results = nil
+			err = nErr
+		}
+	}()
+
+	results = make([]bool, len(regions))
+	for i, region := range regions {
+		if err = pr.setRegion(ctx, region[0]-1, region[1]-1); err != nil {
+			return nil, err
+		}
+		if results[i], err = pr.findOccurrence(ctx, pr.regionStart, 1); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// IsStartAnchored implements the interface Regex.
+func (pr *privateRegex) IsStartAnchored(ctx context.Context) (bool, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return false, pr.regexNotSetError()
+	}
+	return pr.startAnchored, nil
+}
+
+// Replace implements the interface Regex.
+func (pr *privateRegex) Replace(ctx context.Context, replacementStr string, start int, occurrence int) (replacedStr string, err error) {
+	replacedStr, _, err = pr.replaceString(ctx, replacementStr, start, occurrence)
+	return replacedStr, err
+}
+
+// ReplaceAllString implements the interface Regex.
+func (pr *privateRegex) ReplaceAllString(ctx context.Context, replacementStr string) (result string, replaced bool, err error) {
+	return pr.replaceString(ctx, replacementStr, 1, 0)
+}
+
+// replaceString is the implementation of Replace, which also returns whether anything was replaced.
+func (pr *privateRegex) replaceString(ctx context.Context, replacementStr string, start int, occurrence int) (replacedStr string, replaced bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return "", false, ErrMatchNotYetSet.New()
+	}
+
+	replacementStrUPtr, replacementStrULen, err := pr.writeReplacementString(ctx, replacementStr)
+	if err != nil {
+		return "", false, err
+	}
+
+	// A negative index tells ICU to continue from the previous match, which would depend on whatever was called last
+	if start < 1 {
+		start = 1
+	}
+	// ICU would report this error when searching from past the end of the text
+	if start-1 > pr.matchStrUPtrLen {
+		return "", false, newUErrorCodeError("uregex_find", U_INDEX_OUTOFBOUNDS_ERROR)
+	}
+	// ICU only sees the text within the region, so nothing after the region can be replaced
+	if start-1 > pr.regionEnd {
+		replacedStr, err = pr.matchStrSlice(0, pr.matchStrUPtrLen)
+		return replacedStr, false, err
+	}
+	replacedStr, originalSpans, err := pr.appendReplacements(ctx, replacementStrUPtr, replacementStrULen, start-1, occurrence)
+	if err != nil {
+		// ICU reports references to groups that do not exist while appending, however Replace has always dropped the
+		// replacement in that case (as MySQL does) rather than failing, so the result keeps only the surrounding text
+		if invalidErr, ok := err.(*invalidReplacementError); ok {
+			return invalidErr.remainder, true, nil
+		}
+		return "", false, err
+	}
+	return replacedStr, len(originalSpans) > 0, nil
+}
+
+// writeReplacementString translates the replacement string into ICU's syntax, and copies it to WASM memory as UTF16LE.
+// The buffer is reused across calls, so the returned location is only valid until the next replacement.
+func (pr *privateRegex) writeReplacementString(ctx context.Context, replacementStr string) (UCharPtr, int, error) {
+	utf16ReplacementStr, replacementStrULen := toUTF16(pr.replacementSyntax.translate(replacementStr))
+	replacementStrUPtr, err := pr.reserve(ctx, &pr.replacementStrBuffer, uint32(replacementStrULen*2))
+	if err != nil {
+		return 0, 0, err
+	}
+	pr.mod.Memory().Write(replacementStrUPtr, utf16ReplacementStr)
+	return UCharPtr(replacementStrUPtr), replacementStrULen, nil
+}
+
+// ReplaceAllSizeDelta implements the interface Regex.
+func (pr *privateRegex) ReplaceAllSizeDelta(ctx context.Context, replacementStr string) (deltaBytes int, matches int, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, 0, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return 0, 0, ErrMatchNotYetSet.New()
+	}
+
+	template, err := parseReplacementTemplate(pr.replacementSyntax.translate(replacementStr), pr.groups)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Each match and group is converted to UTF-8 to measure it, as the UTF-16 length does not determine the UTF-8 length
+	groupLen := func(group int) (int, error) {
+		groupStart, groupEnd, err := pr.groupBounds(ctx, group)
+		if err != nil || groupStart < 0 {
+			return 0, err
+		}
+		text, err := pr.matchStrSlice(groupStart, groupEnd)
+		return len(text), err
+	}
+	ok, err := pr.findOccurrence(ctx, 0, 1)
+	for ; ok; ok, err = pr.findNext(ctx) {
+		matches++
+		matchLen, err := groupLen(0)
+		if err != nil {
+			return 0, 0, err
+		}
+		deltaBytes += template.literalLen - matchLen
+		for _, group := range template.references {
+			referenceLen, err := groupLen(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			deltaBytes += referenceLen
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return deltaBytes, matches, nil
+}
+
+// Partition implements the interface Regex.
+func (pr *privateRegex) Partition(ctx context.Context, start int, occurrence int) (before string, match string, after string, ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", "", "", false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return "", "", "", false, ErrMatchNotYetSet.New()
+	}
+
+	matchStart, matchEnd, ok, err := pr.substringBounds(ctx, start-1, occurrence)
+	if err != nil || !ok {
+		return "", "", "", false, err
+	}
+	if before, err = pr.matchStrSlice(0, matchStart); err != nil {
+		return "", "", "", false, err
+	}
+	if match, err = pr.matchStrSlice(matchStart, matchEnd); err != nil {
+		return "", "", "", false, err
+	}
+	if after, err = pr.matchStrSlice(matchEnd, pr.matchStrUPtrLen); err != nil {
+		return "", "", "", false, err
+	}
+	return before, match, after, true, nil
+}
+
+// NamedGroupsOrdered implements the interface Regex.
+func (pr *privateRegex) NamedGroupsOrdered(ctx context.Context, start int, occurrence int) (groups []NamedGroup, ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, false, ErrMatchNotYetSet.New()
+	}
+
+	if ok, err = pr.findOccurrence(ctx, start-1, occurrence); err != nil || !ok {
+		return nil, false, err
+	}
+	// The names are indexed by group number, which is the order that the groups appear in the regex
+	for number, name := range pr.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		groupStart, groupEnd, err := pr.groupBounds(ctx, number)
+		if err != nil {
+			return nil, false, err
+		}
+		var value string
+		if groupStart >= 0 {
+			if value, err = pr.matchStrSlice(groupStart, groupEnd); err != nil {
+				return nil, false, err
+			}
+		}
+		groups = append(groups, NamedGroup{Name: name, Value: value})
+	}
+	return groups, true, nil
+}
+
+// GroupTree implements the interface Regex.
+func (pr *privateRegex) GroupTree(ctx context.Context, start int, occurrence int) (root *GroupNode, ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, false, ErrMatchNotYetSet.New()
+	}
+
+	if ok, err = pr.findOccurrence(ctx, start-1, occurrence); err != nil || !ok {
+		return nil, false, err
+	}
+	// Nodes are indexed by group number, and remain nil for groups that did not participate in the match
+	nodes := make([]*GroupNode, len(pr.groups)+1)
+	parents := make([]int, len(pr.groups)+1)
+	for number := range nodes {
+		var name string
+		if number > 0 {
+			name = pr.groups[number-1].name
+			parents[number] = pr.groups[number-1].parent
+		}
+		groupStart, groupEnd, err := pr.groupBounds(ctx, number)
+		if err != nil {
+			return nil, false, err
+		}
+		if groupStart < 0 {
+			continue
+		}
+		text, err := pr.matchStrSlice(groupStart, groupEnd)
+		if err != nil {
+			return nil, false, err
+		}
+		node := &GroupNode{
+			Number: number,
+			Name:   name,
+			Bounds: MatchBounds{Start: groupStart + 1, End: groupEnd + 1},
+			Text:   text,
+		}
+		nodes[number] = node
+		if number == 0 {
+			continue
+		}
+		parent := parents[number]
+		for parent != 0 && (nodes[parent] == nil ||
+			node.Bounds.Start < nodes[parent].Bounds.Start || node.Bounds.End > nodes[parent].Bounds.End) {
+			parent = parents[parent]
+		}
+		nodes[parent].Children = append(nodes[parent].Children, node)
+	}
+	return nodes[0], true, nil
+}
+
+// SubstringFrom implements the interface Regex.
+func (pr *privateRegex) SubstringFrom(ctx context.Context, start int, occurrence int) (text string, endPos int, ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", 0, false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return "", 0, false, ErrMatchNotYetSet.New()
+	}
+
+	matchStart, matchEnd, ok, err := pr.substringBounds(ctx, start-1, occurrence)
+	if err != nil || !ok {
+		return "", 0, false, err
+	}
+	if text, err = pr.matchStrSlice(matchStart, matchEnd); err != nil {
+		return "", 0, false, err
+	}
+	return text, matchEnd + 1, true, nil
+}
+
+// SubstringGrapheme implements the interface Regex.
+func (pr *privateRegex) SubstringGrapheme(ctx context.Context, start int, occurrence int) (string, bool, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return "", false, ErrMatchNotYetSet.New()
+	}
+
+	matchStart, matchEnd, ok, err := pr.substringBounds(ctx, start-1, occurrence)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	matchStr, err := pr.matchStrSlice(0, pr.matchStrUPtrLen)
+	if err != nil {
+		return "", false, err
+	}
+	// We convert the code unit offsets into rune indexes, as grapheme clusters are made of runes
+	runes := []rune(matchStr)
+	runeStart, runeEnd := len(runes), len(runes)
+	codeUnitIdx := 0
+	for i, r := range runes {
+		if runeStart == len(runes) && matchStart <= codeUnitIdx {
+			runeStart = i
+		}
+		if matchEnd <= codeUnitIdx {
+			runeEnd = i
+			break
+		}
+		codeUnitIdx += utf16.RuneLen(r)
+	}
+	for !isGraphemeBoundary(runes, runeStart) {
+		runeStart--
+	}
+	for !isGraphemeBoundary(runes, runeEnd) {
+		runeEnd++
+	}
+	return string(runes[runeStart:runeEnd]), true, nil
+}
+
+// FindAllString implements the interface Regex.
+func (pr *privateRegex) FindAllString(ctx context.Context, start int, limit int) ([]string, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, ErrMatchNotYetSet.New()
+	}
+
+	return pr.allGroup(ctx, start-1, 0, limit, false)
+}
+
+// ReplaceAllWithSpans implements the interface Regex.
+func (pr *privateRegex) ReplaceAllWithSpans(ctx context.Context, replacementStr string) (result string, originalSpans []MatchBounds, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return "", nil, ErrMatchNotYetSet.New()
+	}
+
+	replacementStrUPtr, replacementStrULen, err := pr.writeReplacementString(ctx, replacementStr)
+	if err != nil {
+		return "", nil, err
+	}
+	result, originalSpans, err = pr.appendReplacements(ctx, replacementStrUPtr, replacementStrULen, 0, 0)
+	if invalidErr, ok := err.(*invalidReplacementError); ok {
+		return "", nil, invalidErr.err
+	}
+	return result, originalSpans, err
+}
+
+// FindAllRuneBounds implements the interface Regex.
+func (pr *privateRegex) FindAllRuneBounds(ctx context.Context, start int, limit int) ([]MatchBounds, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, ErrMatchNotYetSet.New()
+	}
+
+	matchStr, err := pr.matchStrSlice(0, pr.matchStrUPtrLen)
+	if err != nil {
+		return nil, err
+	}
+	// We map every code unit to the rune that contains it, while also finding the code unit that the search starts at
+	unitToRune := make([]int, pr.matchStrUPtrLen+1)
+	startIdx := start - 1
+	codeUnitIdx, runeIdx := 0, 0
+	for _, r := range matchStr {
+		if runeIdx == start-1 {
+			startIdx = codeUnitIdx
+		}
+		for n := utf16.RuneLen(r); n > 0; n-- {
+			unitToRune[codeUnitIdx] = runeIdx
+			codeUnitIdx++
+		}
+		runeIdx++
+	}
+	unitToRune[codeUnitIdx] = runeIdx
+	// Positions beyond the end are kept the same distance beyond the end, so that they behave like FindAllString
+	if start-1 >= runeIdx {
+		startIdx = codeUnitIdx + (start - 1 - runeIdx)
+	}
+
+	var results []MatchBounds
+	ok, err := pr.findOccurrence(ctx, startIdx, 1)
+	for ; ok && (limit < 1 || len(results) < limit); ok, err = pr.findNext(ctx) {
+		matchStart, matchEnd, err := pr.groupBounds(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, MatchBounds{Start: unitToRune[matchStart] + 1, End: unitToRune[matchEnd] + 1})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// MatchReaderAll implements the interface Regex.
+func (pr *privateRegex) MatchReaderAll(ctx context.Context, r io.Reader, window int, overlap int) ([]MatchBounds, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+	return matchReaderAll(r, window, overlap, func(text string, eof bool, carryStart int) ([]MatchBounds, error) {
+		return pr.matchWindow(ctx, text, eof, carryStart)
+	})
+}
+
+// matchReaderAll reads the text from the reader in windows for MatchReaderAll, and gives each window to matchWindow,
+// which returns the bounds (in bytes, starting at 1) of the matches within the window that begin before carryStart,
+// unless eof is true, in which case it returns every match. The reader is only used by the calling goroutine.
+func matchReaderAll(r io.Reader, window int, overlap int, matchWindow func(text string, eof bool, carryStart int) ([]MatchBounds, error)) ([]MatchBounds, error) {
+	if overlap < 0 || window <= overlap {
+		return nil, ErrInvalidWindow.New(window, overlap)
+	}
+
+	var results []MatchBounds
+	// The text that is currently being matched, along with the offset of its first byte within the entire text
+	var buf []byte
+	bufOffset := 0
+	// Matches may not begin before this offset, which prevents reporting matches within the overlap twice
+	minStart := 0
+	for eof := false; !eof; {
+		carried := len(buf)
+		buf = append(buf, make([]byte, window)...)
+		n, err := io.ReadFull(r, buf[carried:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return nil, err
+		}
+		buf = buf[:carried+n]
+		// A character that is cut off by the end of the window is held back until the next window completes it
+		usable := len(buf)
+		if !eof {
+			usable -= incompleteSuffixLen(buf)
+		}
+		// Matches that begin within the overlap will be found again in the next window, where they may be longer
+		carryStart := max(usable-overlap, 0)
+		for carryStart > 0 && !utf8.RuneStart(buf[carryStart]) {
+			carryStart--
+		}
+
+		matches, err := matchWindow(string(buf[:usable]), eof, carryStart)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if bufOffset+match.Start-1 < minStart {
+				continue
+			}
+			results = append(results, MatchBounds{Start: bufOffset + match.Start, End: bufOffset + match.End})
+			minStart = max(bufOffset+match.End-1, bufOffset+match.Start)
+		}
+		buf = append(buf[:0], buf[carryStart:]...)
+		bufOffset += carryStart
+	}
+	return results, nil
+}
+
+// matchWindow sets the match string to a single window of MatchReaderAll, and returns the bounds (in bytes, starting
+// at 1) of every match within it. Unless eof is true, matches stop at the first one that begins at or after
+// carryStart, as those are found again in the next window.
+func (pr *privateRegex) matchWindow(ctx context.Context, text string, eof bool, carryStart int) ([]MatchBounds, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+	if err := pr.SetMatchString(ctx, text); err != nil {
+		return nil, err
+	}
+	// The match bounds are in code units, so we map every code unit to the byte that begins it
+	unitToByte := make([]int, 0, pr.matchStrUPtrLen+1)
+	for byteIdx := 0; byteIdx < len(text); {
+		r, size := utf8.DecodeRuneInString(text[byteIdx:])
+		for n := utf16.RuneLen(r); n > 0; n-- {
+			unitToByte = append(unitToByte, byteIdx)
+		}
+		byteIdx += size
+	}
+	unitToByte = append(unitToByte, len(text))
+
+	var matches []MatchBounds
+	ok, err := pr.findOccurrence(ctx, 0, 1)
+	for ; ok; ok, err = pr.findNext(ctx) {
+		matchStart, matchEnd, err := pr.groupBounds(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		startByte, endByte := unitToByte[matchStart], unitToByte[matchEnd]
+		if !eof && startByte >= carryStart {
+			break
+		}
+		matches = append(matches, MatchBounds{Start: startByte + 1, End: endByte + 1})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// AllGroup implements the interface Regex.
+func (pr *privateRegex) AllGroup(ctx context.Context, group int, limit int) ([]string, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, ErrMatchNotYetSet.New()
+	}
+
+	return pr.allGroup(ctx, 0, group, limit, false)
+}
+
+// AllGroupParticipating implements the interface Regex.
+func (pr *privateRegex) AllGroupParticipating(ctx context.Context, group int, limit int) ([]string, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, ErrMatchNotYetSet.New()
+	}
+
+	return pr.allGroup(ctx, 0, group, limit, true)
+}
+
+// FindAllSubmatchColumnar implements the interface Regex.
+func (pr *privateRegex) FindAllSubmatchColumnar(ctx context.Context, start int, limit int) (matchStarts []int, matchEnds []int, groups [][]string, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, nil, nil, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, nil, nil, ErrMatchNotYetSet.New()
+	}
+
+	groups = make([][]string, len(pr.groups)+1)
+	ok, err := pr.findOccurrence(ctx, start-1, 1)
+	for ; ok && (limit < 1 || len(matchStarts) < limit); ok, err = pr.findNext(ctx) {
+		for group := range groups {
+			groupStart, groupEnd, err := pr.groupBounds(ctx, group)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if group == 0 {
+				matchStarts = append(matchStarts, groupStart+1)
+				matchEnds = append(matchEnds, groupEnd+1)
+			}
+			var text string
+			if groupStart >= 0 {
+				if text, err = pr.matchStrSlice(groupStart, groupEnd); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			groups[group] = append(groups[group], text)
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return matchStarts, matchEnds, groups, nil
+}
+
+// allGroup returns the text of the given group from every match, beginning the search at the given zero-based index.
+// This is the shared implementation of FindAllString, AllGroup, and AllGroupParticipating.
+func (pr *privateRegex) allGroup(ctx context.Context, startIdx int, group int, limit int, skipNonParticipating bool) ([]string, error) {
+	var results []string
+	ok, err := pr.findOccurrence(ctx, startIdx, 1)
+	for ; ok && (limit < 1 || len(results) < limit); ok, err = pr.findNext(ctx) {
+		groupStart, groupEnd, err := pr.groupBounds(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+		if groupStart < 0 {
+			if !skipNonParticipating {
+				results = append(results, "")
+			}
+			continue
+		}
+		groupStr, err := pr.matchStrSlice(groupStart, groupEnd)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, groupStr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GroupIndexAcrossMatches implements the interface GroupIndexer.
+func (pr *privateRegex) GroupIndexAcrossMatches(ctx context.Context, group int, occurrence int, endIndex bool) (int, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return 0, ErrMatchNotYetSet.New()
+	}
+
+	participations := 0
+	ok, err := pr.findOccurrence(ctx, 0, 1)
+	for ; ok; ok, err = pr.findNext(ctx) {
+		groupStart, groupEnd, err := pr.groupBounds(ctx, group)
+		if err != nil {
+			return 0, err
+		}
+		if groupStart < 0 {
+			continue
+		}
+		participations++
+		if participations >= occurrence {
+			if endIndex {
+				return groupEnd + 1, nil
+			}
+			return groupStart + 1, nil
+		}
+	}
+	return 0, err
+}
+
+// FindLazy implements the interface Regex.
+func (pr *privateRegex) FindLazy(ctx context.Context, start int) (match *LazyMatch, ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return nil, false, ErrMatchNotYetSet.New()
+	}
+
+	if ok, err = pr.findOccurrence(ctx, start-1, 1); err != nil || !ok {
+		return nil, false, err
+	}
+	// Retrieving the bounds is cheap compared to creating strings, so we retrieve all of them now
+	bounds := make([]MatchBounds, len(pr.groups)+1)
+	for group := range bounds {
+		groupStart, groupEnd, err := pr.groupBounds(ctx, group)
+		if err != nil {
+			return nil, false, err
+		}
+		if groupStart >= 0 {
+			bounds[group] = MatchBounds{Start: groupStart + 1, End: groupEnd + 1}
+		}
+	}
+	version := pr.matchStrVersion
+	return newLazyMatch(bounds, pr.groups, func(startIdx int, endIdx int) (string, bool) {
+		if pr.matchStrVersion != version {
+			return "", false
+		}
+		str, err := pr.matchStrSlice(startIdx, endIdx)
+		return str, err == nil
+	}), true, nil
+}
+
+// FindFrom implements the interface Regex.
+func (pr *privateRegex) FindFrom(ctx context.Context, pos int) (bounds MatchBounds, ok bool, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return MatchBounds{}, false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return MatchBounds{}, false, ErrMatchNotYetSet.New()
+	}
+
+	// Stepping past an empty match at the end of the string leads past the end, where there is nothing left to find
+	if pos-1 > pr.matchStrUPtrLen {
+		return MatchBounds{}, false, nil
+	}
+	matchStart, matchEnd, ok, err := pr.substringBounds(ctx, pos-1, 1)
+	if err != nil || !ok {
+		return MatchBounds{}, false, err
+	}
+	return MatchBounds{Start: matchStart + 1, End: matchEnd + 1}, true, nil
+}
+
+// LongestPrefixMatch implements the interface Regex.
+func (pr *privateRegex) LongestPrefixMatch(ctx context.Context) (length int, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return 0, ErrMatchNotYetSet.New()
+	}
+
+	matchEnd, ok, err := pr.lookingAt(ctx, pr.regionStart)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return matchEnd - pr.regionStart, nil
+}
+
+// ExplainNonMatch implements the interface Regex.
+func (pr *privateRegex) ExplainNonMatch(ctx context.Context) (string, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return "", ErrMatchNotYetSet.New()
+	}
+
+	bounds, ok, err := pr.tryPattern(ctx, pr.regexStr, pr.regexFlags)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return fmt.Sprintf("the regex matches at position %d", bounds.Start), nil
+	}
+	hints := []string{"the regex does not match"}
+	addHint := func(pattern string, flags RegexFlags, format string) error {
+		if pattern == pr.regexStr && flags == pr.regexFlags {
+			return nil
+		}
+		bounds, ok, err := pr.tryPattern(ctx, pattern, flags)
+		if err == nil && ok {
+			hints = append(hints, fmt.Sprintf(format, bounds.Start))
+		}
+		return err
+	}
+	if err = addHint(pr.regexStr, pr.regexFlags|RegexFlags_Case_Insensitive,
+		"the regex matches at position %d when ignoring case"); err != nil {
+		return "", err
+	}
+	if err = addHint(pr.regexStr, pr.regexFlags|RegexFlags_Multiline,
+		"the regex matches at position %d in multiline mode, where ^ and $ also match at line boundaries"); err != nil {
+		return "", err
+	}
+	if err = addHint(pr.regexStr, pr.regexFlags|RegexFlags_Dot_All,
+		"the regex matches at position %d when . also matches line terminators"); err != nil {
+		return "", err
+	}
+	if pr.regexFlags&RegexFlags_Literal == 0 {
+		if pattern, ok := stripStartAnchor(pr.regexStr); ok {
+			if err = addHint(pattern, pr.regexFlags,
+				"the regex matches at position %d without its leading anchor, so a match exists but not at the beginning"); err != nil {
+				return "", err
+			}
+		}
+		if pattern, ok := stripEndAnchor(pr.regexStr); ok {
+			if err = addHint(pattern, pr.regexFlags,
+				"the regex matches at position %d without its trailing anchor, so a match exists but not at the end"); err != nil {
+				return "", err
+			}
+		}
+	}
+	// We look for the longest prefix of the regex that matches, as the remainder is where matching fails. Prefixes end
+	// between tokens and have their open groups closed, so that they remain valid patterns.
+	cuts := patternCuts(pr.regexStr, pr.regexFlags)
+	for i := len(cuts) - 1; i >= 0; i-- {
+		prefix := pr.regexStr[:cuts[i].offset]
+		bounds, ok, err := pr.tryPattern(ctx, prefix+strings.Repeat(")", cuts[i].open), pr.regexFlags)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			hints = append(hints, fmt.Sprintf("the beginning of the regex, %q, matches at position %d, but the remainder, "+
+				"%q, fails to match at position %d", prefix, bounds.Start, pr.regexStr[cuts[i].offset:], bounds.End))
+			break
+		}
+	}
+	if len(hints) == 1 {
+		hints = append(hints, "no part of the regex matches, even with different flags")
+	}
+	return strings.Join(hints, "\n"), nil
+}
+
+// GroupCount implements the interface Regex.
+func (pr *privateRegex) GroupCount() (int, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, pr.regexNotSetError()
+	}
+	return len(pr.groups), nil
+}
+
+// NumSubexp implements the interface Regex.
+func (pr *privateRegex) NumSubexp() int {
+	return len(pr.groups)
+}
+
+// SubexpNames implements the interface Regex.
+func (pr *privateRegex) SubexpNames() []string {
+	if pr.regexPtr == 0 {
+		return nil
+	}
+	names := make([]string, len(pr.groups)+1)
+	for _, group := range pr.groups {
+		names[group.number] = group.name
+	}
+	return names
+}
+
+// NamedGroupCount implements the interface Regex.
+func (pr *privateRegex) NamedGroupCount(ctx context.Context) (int, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return 0, pr.regexNotSetError()
+	}
+	count := 0
+	for _, group := range pr.groups {
+		if group.name != "" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ValidateReplacement implements the interface Regex.
+func (pr *privateRegex) ValidateReplacement(ctx context.Context, replacementStr string) error {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return pr.regexNotSetError()
+	}
+
+	_, err := parseReplacementTemplate(pr.replacementSyntax.translate(replacementStr), pr.groups)
+	return err
+}
+
+// Pattern implements the interface Regex.
+func (pr *privateRegex) Pattern() (pattern string, flags RegexFlags, err error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return "", RegexFlags_None, pr.regexNotSetError()
+	}
+	return pr.regexStr, pr.regexFlags, nil
+}
+
+// MatchWithContext implements the interface Regex.
+func (pr *privateRegex) MatchWithContext(ctx context.Context, start int, occurrence int, contextLines int) (ContextResult, bool, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return ContextResult{}, false, pr.regexNotSetError()
+	}
+
+	// Check that the match string has been set
+	if pr.matchStrUPtr == 0 {
+		return ContextResult{}, false, ErrMatchNotYetSet.New()
+	}
+
+	matchStart, matchEnd, ok, err := pr.substringBounds(ctx, start-1, occurrence)
+	if err != nil || !ok {
+		return ContextResult{}, false, err
+	}
+	strBytes, ok := pr.mod.Memory().Read(uint32(pr.matchStrUPtr), uint32(pr.matchStrUPtrLen*2))
+	if !ok {
+		return ContextResult{}, false, fmt.Errorf("somehow failed when retrieving the match string")
+	}
+	units := make([]uint16, pr.matchStrUPtrLen)
+	for i := range units {
+		units[i] = uint16(strBytes[2*i]) | uint16(strBytes[2*i+1])<<8
+	}
+	return newContextResult(units, matchStart, matchEnd, contextLines, pr.regexFlags&RegexFlags_Unix_Lines != 0), true, nil
+}
+
+// Clone implements the interface Regex.
+func (pr *privateRegex) Clone(ctx context.Context) (Regex, error) {
+	// Check for the regex pointer first
+	if pr.regexPtr == 0 {
+		return nil, pr.regexNotSetError()
+	}
+
+	mod, err := modulePool.TryGet()
+	if err != nil {
+		return nil, err
+	}
+	return pr.clone(ctx, mod, modulePool.Put)
+}
+
+// clone creates a copy of the regex that operates on the given module, as described in Clone. The release function is
+// called with the module once the clone has been closed.
+func (pr *privateRegex) clone(ctx context.Context, mod api.Module, release func(api.Module)) (*privateRegex, error) {
+	clone := newPrivateRegex(mod, pr.bufferSize, release, pr.opts)
+	if err := clone.setEncodedRegex(ctx, pr.regexStrUTF16, pr.regexFlags); err != nil {
+		// The error from setEncodedRegex takes precedence, as closing should only fail if something is very wrong
+		_ = clone.Close()
+		return nil, err
+	}
+	// These are never modified, so the clone may share them
+	clone.regexStr = pr.regexStr
+	clone.regexStrUTF16 = pr.regexStrUTF16
+	clone.regexFlags = pr.regexFlags
+	clone.groups = pr.groups
+	clone.startAnchored = pr.startAnchored
+	return clone, nil
+}
+
+// AsStdlib implements the interface Regex.
+func (pr *privateRegex) AsStdlib(ctx context.Context) StdlibCompat {
+	return StdlibCompat{regex: pr, ctx: ctx}
+}
+
+// StringBufferSize implements the interface Regex.
+func (pr *privateRegex) StringBufferSize() uint32 {
+	return pr.bufferSize
+}
+
+// Close implements the interface Regex.
+func (pr *privateRegex) Close() (err error) {
+	if pr == nil || pr.mod == nil {
+		return nil
+	}
+	// A module that has stopped (such as from running out of memory) cannot free anything, nor does it need to
+	if pr.mod.IsClosed() {
+		pr.release(pr.mod)
+		pr.mod = nil
+		pr.closed = true
+		runtime.SetFinalizer(pr, nil)
+		return nil
+	}
+	err = pr.closeRegexPtrs()
+	if nErr := pr.closeMatchPtr(); err == nil {
+		err = nErr
+	}
+	// As we do not free the buffers in the other close functions (since they may be called without intending to close
+	// the regex as a whole), we take care of freeing them here.
+	ctx := context.Background()
+	if pr.bufferSize > 0 {
+		if nErr := pr.free(ctx, uint32(pr.regexStrBuffer)); err == nil {
+			err = nErr
+		}
+		if nErr := pr.free(ctx, uint32(pr.matchStrBuffer)); err == nil {
+			err = nErr
+		}
+	}
+	if nErr := pr.releaseBuffer(ctx, &pr.replacementStrBuffer); err == nil {
+		err = nErr
+	}
+	if nErr := pr.releaseBuffer(ctx, &pr.replaceDestBuffer); err == nil {
+		err = nErr
+	}
+	if nErr := pr.releaseBuffer(ctx, &pr.flagVariantText); err == nil {
+		err = nErr
+	}
+	if pr.mod != nil {
+		pr.release(pr.mod)
+		pr.mod = nil
+		pr.closed = true
+		runtime.SetFinalizer(pr, nil)
+	}
+	return err
+}
+
+// compile creates a URegularExpression* from the given regex string, which must already be in WASM memory. Invalid
+// regexes return ErrInvalidRegex, which wraps a *ParseError.
+func (pr *privateRegex) compile(ctx context.Context, regexStrUPtr UCharPtr, regexStrULen int, flags RegexFlags) (URegularExpressionPtr, error) {
+	errorCode := UErrorCode(0)
+	var parseError ParseError
+	regex, err := pr.uregex_open(ctx, regexStrUPtr, regexStrULen, uint32(flags), &parseError, &errorCode)
+	if err != nil {
+		return 0, err
+	}
+	if errorCode == U_MEMORY_ALLOCATION_ERROR {
+		return 0, newUErrorCodeError("uregex_open", errorCode)
+	}
+	if errorCode.IsFailure() {
+		parseError.Code = errorCode
+		return 0, ErrInvalidRegex.Wrap(&parseError)
+	}
+	return regex, nil
+}
+
+// tryPattern compiles the given pattern separately from the regex, and returns the bounds of its first match within the
+// current region of the match string. If the pattern is invalid, then it is treated as not matching.
+func (pr *privateRegex) tryPattern(ctx context.Context, pattern string, flags RegexFlags) (bounds MatchBounds, ok bool, err error) {
+	utf16Pattern, patternULen := toUTF16(pattern)
+	if patternULen == 0 {
+		return MatchBounds{}, false, nil
+	}
+	patternUPtr, err := pr.mallocChecked(ctx, uint32(len(utf16Pattern)))
+	if err != nil {
+		return MatchBounds{}, false, err
+	}
+	defer func() {
+		if fErr := pr.free(ctx, patternUPtr); err == nil {
+			err = fErr
+		}
+	}()
+	pr.mod.Memory().Write(patternUPtr, utf16Pattern)
+	regex, err := pr.compile(ctx, UCharPtr(patternUPtr), patternULen, flags)
+	if err != nil {
+		if ErrInvalidRegex.Is(err) {
+			return MatchBounds{}, false, nil
+		}
+		return MatchBounds{}, false, err
+	}
+	defer func() {
+		if cErr := pr.uregex_close(ctx, regex); err == nil {
+			err = cErr
+		}
+	}()
+
+	var errorCode UErrorCode
+	err = pr.uregex_setText(ctx, regex, pr.matchStrUPtr+UCharPtr(pr.regionStart*2), pr.regionEnd-pr.regionStart, &errorCode)
+	if err != nil {
+		return MatchBounds{}, false, err
+	}
+	ok, err = pr.uregex_find(ctx, regex, 0, &errorCode)
+	if err != nil || !ok {
+		return MatchBounds{}, false, err
+	}
+	start, err := pr.uregex_start(ctx, regex, 0, &errorCode)
+	if err != nil {
+		return MatchBounds{}, false, err
+	}
+	end, err := pr.uregex_end(ctx, regex, 0, &errorCode)
+	if err != nil {
+		return MatchBounds{}, false, err
+	}
+	if errorCode.IsFailure() {
+		return MatchBounds{}, false, newUErrorCodeError("uregex_setText/uregex_find/uregex_start/uregex_end", errorCode)
+	}
+	return MatchBounds{Start: int(start) + pr.regionStart + 1, End: int(end) + pr.regionStart + 1}, true, nil
+}
+
+// reusableBuffer is a region of WASM memory that is reused across calls, rather than being allocated and freed for
+// every call. It only grows, and is freed once the regex is closed.
+type reusableBuffer struct {
+	ptr  uint32
+	size uint32
+}
+
+// reserve returns the location of the given buffer, ensuring that it's at least the given size (in bytes). Growing the
+// buffer does not preserve its contents. To reduce the number of reallocations as sizes increase, the buffer grows by
+// at least the growth factor (which defaults to doubling) whenever it grows.
+func (pr *privateRegex) reserve(ctx context.Context, buf *reusableBuffer, size uint32) (uint32, error) {
+	if buf.ptr != 0 && size <= buf.size {
+		return buf.ptr, nil
+	}
+	newSize := max(size, uint32(min(float64(buf.size)*pr.bufferGrowthFactor, math.MaxUint32)), 2)
+	if err := pr.releaseBuffer(ctx, buf); err != nil {
+		return 0, err
+	}
+	ptr, err := pr.mallocChecked(ctx, newSize)
+	if err != nil {
+		return 0, err
+	}
+	buf.ptr = ptr
+	buf.size = newSize
+	return ptr, nil
+}
+
+// releaseBuffer frees the given buffer if it has been allocated.
+func (pr *privateRegex) releaseBuffer(ctx context.Context, buf *reusableBuffer) error {
+	if buf.ptr == 0 {
+		return nil
+	}
+	err := pr.free(ctx, buf.ptr)
+	buf.ptr = 0
+	buf.size = 0
+	return err
+}
+
+// writeString copies the given UTF16LE string to WASM memory, and returns its location. If the string fits within the
+// given string buffer, then the buffer is used. Otherwise, memory is allocated for the string, which must be freed
+// later. The returned location is never null, even for empty strings, as ICU rejects null strings, and a null location
+// is how we track strings that have not been set.
+func (pr *privateRegex) writeString(ctx context.Context, buffer UCharPtr, utf16Str []byte) (UCharPtr, error) {
+	if pr.bufferSize > 0 && uint32(len(utf16Str)) <= pr.bufferSize {
+		pr.mod.Memory().Write(uint32(buffer), utf16Str)
+		return buffer, nil
+	}
+	ptr, err := pr.mallocChecked(ctx, max(uint32(len(utf16Str)), 2))
+	if err != nil {
+		return 0, err
+	}
+	pr.mod.Memory().Write(ptr, utf16Str)
+	return UCharPtr(ptr), nil
+}
+
+// closeRegexPtr closes the regex pointers if they exist. This will not free the string buffer if it is being used.
+func (pr *privateRegex) closeRegexPtrs() (err error) {
+	ctx := context.Background()
+	if pr.regexPtr != 0 {
+		err = pr.uregex_close(ctx, pr.regexPtr)
+	}
+	for _, variantPtr := range pr.flagVariants {
+		if closeErr := pr.uregex_close(ctx, variantPtr); err == nil {
+			err = closeErr
+		}
+	}
+	if pr.regexStrUPtr != pr.regexStrBuffer && pr.regexStrUPtr != 0 {
+		if freeErr := pr.free(ctx, uint32(pr.regexStrUPtr)); err == nil {
+			err = freeErr
+		}
+	}
+	pr.regexPtr = 0
+	pr.regexStrUPtr = 0
+	pr.regexStr = ""
+	pr.regexStrUTF16 = nil
+	pr.regexFlags = RegexFlags_None
+	pr.groups = nil
+	pr.startAnchored = false
+	pr.flagVariants = nil
+	return err
+}
+
+// closeMatchPtr closes the match string pointer if it exists. This will not free the string buffer if it is being used.
+func (pr *privateRegex) closeMatchPtr() (err error) {
+	if pr.matchStrUPtr != pr.matchStrBuffer && pr.matchStrUPtr != 0 {
+		err = pr.free(context.Background(), uint32(pr.matchStrUPtr))
+	}
+	pr.matchStrUPtr = 0
+	pr.matchStrUPtrLen = 0
+	pr.matchStrVersion++
+	pr.regionStart = 0
+	pr.regionEnd = 0
+	pr.scanEnd = 0
+	return err
+}
+
+// appendReplacements replaces the given occurrence of the regex (or every match when the occurrence is zero) with the
+// replacement string, which must already be in WASM memory. The search begins at the given zero-based index. This
+// builds the result using ICU's uregex_appendReplacement and uregex_appendTail, and returns the result along with the
+// bounds of every replaced match within the original match string. If there are no matches, then the original match
+// string is returned.
+func (pr *privateRegex) appendReplacements(ctx context.Context, replacementStrUPtr UCharPtr, replacementStrULen int, startIdx int, occurrence int) (result string, originalSpans []MatchBounds, err error) {
+	// We make an initial guess at the size of the result. If it is too small, then ICU continues as though it were
+	// only determining the size (preflighting), so we'll know the exact size needed for a second attempt. The buffer is
+	// reused across calls, so we make use of its entire capacity when it's already larger than our guess.
+	destCapacity := pr.matchStrUPtrLen + replacementStrULen + 16
+	for attempt := 0; attempt < 2; attempt++ {
+		destBuf, err := pr.reserve(ctx, &pr.replaceDestBuffer, uint32(destCapacity*2))
+		if err != nil {
+			return "", nil, err
+		}
+		destCapacity = int(pr.replaceDestBuffer.size / 2)
+		result, originalSpans, requiredCapacity, err := pr.appendReplacementsToBuffer(ctx, replacementStrUPtr, replacementStrULen, startIdx, occurrence, UCharPtr(destBuf), destCapacity)
+		if err != nil || requiredCapacity <= destCapacity {
+			return result, originalSpans, err
+		}
+		destCapacity = requiredCapacity
+	}
+	return "", nil, fmt.Errorf("the replacement result did not fit within the buffer after resizing")
+}
+
+// invalidReplacementError is returned by appendReplacements when ICU rejects the replacement string while appending,
+// as it references a group that does not exist. The remainder is the text surrounding the replaced portion of the
+// match string, which is the result when the replacement is dropped rather than reported.
+type invalidReplacementError struct {
+	err       error
+	remainder string
+}
+
+var _ error = (*invalidReplacementError)(nil)
+
+// Error implements the interface error.
+func (err *invalidReplacementError) Error() string {
+	return err.err.Error()
+}
+
+// appendReplacementsToBuffer performs a single attempt of appendReplacements, writing the result into the given
+// buffer. If the buffer is too small, then the returned capacity is larger than the given capacity, and the result is
+// incomplete.
+func (pr *privateRegex) appendReplacementsToBuffer(ctx context.Context, replacementStrUPtr UCharPtr, replacementStrULen int, startIdx int, occurrence int, destBuf UCharPtr, destCapacity int) (result string, originalSpans []MatchBounds, requiredCapacity int, err error) {
+	// ICU begins appending text from the start index, or from the end of the previous match when skipping occurrences,
+	// so we need to add everything before that ourselves.
+	headEnd := max(startIdx, pr.regionStart)
+	found, err := pr.findOccurrence(ctx, startIdx, 1)
+	for i := 1; i < occurrence && found; i++ {
+		if _, headEnd, err = pr.groupBounds(ctx, 0); err != nil {
+			return "", nil, 0, err
+		}
+		found, err = pr.findNext(ctx)
+	}
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if !found {
+		result, err = pr.matchStrSlice(0, pr.matchStrUPtrLen)
+		return result, nil, 0, err
+	}
+
+	// The status is shared between the appending functions, as it lets ICU know to continue preflighting once the
+	// buffer has overflowed. Searching for matches uses its own status, since those fail when given an overflow.
+	var errorCode UErrorCode
+	destPtr := destBuf
+	remainingCapacity := destCapacity
+	for found {
+		matchStart, matchEnd, err := pr.groupBounds(ctx, 0)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		originalSpans = append(originalSpans, MatchBounds{Start: matchStart + 1, End: matchEnd + 1})
+		appendedLen, err := pr.uregex_appendReplacement(ctx, pr.regexPtr, replacementStrUPtr, replacementStrULen, &destPtr, &remainingCapacity, &errorCode)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if errorCode.IsFailure() && errorCode != U_BUFFER_OVERFLOW_ERROR {
+			err = newUErrorCodeError("uregex_appendReplacement", errorCode)
+			if errorCode == U_MEMORY_ALLOCATION_ERROR {
+				return "", nil, 0, err
+			}
+			// The replacement string references a group that does not exist
+			head, hErr := pr.matchStrSlice(0, headEnd)
+			if hErr != nil {
+				return "", nil, 0, hErr
+			}
+			tail, tErr := pr.matchStrSlice(pr.scanEnd, pr.matchStrUPtrLen)
+			if tErr != nil {
+				return "", nil, 0, tErr
+			}
+			return "", nil, 0, &invalidReplacementError{err: err, remainder: head + tail}
+		}
+		requiredCapacity += appendedLen
+		if occurrence != 0 {
+			break
+		}
+		if found, err = pr.findNext(ctx); err != nil {
+			return "", nil, 0, err
+		}
+	}
+	appendedLen, err := pr.uregex_appendTail(ctx, pr.regexPtr, &destPtr, &remainingCapacity, &errorCode)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if errorCode.IsFailure() && errorCode != U_BUFFER_OVERFLOW_ERROR {
+		return "", nil, 0, newUErrorCodeError("uregex_appendTail", errorCode)
+	}
+	requiredCapacity += appendedLen
+	if requiredCapacity > destCapacity {
+		return "", nil, requiredCapacity, nil
+	}
+
+	// ICU stops appending at the end of the text that it was given, which is the end of the region unless the scan is
+	// limited, so we also need to add everything after it ourselves
+	head, err := pr.matchStrSlice(0, headEnd)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	tail, err := pr.matchStrSlice(pr.scanEnd, pr.matchStrUPtrLen)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	resultBytes, ok := pr.mod.Memory().Read(uint32(destBuf), uint32(requiredCapacity*2))
+	if !ok {
+		return "", nil, 0, fmt.Errorf("somehow failed when retrieving the string with replacements")
+	}
+	return head + fromUTF16(resultBytes) + tail, originalSpans, requiredCapacity, nil
+}
+
+// mallocChecked is the same as malloc, except that it returns ErrOutOfMemory when the allocation fails.
+func (pr *privateRegex) mallocChecked(ctx context.Context, sz uint32) (uint32, error) {
+	ptr, err := pr.malloc(ctx, sz)
+	if err != nil {
+		return 0, err
+	}
+	if ptr == 0 && sz > 0 {
+		return 0, ErrOutOfMemory.New()
+	}
+	return ptr, nil
+}
+
+// findOccurrence searches for the given occurrence of the regex, starting at the given index. The index is the
+// zero-based code unit offset that ICU expects. An occurrence of zero is treated the same as an occurrence of one.
+func (pr *privateRegex) findOccurrence(ctx context.Context, startIdx int, occurrence int) (ok bool, err error) {
+	// Searches that begin after the region can never match
+	if startIdx > pr.regionEnd && startIdx <= pr.matchStrUPtrLen {
+		return false, nil
+	}
+	if err = pr.limitScan(ctx, startIdx); err != nil {
+		return false, err
+	}
+	var errorCode UErrorCode
+	ok, err = pr.uregex_find(ctx, pr.regexPtr, pr.regionOffset(startIdx), &errorCode)
+	if err != nil {
+		return false, err
+	}
+	for i := 1; i < occurrence && ok; i++ {
+		ok, err = pr.uregex_findNext(ctx, pr.regexPtr, &errorCode)
+		if err != nil {
+			return false, err
+		}
+	}
+	if errorCode.IsFailure() {
+		return false, newUErrorCodeError("uregex_find/uregex_findNext", errorCode)
+	}
+	return ok, nil
+}
+
+// findNext searches for the next match of the regex, continuing from the end of the previous match.
+func (pr *privateRegex) findNext(ctx context.Context) (ok bool, err error) {
+	var errorCode UErrorCode
+	ok, err = pr.uregex_findNext(ctx, pr.regexPtr, &errorCode)
+	if err != nil {
+		return false, err
+	}
+	if errorCode.IsFailure() {
+		return false, newUErrorCodeError("uregex_findNext", errorCode)
+	}
+	return ok, nil
+}
+
+// lookingAt returns whether the regex matches the match string beginning exactly at the given index. The start index
+// and the returned end offset are zero-based, and the end offset is exclusive. ICU's uregex_lookingAt is not exported
+// from the module, so this instead searches from the index and checks where the first match begins. As matches are
+// attempted at each position in order, a match beginning at the index will always be the first one found.
+func (pr *privateRegex) lookingAt(ctx context.Context, startIdx int) (matchEnd int, ok bool, err error) {
+	matchStart, matchEnd, ok, err := pr.substringBounds(ctx, startIdx, 1)
+	if err != nil || !ok || matchStart != startIdx {
+		return 0, false, err
+	}
+	return matchEnd, true, nil
+}
+
+// substringBounds finds the given occurrence of the regex, and returns the code unit offsets of the match within the
+// match string. The start index and the returned offsets are zero-based, and the end offset is exclusive.
+func (pr *privateRegex) substringBounds(ctx context.Context, startIdx int, occurrence int) (matchStart int, matchEnd int, ok bool, err error) {
+	ok, err = pr.findOccurrence(ctx, startIdx, occurrence)
+	if err != nil || !ok {
+		return 0, 0, false, err
+	}
+	matchStart, matchEnd, err = pr.groupBounds(ctx, 0)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return matchStart, matchEnd, true, nil
+}
+
+// groupBounds returns the code unit offsets of the given group from the most recent match. The offsets are zero-based,
+// and the end offset is exclusive. If the group did not participate in the match, then both offsets will be -1.
+func (pr *privateRegex) groupBounds(ctx context.Context, group int) (groupStart int, groupEnd int, err error) {
+	var errorCode UErrorCode
+	start, err := pr.uregex_start(ctx, pr.regexPtr, group, &errorCode)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := pr.uregex_end(ctx, pr.regexPtr, group, &errorCode)
+	if err != nil {
+		return 0, 0, err
+	}
+	if errorCode == U_INDEX_OUTOFBOUNDS_ERROR {
+		return 0, 0, ErrInvalidGroup.New(group)
+	}
+	if errorCode.IsFailure() {
+		return 0, 0, newUErrorCodeError("uregex_start/uregex_end", errorCode)
+	}
+	// ICU's offsets are relative to the region, as that is the only text that it sees
+	if start >= 0 {
+		start += int32(pr.regionStart)
+	}
+	if end >= 0 {
+		end += int32(pr.regionStart)
+	}
+	return int(start), int(end), nil
+}
+
+// setRegion limits matching to the region between the given code unit offsets. The offsets are zero-based, and the
+// end offset is exclusive. ICU's uregex_setRegion is not exported from the module, so instead the region is given to
+// ICU as the entire text. Since ICU does not copy the text, this does not copy the region either. This matches ICU's
+// default behavior of opaque and anchoring bounds, where lookaround cannot see outside of the region, and the region's
+// boundaries match anchors.
+func (pr *privateRegex) setRegion(ctx context.Context, startIdx int, endIdx int) error {
+	errorCode := UErrorCode(0)
+	err := pr.uregex_setText(ctx, pr.regexPtr, pr.matchStrUPtr+UCharPtr(startIdx*2), endIdx-startIdx, &errorCode)
+	if err != nil {
+		return err
+	}
+	if errorCode.IsFailure() {
+		return newUErrorCodeError("uregex_setText", errorCode)
+	}
+	pr.regionStart = startIdx
+	pr.regionEnd = endIdx
+	pr.scanEnd = endIdx
+	return nil
+}
+
+// scanLimit returns the zero-based, exclusive end of the text that a search beginning at the given index may scan,
+// which is the end of the region unless a shorter limit has been set with SetMaxScanLength.
+func (pr *privateRegex) scanLimit(startIdx int) int {
+	if pr.maxScanLength <= 0 {
+		return pr.regionEnd
+	}
+	return min(pr.regionEnd, max(startIdx, pr.regionStart)+pr.maxScanLength)
+}
+
+// limitScan gives ICU the text that a search beginning at the given index may scan. The text only changes when the
+// limit does, as setting the text also resets ICU's match state.
+func (pr *privateRegex) limitScan(ctx context.Context, startIdx int) error {
+	scanEnd := pr.scanLimit(startIdx)
+	if scanEnd == pr.scanEnd {
+		return nil
+	}
+	errorCode := UErrorCode(0)
+	err := pr.uregex_setText(ctx, pr.regexPtr, pr.matchStrUPtr+UCharPtr(pr.regionStart*2), scanEnd-pr.regionStart, &errorCode)
+	if err != nil {
+		return err
+	}
+	if errorCode.IsFailure() {
+		return newUErrorCodeError("uregex_setText", errorCode)
+	}
+	pr.scanEnd = scanEnd
+	return nil
+}
+
+// regionOffset converts a zero-based code unit offset within the match string to one that is relative to the region.
+// Offsets before the region are moved to the beginning of the region.
+func (pr *privateRegex) regionOffset(idx int) int {
+	if idx < pr.regionStart {
+		return 0
+	}
+	return idx - pr.regionStart
+}
+
+// matchStrSlice returns the portion of the match string that is between the given code unit offsets. The offsets are
+// zero-based, and the end offset is exclusive.
+func (pr *privateRegex) matchStrSlice(startIdx int, endIdx int) (string, error) {
+	if endIdx <= startIdx {
+		return "", nil
+	}
+	strBytes, ok := pr.mod.Memory().Read(uint32(pr.matchStrUPtr)+uint32(startIdx*2), uint32((endIdx-startIdx)*2))
+	if !ok {
+		return "", fmt.Errorf("somehow failed when retrieving a portion of the match string")
+	}
+	return fromUTF16(strBytes), nil
+}
+
+// incompleteSuffixLen returns the number of bytes at the end of the given UTF-8 text that begin a character, but do not
+// complete it.
+func incompleteSuffixLen(text []byte) int {
+	for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(text[i]) {
+			if utf8.FullRune(text[i:]) {
+				return 0
+			}
+			return len(text) - i
+		}
+	}
+	return 0
+}
+
+// toUTF16 returns a byte slice that contains the given string converted to UTF16LE, which is required for use with the
+// ICU library. The length returned is the length that should be passed to ICU functions.
+func toUTF16(str string) (convertedString []byte, length int) {
+	// ICU complains about the lack of NULL-termination, but it works anyway. Adding NULL at the end seems to
+	// prevent some matches (both a single NULL and two NULLs since it's a char16_t array). We just ignore the warning.
+	utf16Raw := utf16.Encode([]rune(str))
+	length = len(utf16Raw)
+	convertedString = make([]byte, length*2)
+	for i := 0; i < length; i++ {
+		convertedString[2*i] = byte(utf16Raw[i])
+		convertedString[(2*i)+1] = byte(utf16Raw[i] >> 8)
+	}
+	return
+}
+
+// fromNullTerminatedUTF16 is the same as fromUTF16, except that the string ends at the first NULL character.
+func fromNullTerminatedUTF16(convertedString []byte) string {
+	for i := 0; i+1 < len(convertedString); i += 2 {
+		if convertedString[i] == 0 && convertedString[i+1] == 0 {
+			return fromUTF16(convertedString[:i])
+		}
+	}
+	return fromUTF16(convertedString)
 }
 
 // fromUTF16 returns a string from a byte slice that contains a string in the UTF16LE format, which is how strings will
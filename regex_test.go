@@ -16,9 +16,15 @@ package regex
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/wazero/api"
+	"gopkg.in/src-d/go-errors.v1"
 )
 
 func TestRegexMatch(t *testing.T) {
@@ -97,3 +103,1914 @@ func TestRegexReplace(t *testing.T) {
 	require.Equal(t, "X X X", replacedStr)
 	require.NoError(t, regex.Close())
 }
+
+func TestRegexReplaceReferences(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer func() {
+		require.NoError(t, regex.Close())
+	}()
+
+	require.NoError(t, regex.SetRegexString(ctx, `\d`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a1b2c3"))
+	replacedStr, err := regex.Replace(ctx, "[$0]", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "a[1]b[2]c[3]", replacedStr)
+	replacedStr, err = regex.Replace(ctx, "[$0]", 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, "a1b[2]c3", replacedStr)
+	replacedStr, _, err = regex.ReplaceAllString(ctx, "[$0]")
+	require.NoError(t, err)
+	require.Equal(t, "a[1]b[2]c[3]", replacedStr)
+	replacedStr, _, err = regex.ReplaceAllWithSpans(ctx, "[$0]")
+	require.NoError(t, err)
+	require.Equal(t, "a[1]b[2]c[3]", replacedStr)
+
+	// Every kind of reference must behave the same whether every match or a single occurrence is replaced
+	require.NoError(t, regex.SetRegexString(ctx, `(?<key>[a-z]+)=(\d+)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "x=1, yy=22"))
+	tests := []struct {
+		replacement string
+		all         string
+		second      string
+	}{
+		{"$0", "x=1, yy=22", "x=1, yy=22"},
+		{"<$0>", "<x=1>, <yy=22>", "x=1, <yy=22>"},
+		{"$2=$1", "1=x, 22=yy", "x=1, 22=yy"},
+		{"${key}", "x, yy", "x=1, yy"},
+		{"${key}:$2:$0", "x:1:x=1, yy:22:yy=22", "x=1, yy:22:yy=22"},
+		{`\$0`, "$0, $0", "x=1, $0"},
+		{`\\$1`, `\x, \yy`, `x=1, \yy`},
+		// A digit following a reference is only part of it while the group exists
+		{"$10", "x0, yy0", "x=1, yy0"},
+	}
+	for _, test := range tests {
+		t.Run(test.replacement, func(t *testing.T) {
+			replacedStr, err := regex.Replace(ctx, test.replacement, 1, 0)
+			require.NoError(t, err)
+			require.Equal(t, test.all, replacedStr)
+			replacedStr, _, err = regex.ReplaceAllString(ctx, test.replacement)
+			require.NoError(t, err)
+			require.Equal(t, test.all, replacedStr)
+			replacedStr, err = regex.Replace(ctx, test.replacement, 1, 2)
+			require.NoError(t, err)
+			require.Equal(t, test.second, replacedStr)
+		})
+	}
+}
+
+func TestRegexReplaceStart(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `[a-z]+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "abc def ghi"))
+	tests := []struct {
+		start      int
+		occurrence int
+		expected   string
+	}{
+		// The first match is before the start, so it must be left untouched
+		{5, 0, "abc X X"},
+		{5, 1, "abc X ghi"},
+		{5, 2, "abc def X"},
+		{5, 3, "abc def ghi"},
+		// Starting within a word only matches the remainder of the word
+		{6, 0, "abc dX X"},
+		{4, 0, "abc X X"},
+		{11, 0, "abc def ghX"},
+		// Starting immediately after the end leaves nothing to replace
+		{12, 0, "abc def ghi"},
+		// Positions before the beginning are treated as the beginning
+		{1, 0, "X X X"},
+		{0, 0, "X X X"},
+		{-3, 1, "X def ghi"},
+	}
+	for _, test := range tests {
+		replacedStr, err := regex.Replace(ctx, "X", test.start, test.occurrence)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, replacedStr, "start %d occurrence %d", test.start, test.occurrence)
+	}
+
+	// Positions past the end of the match string are out of bounds
+	_, err := regex.Replace(ctx, "X", 13, 0)
+	var uErr *UErrorCodeError
+	require.ErrorAs(t, err, &uErr)
+	require.Equal(t, U_INDEX_OUTOFBOUNDS_ERROR, uErr.Code)
+
+	// A position before the beginning must not continue from the previous match
+	require.NoError(t, regex.SetMatchString(ctx, "abc def ghi"))
+	ok, err := regex.Matches(ctx, 4, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	replacedStr, err := regex.Replace(ctx, "X", 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, "X def ghi", replacedStr)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexPartition(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `=`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "key=value"))
+	before, match, after, ok, err := regex.Partition(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "key", before)
+	require.Equal(t, "=", match)
+	require.Equal(t, "value", after)
+	_, _, _, ok, err = regex.Partition(ctx, 5, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, regex.SetRegexString(ctx, `\d+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "ä1bb22ccc333"))
+	before, match, after, ok, err = regex.Partition(ctx, 1, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "ä1bb", before)
+	require.Equal(t, "22", match)
+	require.Equal(t, "ccc333", after)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexAllGroup(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `(\w+):(\d+)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a:1, bb:22, ccc:333"))
+	results, err := regex.AllGroup(ctx, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "22", "333"}, results)
+	results, err = regex.AllGroup(ctx, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "bb"}, results)
+	_, err = regex.AllGroup(ctx, 3, 0)
+	require.True(t, ErrInvalidGroup.Is(err))
+
+	require.NoError(t, regex.SetRegexString(ctx, `(a)?b`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "ab b ab"))
+	results, err = regex.AllGroup(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "", "a"}, results)
+	results, err = regex.AllGroupParticipating(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "a"}, results)
+	require.NoError(t, regex.SetMatchString(ctx, "nothing here"))
+	results, err = regex.AllGroup(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Empty(t, results)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexRefreshText(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	pr := regex.(*privateRegex)
+	require.NoError(t, regex.SetRegexString(ctx, `\d`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "1a2b3c"))
+	ok, err := pr.findOccurrence(ctx, 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The match position should carry over to the refreshed text
+	require.NoError(t, regex.RefreshText(ctx, "1a9b8c"))
+	ok, err = pr.findNext(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	matchStart, matchEnd, err := pr.groupBounds(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, matchStart)
+	match, err := pr.matchStrSlice(matchStart, matchEnd)
+	require.NoError(t, err)
+	require.Equal(t, "9", match)
+	ok, err = pr.findNext(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	matchStart, matchEnd, err = pr.groupBounds(ctx, 0)
+	require.NoError(t, err)
+	match, err = pr.matchStrSlice(matchStart, matchEnd)
+	require.NoError(t, err)
+	require.Equal(t, "8", match)
+
+	err = regex.RefreshText(ctx, "1a9b8")
+	require.True(t, ErrTextLengthMismatch.Is(err))
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexGroupIndexAcrossMatches(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `(a)?(b)`, RegexFlags_None))
+	// Group 1 only participates in the second and fourth matches
+	require.NoError(t, regex.SetMatchString(ctx, "b ab b ab"))
+	idx, err := regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 1, 1, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, idx)
+	idx, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 1, 1, true)
+	require.NoError(t, err)
+	require.Equal(t, 4, idx)
+	idx, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 1, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, 8, idx)
+	idx, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 1, 3, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, idx)
+	// Group 2 participates in every match
+	idx, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 2, 3, false)
+	require.NoError(t, err)
+	require.Equal(t, 6, idx)
+	_, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 3, 1, false)
+	require.True(t, ErrInvalidGroup.Is(err))
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexUnicodeWordBoundaries(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	// ICU's break iterator data is not included in the module, so Unicode word boundaries cannot be evaluated
+	require.NoError(t, regex.SetRegexString(ctx, `\bcafé\b`, RegexFlags_Unicode_Word))
+	require.NoError(t, regex.SetMatchString(ctx, "un café noir"))
+	_, err := regex.Matches(ctx, 0, 0)
+	require.Error(t, err)
+	uErr, ok := err.(*UErrorCodeError)
+	require.True(t, ok)
+	require.Equal(t, U_MISSING_RESOURCE_ERROR, uErr.Code)
+	// The flag does not affect patterns that do not use \b
+	require.NoError(t, regex.SetRegexString(ctx, `café`, RegexFlags_Unicode_Word))
+	require.NoError(t, regex.SetMatchString(ctx, "un café noir"))
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The documented workaround uses lookaround with Unicode properties in place of \b
+	require.NoError(t, regex.SetRegexString(ctx, `(?<![\p{L}\p{M}\p{N}_])café(?![\p{L}\p{M}\p{N}_])`, RegexFlags_None))
+	for input, expected := range map[string]bool{"un café noir": true, "le café": true, "cafés": false, "écafé": false} {
+		require.NoError(t, regex.SetMatchString(ctx, input))
+		ok, err = regex.Matches(ctx, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, ok, input)
+	}
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexFindAllString(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `\d`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a1b2c3"))
+	results, err := regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, results)
+	results, err = regex.FindAllString(ctx, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "3"}, results)
+	results, err = regex.FindAllString(ctx, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, results)
+
+	// Empty matches occur at every position, including the end of the string
+	require.NoError(t, regex.SetRegexString(ctx, `x*`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "axxb"))
+	results, err = regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"", "xx", "", ""}, results)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexFindAllRuneBounds(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+	require.NoError(t, regex.SetRegexString(ctx, `[a-z]+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "😀a😀bb🎉c"))
+	results, err := regex.FindAllRuneBounds(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []MatchBounds{{Start: 2, End: 3}, {Start: 4, End: 6}, {Start: 7, End: 8}}, results)
+
+	// The astral characters each take two code units, so the code unit bounds differ
+	_, spans, err := regex.ReplaceAllWithSpans(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []MatchBounds{{Start: 3, End: 4}, {Start: 6, End: 8}, {Start: 10, End: 11}}, spans)
+
+	// The start position is in runes as well
+	results, err = regex.FindAllRuneBounds(ctx, 4, 0)
+	require.NoError(t, err)
+	require.Equal(t, []MatchBounds{{Start: 4, End: 6}, {Start: 7, End: 8}}, results)
+	results, err = regex.FindAllRuneBounds(ctx, 5, 1)
+	require.NoError(t, err)
+	require.Equal(t, []MatchBounds{{Start: 5, End: 6}}, results)
+	results, err = regex.FindAllRuneBounds(ctx, 8, 0)
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+func TestRegexReplaceAllWithSpans(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `\d+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a12b345"))
+	result, spans, err := regex.ReplaceAllWithSpans(ctx, "#")
+	require.NoError(t, err)
+	require.Equal(t, "a#b#", result)
+	require.Equal(t, []MatchBounds{{Start: 2, End: 4}, {Start: 5, End: 8}}, spans)
+	// The result is much larger than the original, which forces the result buffer to be resized
+	result, spans, err = regex.ReplaceAllWithSpans(ctx, "<$0 is a number with many characters>")
+	require.NoError(t, err)
+	require.Equal(t, "a<12 is a number with many characters>b<345 is a number with many characters>", result)
+	require.Len(t, spans, 2)
+
+	require.NoError(t, regex.SetMatchString(ctx, "no digits"))
+	result, spans, err = regex.ReplaceAllWithSpans(ctx, "#")
+	require.NoError(t, err)
+	require.Equal(t, "no digits", result)
+	require.Empty(t, spans)
+
+	// Empty matches are replaced at every position
+	require.NoError(t, regex.SetRegexString(ctx, `x*`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "axb"))
+	result, spans, err = regex.ReplaceAllWithSpans(ctx, "-")
+	require.NoError(t, err)
+	require.Equal(t, "-a--b-", result)
+	require.Equal(t, []MatchBounds{{Start: 1, End: 1}, {Start: 2, End: 3}, {Start: 3, End: 3}, {Start: 4, End: 4}}, spans)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexIsStartAnchored(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	_, err := regex.IsStartAnchored(ctx)
+	require.True(t, ErrRegexNotYetSet.Is(err))
+	tests := []struct {
+		pattern  string
+		flags    RegexFlags
+		anchored bool
+	}{
+		{`^abc`, RegexFlags_None, true},
+		{`\Aabc`, RegexFlags_None, true},
+		{`(?i)^abc`, RegexFlags_None, true},
+		{`^(a|b)[|]\|c`, RegexFlags_None, true},
+		{`^a\Q|\Eb`, RegexFlags_None, true},
+		{`\Aabc`, RegexFlags_Multiline, true},
+		{`^abc`, RegexFlags_Multiline, false},
+		{`(?m)^abc`, RegexFlags_None, false},
+		{`(?m-m)^abc`, RegexFlags_None, true},
+		{`^abc`, RegexFlags_Literal, false},
+		{`^a|b`, RegexFlags_None, false},
+		{`abc`, RegexFlags_None, false},
+		{`a^bc`, RegexFlags_None, false},
+		// ICU accepts quantified anchors, which may then match anywhere
+		{`^?abc`, RegexFlags_None, false},
+		{`^*abc`, RegexFlags_None, false},
+		{`^{0}abc`, RegexFlags_None, false},
+		{`(?x)^a #(
+			|b`, RegexFlags_None, false},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			require.NoError(t, regex.SetRegexString(ctx, test.pattern, test.flags))
+			anchored, err := regex.IsStartAnchored(ctx)
+			require.NoError(t, err)
+			require.Equal(t, test.anchored, anchored)
+		})
+	}
+
+	// The short-circuit must agree with a full search
+	pr := regex.(*privateRegex)
+	for _, pattern := range []string{`^abc`, `\Aabc`, `^`, `^?abc`, `^*abc`, `^{0}abc`} {
+		require.NoError(t, regex.SetRegexString(ctx, pattern, RegexFlags_None))
+		require.NoError(t, regex.SetMatchString(ctx, "abcabc"))
+		for start := 0; start < 3; start++ {
+			for occurrence := 0; occurrence < 3; occurrence++ {
+				expected, err := pr.findOccurrence(ctx, start, occurrence)
+				require.NoError(t, err)
+				ok, err := regex.Matches(ctx, start, occurrence)
+				require.NoError(t, err)
+				require.Equal(t, expected, ok, "%s start %d occurrence %d", pattern, start, occurrence)
+			}
+		}
+	}
+
+	// A quantified anchor must still find later matches
+	require.NoError(t, regex.SetRegexString(ctx, `^?a`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a a a"))
+	ok, err := regex.Matches(ctx, 0, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = regex.Matches(ctx, 1, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.Close())
+}
+
+func BenchmarkRegexStartAnchored(b *testing.B) {
+	ctx := context.Background()
+	regex := CreateRegex(1024 * 1024)
+	defer regex.Close()
+	if err := regex.SetRegexString(ctx, `^\d*`, RegexFlags_None); err != nil {
+		b.Fatal(err)
+	}
+	if err := regex.SetMatchString(ctx, strings.Repeat("1234567890", 10000)); err != nil {
+		b.Fatal(err)
+	}
+	pr := regex.(*privateRegex)
+	b.Run("Search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := pr.findOccurrence(ctx, 0, 2); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ShortCircuit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := regex.Matches(ctx, 0, 2); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRegexSetRegion(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `^\w+$`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "ab cd ef"))
+	start, end, err := regex.Region(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, start)
+	require.Equal(t, 9, end)
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// The region's boundaries behave as the beginning and end of the text, while positions are still absolute
+	require.NoError(t, regex.SetRegion(ctx, 4, 6))
+	start, end, err = regex.Region(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 4, start)
+	require.Equal(t, 6, end)
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	before, match, after, ok, err := regex.Partition(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "ab ", before)
+	require.Equal(t, "cd", match)
+	require.Equal(t, " ef", after)
+	replaced, err := regex.Replace(ctx, "<$0>", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "ab <cd> ef", replaced)
+	replaced, _, err = regex.ReplaceAllWithSpans(ctx, "<$0>")
+	require.NoError(t, err)
+	require.Equal(t, "ab <cd> ef", replaced)
+	ok, err = regex.Matches(ctx, 6, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.True(t, ErrInvalidRegion.Is(regex.SetRegion(ctx, 0, 2)))
+	require.True(t, ErrInvalidRegion.Is(regex.SetRegion(ctx, 3, 2)))
+	require.True(t, ErrInvalidRegion.Is(regex.SetRegion(ctx, 1, 10)))
+
+	// Setting the match string resets the region
+	require.NoError(t, regex.SetMatchString(ctx, "abcdef"))
+	start, end, err = regex.Region(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, start)
+	require.Equal(t, 7, end)
+	ok, err = regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexSetRegionBytes(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	require.NoError(t, regex.SetRegexString(ctx, `.+`, RegexFlags_None))
+	// "é" is 2 bytes and 1 code unit, while "😀" is 4 bytes and 2 code units
+	require.NoError(t, regex.SetMatchString(ctx, "aé😀bé"))
+	from, to, err := regex.RegionBytes()
+	require.NoError(t, err)
+	require.Equal(t, 1, from)
+	require.Equal(t, 11, to)
+
+	require.NoError(t, regex.SetRegionBytes(ctx, 2, 8))
+	from, to, err = regex.RegionBytes()
+	require.NoError(t, err)
+	require.Equal(t, 2, from)
+	require.Equal(t, 8, to)
+	results, err := regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"é😀"}, results)
+
+	// Positions within a character are rounded outward to include the entire character
+	require.NoError(t, regex.SetRegionBytes(ctx, 3, 6))
+	from, to, err = regex.RegionBytes()
+	require.NoError(t, err)
+	require.Equal(t, 2, from)
+	require.Equal(t, 8, to)
+	results, err = regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"é😀"}, results)
+
+	// A region within a single character expands to cover the entire character
+	require.NoError(t, regex.SetRegionBytes(ctx, 5, 5))
+	from, to, err = regex.RegionBytes()
+	require.NoError(t, err)
+	require.Equal(t, 4, from)
+	require.Equal(t, 8, to)
+
+	require.NoError(t, regex.SetRegionBytes(ctx, 11, 11))
+	results, err = regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Empty(t, results)
+	require.True(t, ErrInvalidRegion.Is(regex.SetRegionBytes(ctx, 1, 12)))
+	require.NoError(t, regex.Close())
+}
+
+func TestCompileAll(t *testing.T) {
+	ctx := context.Background()
+	regexes, errs := CompileAll(ctx, []string{`a+`, `ab(cd`, `\d{2}`, `x**`}, RegexFlags_None)
+	require.Len(t, regexes, 4)
+	require.Len(t, errs, 4)
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[2])
+	require.NotNil(t, regexes[0])
+	require.NotNil(t, regexes[2])
+	require.Nil(t, regexes[1])
+	require.Nil(t, regexes[3])
+
+	require.True(t, ErrInvalidRegex.Is(errs[1]))
+	parseErr, ok := errs[1].(*errors.Error).Cause().(*ParseError)
+	require.True(t, ok)
+	require.Equal(t, ParseError{Code: U_REGEX_MISMATCHED_PAREN, Line: 1, Offset: 5, PreContext: "ab(cd", PostContext: ""}, *parseErr)
+	require.True(t, ErrInvalidRegex.Is(errs[3]))
+	parseErr, ok = errs[3].(*errors.Error).Cause().(*ParseError)
+	require.True(t, ok)
+	require.Equal(t, ParseError{Code: U_REGEX_RULE_SYNTAX, Line: 1, Offset: 3, PreContext: "x*", PostContext: "*"}, *parseErr)
+	require.Equal(t, `the given regular expression is invalid: U_REGEX_RULE_SYNTAX at line 1, offset 3, between "x*" and "*"`, errs[3].Error())
+
+	// The successfully-compiled regexes are usable
+	require.NoError(t, regexes[2].SetMatchString(ctx, "a12"))
+	ok, err := regexes[2].Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	for _, regex := range regexes {
+		if regex != nil {
+			require.NoError(t, regex.Close())
+		}
+	}
+}
+
+func TestRegexUninitializedText(t *testing.T) {
+	ctx := context.Background()
+	// Every function that reads the match string, which must return an error rather than reaching ICU without any text
+	textFunctions := map[string]func(regex Regex) error{
+		"GroupIndexAcrossMatches": func(regex Regex) error {
+			_, err := regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 0, 1, false)
+			return err
+		},
+		"RefreshText": func(regex Regex) error { return regex.RefreshText(ctx, "") },
+		"SetRegion":   func(regex Regex) error { return regex.SetRegion(ctx, 1, 1) },
+		"SetRegionBytes": func(regex Regex) error {
+			return regex.SetRegionBytes(ctx, 1, 1)
+		},
+		"RegionBytes": func(regex Regex) error {
+			_, _, err := regex.RegionBytes()
+			return err
+		},
+		"Region": func(regex Regex) error {
+			_, _, err := regex.Region(ctx)
+			return err
+		},
+		"Matches": func(regex Regex) error {
+			_, err := regex.Matches(ctx, 0, 0)
+			return err
+		},
+		"Replace": func(regex Regex) error {
+			_, err := regex.Replace(ctx, "x", 1, 0)
+			return err
+		},
+		"Partition": func(regex Regex) error {
+			_, _, _, _, err := regex.Partition(ctx, 1, 1)
+			return err
+		},
+		"ReplaceAllWithSpans": func(regex Regex) error {
+			_, _, err := regex.ReplaceAllWithSpans(ctx, "x")
+			return err
+		},
+		"FindAllString": func(regex Regex) error {
+			_, err := regex.FindAllString(ctx, 1, 0)
+			return err
+		},
+		"AllGroup": func(regex Regex) error {
+			_, err := regex.AllGroup(ctx, 0, 0)
+			return err
+		},
+		"AllGroupParticipating": func(regex Regex) error {
+			_, err := regex.AllGroupParticipating(ctx, 0, 0)
+			return err
+		},
+	}
+	for name, f := range textFunctions {
+		t.Run(name, func(t *testing.T) {
+			for _, bufferSize := range []uint32{0, 1024} {
+				regex := CreateRegex(bufferSize)
+				require.True(t, ErrRegexNotYetSet.Is(f(regex)))
+				require.NoError(t, regex.SetRegexString(ctx, `a`, RegexFlags_None))
+				require.True(t, ErrMatchNotYetSet.Is(f(regex)))
+				// Changing the regex requires the match string to be set again
+				require.NoError(t, regex.SetMatchString(ctx, "abc"))
+				require.NoError(t, regex.SetRegexString(ctx, `b`, RegexFlags_None))
+				require.True(t, ErrMatchNotYetSet.Is(f(regex)))
+				require.NoError(t, regex.Close())
+			}
+		})
+	}
+
+	// Empty match strings are still set, even when they do not use the string buffer. ICU rejects empty regexes, which
+	// is also true of MySQL.
+	for _, bufferSize := range []uint32{0, 1024} {
+		regex := CreateRegex(bufferSize)
+		require.True(t, ErrInvalidRegex.Is(regex.SetRegexString(ctx, ``, RegexFlags_None)))
+		require.NoError(t, regex.SetRegexString(ctx, `x*`, RegexFlags_None))
+		require.NoError(t, regex.SetMatchString(ctx, ""))
+		ok, err := regex.Matches(ctx, 0, 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+		results, err := regex.FindAllString(ctx, 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{""}, results)
+		require.NoError(t, regex.Close())
+	}
+}
+
+func BenchmarkRegexReplace(b *testing.B) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+	if err := regex.SetRegexString(ctx, `\d+`, RegexFlags_None); err != nil {
+		b.Fatal(err)
+	}
+	if err := regex.SetMatchString(ctx, strings.Repeat("abc 123 ", 50)); err != nil {
+		b.Fatal(err)
+	}
+	pr := regex.(*privateRegex)
+	// ICU appends the result into a buffer that we allocate, so every allocation made while replacing goes through malloc
+	var mallocs uint64
+	pr.f_malloc = countingFunction{Function: pr.f_malloc, calls: &mallocs}
+	operations := map[string]func() error{
+		"Replace": func() error {
+			_, err := regex.Replace(ctx, "<$0>", 1, 0)
+			return err
+		},
+		"ReplaceAllWithSpans": func() error {
+			_, _, err := regex.ReplaceAllWithSpans(ctx, "<$0>")
+			return err
+		},
+	}
+	for _, name := range []string{"Replace", "ReplaceAllWithSpans"} {
+		// The reused buffers are only allocated by the first call, while releasing them before each call allocates them
+		// every time, as each call did before the buffers were reused
+		for _, reused := range []bool{true, false} {
+			b.Run(fmt.Sprintf("%s/reused=%t", name, reused), func(b *testing.B) {
+				start := mallocs
+				for i := 0; i < b.N; i++ {
+					if !reused {
+						if err := pr.releaseBuffer(ctx, &pr.replacementStrBuffer); err != nil {
+							b.Fatal(err)
+						}
+						if err := pr.releaseBuffer(ctx, &pr.replaceDestBuffer); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err := operations[name](); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(mallocs-start)/float64(b.N), "guest-mallocs/op")
+			})
+		}
+	}
+}
+
+// countingFunction wraps a function exported from the module, and counts how many times it is called.
+type countingFunction struct {
+	api.Function
+	calls *uint64
+}
+
+// CallWithStack implements the interface api.Function.
+func (f countingFunction) CallWithStack(ctx context.Context, stack []uint64) error {
+	*f.calls++
+	return f.Function.CallWithStack(ctx, stack)
+}
+
+func TestCompileGlob(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		glob       string
+		matches    []string
+		nonMatches []string
+	}{
+		{"*.txt", []string{"a.txt", ".txt", "dir/a.txt"}, []string{"a.txtx", "atxt", "a.TXT"}},
+		{"data_?.csv", []string{"data_1.csv", "data_é.csv"}, []string{"data_.csv", "data_12.csv"}},
+		{"file[0-9].log", []string{"file1.log"}, []string{"filea.log", "file10.log"}},
+		{"file[!0-9].log", []string{"filea.log"}, []string{"file1.log"}},
+		{"[]a]", []string{"]", "a"}, []string{"b"}},
+		// Characters that are special in a regex, but not in a glob, match literally
+		{"a+b.(c)", []string{"a+b.(c)"}, []string{"aab.(c)", "a+bx(c)", "a+b.c"}},
+		{`a\*b`, []string{"a*b"}, []string{"axb"}},
+		{"a[b", []string{"a[b"}, []string{"ab"}},
+	}
+	for _, test := range tests {
+		t.Run(test.glob, func(t *testing.T) {
+			regex, err := CompileGlob(test.glob, RegexFlags_None)
+			require.NoError(t, err)
+			for _, str := range test.matches {
+				require.NoError(t, regex.SetMatchString(ctx, str))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.True(t, ok, str)
+			}
+			for _, str := range test.nonMatches {
+				require.NoError(t, regex.SetMatchString(ctx, str))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.False(t, ok, str)
+			}
+			require.NoError(t, regex.Close())
+		})
+	}
+
+	regex, err := CompileGlob("*.TXT", RegexFlags_Case_Insensitive)
+	require.NoError(t, err)
+	require.NoError(t, regex.SetMatchString(ctx, "a.txt"))
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.Close())
+}
+
+func TestRegexExplainNonMatch(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `hello`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "Say HELLO"))
+	explanation, err := regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Contains(t, explanation, "the regex does not match")
+	require.Contains(t, explanation, "the regex matches at position 5 when ignoring case")
+
+	require.NoError(t, regex.SetRegexString(ctx, `^world`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "hello world"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Contains(t, explanation, "the regex matches at position 7 without its leading anchor")
+	require.NotContains(t, explanation, "ignoring case")
+
+	require.NoError(t, regex.SetRegexString(ctx, `(?i)hello\z`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "Hello world"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Contains(t, explanation, "the regex matches at position 1 without its trailing anchor")
+
+	require.NoError(t, regex.SetRegexString(ctx, `hello there`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "hello world"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "the regex does not match\n"+
+		`the beginning of the regex, "hello ", matches at position 1, but the remainder, "there", fails to match at position 7`, explanation)
+
+	// Prefixes that end within a group have the group closed
+	require.NoError(t, regex.SetRegexString(ctx, `(abc)d`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "abx"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "the regex does not match\n"+
+		`the beginning of the regex, "(ab", matches at position 1, but the remainder, "c)d", fails to match at position 3`, explanation)
+
+	// Prefixes never split escapes, classes, or quantifiers
+	require.NoError(t, regex.SetRegexString(ctx, `(?<word>\p{L}+)\s[0-9]{2,}x`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "word 1x"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "the regex does not match\n"+
+		`the beginning of the regex, "(?<word>\\p{L}+)\\s", matches at position 1, but the remainder, "[0-9]{2,}x", fails to match at position 6`, explanation)
+
+	require.NoError(t, regex.SetRegexString(ctx, `\d`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "hello world"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "the regex does not match\nno part of the regex matches, even with different flags", explanation)
+
+	require.NoError(t, regex.SetRegexString(ctx, `wor`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "hello world"))
+	explanation, err = regex.ExplainNonMatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "the regex matches at position 7", explanation)
+}
+
+func TestRegexClone(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024, WithNormalization(NormalizationForm_NFC))
+	defer regex.Close()
+
+	_, err := regex.Clone(ctx)
+	require.True(t, ErrRegexNotYetSet.Is(err))
+
+	require.NoError(t, regex.SetRegexString(ctx, `^(\w+) (?<second>\w+)`, RegexFlags_Case_Insensitive))
+	clone, err := regex.Clone(ctx)
+	require.NoError(t, err)
+	require.Equal(t, regex.StringBufferSize(), clone.StringBufferSize())
+
+	// The clone does not have the match string, and must receive its own
+	_, err = clone.Matches(ctx, 0, 0)
+	require.True(t, ErrMatchNotYetSet.Is(err))
+	require.NoError(t, regex.SetMatchString(ctx, "Hello World"))
+	require.NoError(t, clone.SetMatchString(ctx, "HELLO there"))
+	for _, r := range []Regex{regex, clone} {
+		ok, err := r.Matches(ctx, 0, 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+		anchored, err := r.IsStartAnchored(ctx)
+		require.NoError(t, err)
+		require.True(t, anchored)
+	}
+	groups, err := regex.AllGroup(ctx, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"World"}, groups)
+	groups, err = clone.AllGroup(ctx, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"there"}, groups)
+
+	// The encoded regex string is shared rather than encoded again
+	original, copied := regex.(*privateRegex).regexStrUTF16, clone.(*privateRegex).regexStrUTF16
+	require.Same(t, &original[0], &copied[0])
+
+	// Changing the original does not affect the clone
+	require.NoError(t, regex.SetRegexString(ctx, `xyz`, RegexFlags_None))
+	require.NoError(t, clone.SetMatchString(ctx, "abc def"))
+	ok, err := clone.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, clone.Close())
+
+	engine := NewSerializedEngine()
+	defer engine.Close()
+	serialized, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	require.NoError(t, serialized.SetRegexString(ctx, `b+`, RegexFlags_None))
+	serializedClone, err := serialized.Clone(ctx)
+	require.NoError(t, err)
+	require.NoError(t, serializedClone.SetMatchString(ctx, "abbbc"))
+	results, err := serializedClone.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bbb"}, results)
+	require.NoError(t, serializedClone.Close())
+	require.NoError(t, serialized.Close())
+}
+
+func BenchmarkRegexClone(b *testing.B) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+	if err := regex.SetRegexString(ctx, `(\d{4})-(\d{2})-(\d{2})T(\d{2}):(\d{2})`, RegexFlags_None); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clone, err := regex.Clone(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = clone.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRegexMatchWithContext(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	text := "one\ntwo\r\nthree\nfour target here\nfive\r\nsix\nseven"
+	require.NoError(t, regex.SetRegexString(ctx, `target`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, text))
+	result, ok, err := regex.MatchWithContext(ctx, 1, 0, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, ContextResult{
+		Match:      "target",
+		Bounds:     MatchBounds{Start: 21, End: 27},
+		Lines:      "four target here",
+		LineNumber: 4,
+		Before:     []string{"two", "three"},
+		After:      []string{"five", "six"},
+	}, result)
+
+	// Context is cut short at the beginning and end of the text
+	result, ok, err = regex.MatchWithContext(ctx, 1, 0, 10)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []string{"one", "two", "three"}, result.Before)
+	require.Equal(t, []string{"five", "six", "seven"}, result.After)
+
+	// A match across lines includes every line that it spans
+	require.NoError(t, regex.SetRegexString(ctx, `here\nfi`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, text))
+	result, ok, err = regex.MatchWithContext(ctx, 1, 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "four target here\nfive", result.Lines)
+	require.Equal(t, []string{"three"}, result.Before)
+	require.Equal(t, []string{"six"}, result.After)
+
+	// Only '\n' ends a line with Unix lines
+	require.NoError(t, regex.SetRegexString(ctx, `b`, RegexFlags_Unix_Lines))
+	require.NoError(t, regex.SetMatchString(ctx, "x\na\rb\rc\ny"))
+	result, ok, err = regex.MatchWithContext(ctx, 1, 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "a\rb\rc", result.Lines)
+	require.Equal(t, 2, result.LineNumber)
+	require.Equal(t, []string{"x"}, result.Before)
+	require.Equal(t, []string{"y"}, result.After)
+	require.NoError(t, regex.SetRegexString(ctx, `b`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "x\na\rb\rc\ny"))
+	result, ok, err = regex.MatchWithContext(ctx, 1, 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "b", result.Lines)
+	require.Equal(t, 3, result.LineNumber)
+	require.Equal(t, []string{"a"}, result.Before)
+	require.Equal(t, []string{"c"}, result.After)
+
+	_, ok, err = regex.MatchWithContext(ctx, 1, 2, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestCompileFrom(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024, WithNormalization(NormalizationForm_NFC))
+	defer regex.Close()
+
+	_, _, err := regex.Pattern()
+	require.True(t, ErrRegexNotYetSet.Is(err))
+
+	require.NoError(t, regex.SetRegexString(ctx, "caf\u00e9 (\\w+)", RegexFlags_Case_Insensitive|RegexFlags_Multiline))
+	pattern, flags, err := regex.Pattern()
+	require.NoError(t, err)
+	require.Equal(t, "caf\u00e9 (\\w+)", pattern)
+	require.Equal(t, RegexFlags_Case_Insensitive|RegexFlags_Multiline, flags)
+
+	restored, err := CompileFrom(pattern, flags)
+	require.NoError(t, err)
+	defer restored.Close()
+	restoredPattern, restoredFlags, err := restored.Pattern()
+	require.NoError(t, err)
+	require.Equal(t, pattern, restoredPattern)
+	require.Equal(t, flags, restoredFlags)
+	for _, r := range []Regex{regex, restored} {
+		require.NoError(t, r.SetMatchString(ctx, "first\nCAFÉ latte"))
+		groups, err := r.AllGroup(ctx, 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"latte"}, groups)
+	}
+
+	_, err = CompileFrom("(unclosed", RegexFlags_None)
+	require.True(t, ErrInvalidRegex.Is(err))
+}
+
+func TestRegexGroupCount(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	_, err := regex.GroupCount()
+	require.True(t, ErrRegexNotYetSet.Is(err))
+	require.Equal(t, 0, regex.NumSubexp())
+
+	tests := []struct {
+		pattern string
+		flags   RegexFlags
+		count   int
+	}{
+		{`(a)(b)`, RegexFlags_None, 2},
+		{`(?:a)`, RegexFlags_None, 0},
+		{`abc`, RegexFlags_None, 0},
+		{`(a(?<name>b)(?=c))\(d\)`, RegexFlags_None, 2},
+		{`(a)(b)`, RegexFlags_Literal, 0},
+	}
+	for _, test := range tests {
+		require.NoError(t, regex.SetRegexString(ctx, test.pattern, test.flags))
+		count, err := regex.GroupCount()
+		require.NoError(t, err)
+		require.Equal(t, test.count, count, test.pattern)
+		require.Equal(t, test.count, regex.NumSubexp(), test.pattern)
+	}
+
+	// The count sizes a slice of every group, where the last group is valid and the one after it is not
+	require.NoError(t, regex.SetRegexString(ctx, `(a)(b)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "ab"))
+	count, err := regex.GroupCount()
+	require.NoError(t, err)
+	_, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, count, 1, false)
+	require.NoError(t, err)
+	_, err = regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, count+1, 1, false)
+	require.True(t, ErrInvalidGroup.Is(err))
+}
+
+func TestFindSubmatchString(t *testing.T) {
+	ctx := context.Background()
+	results, err := FindSubmatchString(ctx, `(\w+)=(\w+)`, "a=b", RegexFlags_None)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a=b", "a", "b"}, results)
+
+	results, err = FindSubmatchString(ctx, `(\w+)=(\w+)`, "no pairs here", RegexFlags_None)
+	require.NoError(t, err)
+	require.Nil(t, results)
+
+	results, err = FindSubmatchString(ctx, `KEY:(\d+)?(x)`, "the key:x", RegexFlags_Case_Insensitive)
+	require.NoError(t, err)
+	require.Equal(t, []string{"key:x", "", "x"}, results)
+
+	_, err = FindSubmatchString(ctx, `(\w+=`, "a=b", RegexFlags_None)
+	require.True(t, ErrInvalidRegex.Is(err))
+}
+
+func TestRegexValidateReplacement(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.Nil(t, regex.SubexpNames())
+	require.True(t, ErrRegexNotYetSet.Is(regex.ValidateReplacement(ctx, "$1")))
+
+	require.NoError(t, regex.SetRegexString(ctx, `(\w+)=(?<value>\w+)`, RegexFlags_None))
+	require.Equal(t, []string{"", "", "value"}, regex.SubexpNames())
+	require.NoError(t, regex.SetMatchString(ctx, "a=b"))
+	for _, replacement := range []string{`$0`, `$1:$2`, `${value}`, `$12`, `\$5`, `cost: \$${value}`} {
+		require.NoError(t, regex.ValidateReplacement(ctx, replacement), replacement)
+		// ICU agrees that these are valid, as invalid references result in an empty string
+		replaced, err := regex.Replace(ctx, replacement, 1, 0)
+		require.NoError(t, err)
+		require.NotEmpty(t, replaced, replacement)
+	}
+
+	err := regex.ValidateReplacement(ctx, `$5`)
+	require.True(t, ErrInvalidReplacement.Is(err))
+	require.Equal(t, "the replacement string is invalid: $5 references group 5, but the regex only has 2 groups", err.Error())
+	replaced, err := regex.Replace(ctx, `$5`, 1, 0)
+	require.NoError(t, err)
+	require.Empty(t, replaced)
+
+	err = regex.ValidateReplacement(ctx, `${key}=${value} $3 $`)
+	require.True(t, ErrInvalidReplacement.Is(err))
+	require.Equal(t, "the replacement string is invalid: ${key} references a named group that does not exist; "+
+		"$3 references group 3, but the regex only has 2 groups; "+
+		`$ must be followed by a group number or a name in braces (use \$ for a literal dollar sign)`, err.Error())
+
+	err = regex.ValidateReplacement(ctx, `${value`)
+	require.Equal(t, `the replacement string is invalid: "${value" is missing its closing brace`, err.Error())
+
+	// References are validated using the Regex's replacement syntax
+	mysql := CreateRegex(1024, WithReplacementSyntax(ReplacementSyntax_MySQL))
+	defer mysql.Close()
+	require.NoError(t, mysql.SetRegexString(ctx, `(a)`, RegexFlags_None))
+	require.NoError(t, mysql.ValidateReplacement(ctx, `\1 costs $5`))
+	require.True(t, ErrInvalidReplacement.Is(mysql.ValidateReplacement(ctx, `\2`)))
+
+	// Numbered references consume digits while the group exists, so $13 with twelve groups is group 1 followed by "3"
+	twelve := CreateRegex(1024)
+	defer twelve.Close()
+	require.NoError(t, twelve.SetRegexString(ctx, strings.Repeat(`(\w)`, 12), RegexFlags_None))
+	require.NoError(t, twelve.SetMatchString(ctx, "abcdefghijkl"))
+	require.NoError(t, twelve.ValidateReplacement(ctx, `$13`))
+	replaced, err = twelve.Replace(ctx, `$13`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "a3", replaced)
+	require.NoError(t, twelve.ValidateReplacement(ctx, `$120`))
+	replaced, err = twelve.Replace(ctx, `$120`, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "l0", replaced)
+}
+
+// sliceChunkProvider is a ChunkProvider that supplies each string from a slice as a chunk.
+type sliceChunkProvider struct {
+	chunks []string
+}
+
+var _ ChunkProvider = (*sliceChunkProvider)(nil)
+
+// NextChunk implements the interface ChunkProvider.
+func (p *sliceChunkProvider) NextChunk() (string, error) {
+	if len(p.chunks) == 0 {
+		return "", io.EOF
+	}
+	chunk := p.chunks[0]
+	p.chunks = p.chunks[1:]
+	return chunk, nil
+}
+
+// failingChunkProvider is a ChunkProvider that always fails.
+type failingChunkProvider struct{}
+
+// NextChunk implements the interface ChunkProvider.
+func (failingChunkProvider) NextChunk() (string, error) {
+	return "", fmt.Errorf("the chunk could not be read")
+}
+
+func TestRegexSetMatchUText(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+	require.True(t, ErrRegexNotYetSet.Is(regex.SetMatchUText(ctx, &sliceChunkProvider{})))
+
+	// The first match spans both chunks, and the chunks split the bytes of "é"
+	require.NoError(t, regex.SetRegexString(ctx, `\w+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchUText(ctx, &sliceChunkProvider{chunks: []string{"hello wor", "ld caf\xc3", "\xa9"}}))
+	results, err := regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello", "world", "café"}, results)
+
+	require.NoError(t, regex.SetMatchUText(ctx, &sliceChunkProvider{}))
+	results, err = regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	require.EqualError(t, regex.SetMatchUText(ctx, failingChunkProvider{}), "the chunk could not be read")
+}
+
+func TestRegexClosed(t *testing.T) {
+	ctx := context.Background()
+	engine := NewSerializedEngine()
+	defer engine.Close()
+	serialized, err := engine.CreateRegex(0)
+	require.NoError(t, err)
+	for name, regex := range map[string]Regex{"private": CreateRegex(1024), "serialized": serialized} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, regex.SetRegexString(ctx, `(a)`, RegexFlags_None))
+			require.NoError(t, regex.SetMatchString(ctx, "abc"))
+			require.NoError(t, regex.Close())
+			require.NoError(t, regex.Close())
+
+			calls := map[string]func() error{
+				"SetRegexString": func() error { return regex.SetRegexString(ctx, `a`, RegexFlags_None) },
+				"SetMatchString": func() error { return regex.SetMatchString(ctx, "a") },
+				"SetMatchUText":  func() error { return regex.SetMatchUText(ctx, &sliceChunkProvider{}) },
+				"GroupIndexAcrossMatches": func() error {
+					_, err := regex.(GroupIndexer).GroupIndexAcrossMatches(ctx, 1, 1, false)
+					return err
+				},
+				"RefreshText":    func() error { return regex.RefreshText(ctx, "abc") },
+				"SetRegion":      func() error { return regex.SetRegion(ctx, 1, 2) },
+				"SetRegionBytes": func() error { return regex.SetRegionBytes(ctx, 1, 2) },
+				"RegionBytes": func() error {
+					_, _, err := regex.RegionBytes()
+					return err
+				},
+				"Region": func() error {
+					_, _, err := regex.Region(ctx)
+					return err
+				},
+				"Matches": func() error {
+					_, err := regex.Matches(ctx, 0, 0)
+					return err
+				},
+				"MatchesWithFlags": func() error {
+					_, err := regex.MatchesWithFlags(ctx, "abc", RegexFlags_None)
+					return err
+				},
+				"MatchesInRegions": func() error {
+					_, err := regex.MatchesInRegions(ctx, [][2]int{{1, 2}})
+					return err
+				},
+				"IsStartAnchored": func() error {
+					_, err := regex.IsStartAnchored(ctx)
+					return err
+				},
+				"Replace": func() error {
+					_, err := regex.Replace(ctx, "x", 1, 0)
+					return err
+				},
+				"ReplaceAllString": func() error {
+					_, _, err := regex.ReplaceAllString(ctx, "x")
+					return err
+				},
+				"Partition": func() error {
+					_, _, _, _, err := regex.Partition(ctx, 1, 1)
+					return err
+				},
+				"ReplaceAllSizeDelta": func() error {
+					_, _, err := regex.ReplaceAllSizeDelta(ctx, "x")
+					return err
+				},
+				"GroupTree": func() error {
+					_, _, err := regex.GroupTree(ctx, 1, 1)
+					return err
+				},
+				"NamedGroupsOrdered": func() error {
+					_, _, err := regex.NamedGroupsOrdered(ctx, 1, 1)
+					return err
+				},
+				"SubstringFrom": func() error {
+					_, _, _, err := regex.SubstringFrom(ctx, 1, 1)
+					return err
+				},
+				"ReplaceAllWithSpans": func() error {
+					_, _, err := regex.ReplaceAllWithSpans(ctx, "x")
+					return err
+				},
+				"FindAllString": func() error {
+					_, err := regex.FindAllString(ctx, 1, 0)
+					return err
+				},
+				"FindAllRuneBounds": func() error {
+					_, err := regex.FindAllRuneBounds(ctx, 1, 0)
+					return err
+				},
+				"AllGroup": func() error {
+					_, err := regex.AllGroup(ctx, 1, 0)
+					return err
+				},
+				"AllGroupParticipating": func() error {
+					_, err := regex.AllGroupParticipating(ctx, 1, 0)
+					return err
+				},
+				"FindAllSubmatchColumnar": func() error {
+					_, _, _, err := regex.FindAllSubmatchColumnar(ctx, 1, 0)
+					return err
+				},
+				"FindLazy": func() error {
+					_, _, err := regex.FindLazy(ctx, 1)
+					return err
+				},
+				"FindFrom": func() error {
+					_, _, err := regex.FindFrom(ctx, 1)
+					return err
+				},
+				"ExplainNonMatch": func() error {
+					_, err := regex.ExplainNonMatch(ctx)
+					return err
+				},
+				"LongestPrefixMatch": func() error {
+					_, err := regex.LongestPrefixMatch(ctx)
+					return err
+				},
+				"GroupCount": func() error {
+					_, err := regex.GroupCount()
+					return err
+				},
+				"NamedGroupCount": func() error {
+					_, err := regex.NamedGroupCount(ctx)
+					return err
+				},
+				"ValidateReplacement": func() error { return regex.ValidateReplacement(ctx, "$1") },
+				"Pattern": func() error {
+					_, _, err := regex.Pattern()
+					return err
+				},
+				"MatchWithContext": func() error {
+					_, _, err := regex.MatchWithContext(ctx, 1, 1, 1)
+					return err
+				},
+				"Clone": func() error {
+					_, err := regex.Clone(ctx)
+					return err
+				},
+			}
+			for call, f := range calls {
+				err := f()
+				require.True(t, ErrClosed.Is(err), "%s: %v", call, err)
+			}
+			require.Zero(t, regex.NumSubexp())
+			require.Nil(t, regex.SubexpNames())
+		})
+	}
+}
+
+func TestRegexMatchesInRegions(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer func() {
+		require.NoError(t, regex.Close())
+	}()
+
+	require.NoError(t, regex.SetRegexString(ctx, `^\d+$`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "123,abc,4567"))
+	require.NoError(t, regex.SetRegion(ctx, 2, 4))
+	results, err := regex.MatchesInRegions(ctx, [][2]int{{1, 4}, {5, 8}, {9, 13}})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, true}, results)
+
+	// The previous region is restored afterward
+	start, end, err := regex.Region(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, start)
+	require.Equal(t, 4, end)
+
+	_, err = regex.MatchesInRegions(ctx, [][2]int{{1, 4}, {9, 14}})
+	require.True(t, ErrInvalidRegion.Is(err))
+	results, err = regex.MatchesInRegions(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+func TestRegexMatchesWithFlags(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer func() {
+		require.NoError(t, regex.Close())
+	}()
+
+	require.NoError(t, regex.SetRegexString(ctx, `^abc`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "xyz abc"))
+	require.NoError(t, regex.SetRegion(ctx, 5, 8))
+	pr := regex.(*privateRegex)
+	var variant URegularExpressionPtr
+	for i := 0; i < 3; i++ {
+		ok, err := regex.MatchesWithFlags(ctx, "ABCdef", RegexFlags_None)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = regex.MatchesWithFlags(ctx, "ABCdef", RegexFlags_Case_Insensitive)
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = regex.MatchesWithFlags(ctx, "abcdef", RegexFlags_None)
+		require.NoError(t, err)
+		require.True(t, ok)
+		// The regex's own flags use the regex itself, while other variants are compiled once and then reused
+		require.Len(t, pr.flagVariants, 1)
+		if variant == 0 {
+			variant = pr.flagVariants[RegexFlags_Case_Insensitive]
+		}
+		require.Equal(t, variant, pr.flagVariants[RegexFlags_Case_Insensitive])
+		require.NotEqual(t, pr.regexPtr, variant)
+	}
+
+	// The match string and region of the regex itself are unchanged
+	ok, err := regex.Matches(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	start, end, err := regex.Region(ctx)
+	require.NoError(t, err)
+	require.Equal(t, [2]int{5, 8}, [2]int{start, end})
+
+	// Changing the regex string discards the variants
+	require.NoError(t, regex.SetRegexString(ctx, `def$`, RegexFlags_None))
+	require.Empty(t, pr.flagVariants)
+	ok, err = regex.MatchesWithFlags(ctx, "ABCDEF", RegexFlags_Case_Insensitive)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestRegexLongestPrefixMatch(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer func() {
+		require.NoError(t, regex.Close())
+	}()
+
+	tests := []struct {
+		pattern  string
+		input    string
+		expected int
+	}{
+		{`[a-z]+`, "abc123", 3},
+		{`abc\d`, "abc123", 4},
+		{`abc\d+x`, "abc123", 0},
+		{`\d+`, "abc123", 0},
+		{`.*`, "abc123", 6},
+		{`a*`, "bcd", 0},
+		{`\x{1F600}+`, "\U0001F600\U0001F600!", 4},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			require.NoError(t, regex.SetRegexString(ctx, test.pattern, RegexFlags_None))
+			require.NoError(t, regex.SetMatchString(ctx, test.input))
+			length, err := regex.LongestPrefixMatch(ctx)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, length)
+		})
+	}
+
+	// The prefix is relative to the region
+	require.NoError(t, regex.SetRegexString(ctx, `[a-z]+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "123abc456"))
+	require.NoError(t, regex.SetRegion(ctx, 4, 8))
+	length, err := regex.LongestPrefixMatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, length)
+}
+
+func TestRegexNamedGroupCount(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	_, err := regex.NamedGroupCount(ctx)
+	require.True(t, ErrRegexNotYetSet.Is(err))
+
+	require.NoError(t, regex.SetRegexString(ctx, `(?<year>\d{4})-(\d{2})-(?<day>\d{2})`, RegexFlags_None))
+	count, err := regex.NamedGroupCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, []string{"", "year", "", "day"}, regex.SubexpNames())
+
+	err = regex.SetRegexString(ctx, `(?<word>\w+) (?<word>\w+)`, RegexFlags_None)
+	require.True(t, ErrDuplicateGroupName.Is(err))
+	require.Equal(t, `the group name "word" is used by both group 1 and group 2`, err.Error())
+	// The previous regex is still set
+	count, err = regex.NamedGroupCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	require.NoError(t, regex.SetRegexString(ctx, `(a)(?:b)`, RegexFlags_None))
+	count, err = regex.NamedGroupCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestRegexSetMaxScanLength(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `\d+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "abc12 defghij345"))
+	regex.SetMaxScanLength(8)
+
+	// The first number is within the limit, while the second is beyond it
+	ok, err := regex.Matches(ctx, 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = regex.Matches(ctx, 0, 2)
+	require.NoError(t, err)
+	require.False(t, ok)
+	results, err := regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"12"}, results)
+	replaced, err := regex.Replace(ctx, "#", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "abc# defghij345", replaced)
+	replaced, _, err = regex.ReplaceAllWithSpans(ctx, "#")
+	require.NoError(t, err)
+	require.Equal(t, "abc# defghij345", replaced)
+
+	// The limit begins at the start position, and a match that is cut off by the limit is shortened
+	ok, err = regex.Matches(ctx, 5, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+	results, err = regex.FindAllString(ctx, 9, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"345"}, results)
+	results, err = regex.FindAllString(ctx, 8, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"34"}, results)
+
+	// The limit also begins at the start of the region
+	require.NoError(t, regex.SetRegion(ctx, 6, 17))
+	ok, err = regex.Matches(ctx, 0, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	regex.SetMaxScanLength(0)
+	ok, err = regex.Matches(ctx, 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, regex.SetRegion(ctx, 1, 17))
+	results, err = regex.FindAllString(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"12", "345"}, results)
+}
+
+func TestRegexMatchReaderAll(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `needle`, RegexFlags_None))
+	// The match begins 3 bytes before the end of the first window, and ends 3 bytes into the second window
+	text := strings.Repeat("x", 13) + "needle" + strings.Repeat("x", 20)
+	bounds, err := regex.MatchReaderAll(ctx, strings.NewReader(text), 16, 8)
+	require.NoError(t, err)
+	require.Equal(t, []MatchBounds{{14, 20}}, bounds)
+	// Without enough overlap, the match is missed
+	bounds, err = regex.MatchReaderAll(ctx, strings.NewReader(text), 16, 2)
+	require.NoError(t, err)
+	require.Empty(t, bounds)
+
+	// Matches within the overlap are only reported once, and characters cut off by a window are kept whole
+	require.NoError(t, regex.SetRegexString(ctx, `\w+`, RegexFlags_None))
+	text = "ab cd éf\U0001F600 gh ij kl mn op"
+	bounds, err = regex.MatchReaderAll(ctx, strings.NewReader(text), 7, 3)
+	require.NoError(t, err)
+	require.Equal(t, []MatchBounds{{1, 3}, {4, 6}, {7, 10}, {15, 17}, {18, 20}, {21, 23}, {24, 26}, {27, 29}}, bounds)
+	for _, window := range []int{4, 5, 8, 100} {
+		windowBounds, err := regex.MatchReaderAll(ctx, strings.NewReader(text), window, 3)
+		require.NoError(t, err)
+		require.Equal(t, bounds, windowBounds, window)
+	}
+
+	_, err = regex.MatchReaderAll(ctx, strings.NewReader(text), 4, 4)
+	require.True(t, ErrInvalidWindow.Is(err))
+}
+
+func TestRegexNamedGroupsOrdered(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	// The names are deliberately not in alphabetical order, and an unnamed group sits between them
+	require.NoError(t, regex.SetRegexString(ctx, `(?<year>\d{4})-(\d{2})-(?<day>\d{2})(?: (?<era>AD|BC))?(?<zone>Z)?`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "2024-05-17 AD, 1999-12-31Z"))
+	groups, ok, err := regex.NamedGroupsOrdered(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []NamedGroup{{"year", "2024"}, {"day", "17"}, {"era", "AD"}, {"zone", ""}}, groups)
+
+	groups, ok, err = regex.NamedGroupsOrdered(ctx, 1, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []struct{ Name, Value string }{{"year", "1999"}, {"day", "31"}, {"era", ""}, {"zone", "Z"}}, groups)
+
+	_, ok, err = regex.NamedGroupsOrdered(ctx, 1, 3)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRegexGroupTree(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer func() {
+		require.NoError(t, regex.Close())
+	}()
+
+	require.NoError(t, regex.SetRegexString(ctx, `((a)(?<second>b))`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "xxab"))
+	root, ok, err := regex.GroupTree(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, &GroupNode{
+		Number: 0,
+		Bounds: MatchBounds{Start: 3, End: 5},
+		Text:   "ab",
+		Children: []*GroupNode{{
+			Number: 1,
+			Bounds: MatchBounds{Start: 3, End: 5},
+			Text:   "ab",
+			Children: []*GroupNode{
+				{Number: 2, Bounds: MatchBounds{Start: 3, End: 4}, Text: "a"},
+				{Number: 3, Name: "second", Bounds: MatchBounds{Start: 4, End: 5}, Text: "b"},
+			},
+		}},
+	}, root)
+	_, ok, err = regex.GroupTree(ctx, 1, 2)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Non-participating groups are left out, and a capture kept from an earlier iteration is moved up to the nearest
+	// group that contains it
+	require.NoError(t, regex.SetRegexString(ctx, `(?:(x)|((a)|b))+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "ab"))
+	root, ok, err = regex.GroupTree(ctx, 1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, &GroupNode{
+		Number: 0,
+		Bounds: MatchBounds{Start: 1, End: 3},
+		Text:   "ab",
+		Children: []*GroupNode{
+			{Number: 2, Bounds: MatchBounds{Start: 2, End: 3}, Text: "b"},
+			{Number: 3, Bounds: MatchBounds{Start: 1, End: 2}, Text: "a"},
+		},
+	}, root)
+}
+
+func TestRegexReplaceAllString(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `\d+`, RegexFlags_None))
+	input := strings.Repeat("no digits here ", 2)
+	require.NoError(t, regex.SetMatchString(ctx, input))
+	result, replaced, err := regex.ReplaceAllString(ctx, "#")
+	require.NoError(t, err)
+	require.False(t, replaced)
+	require.Equal(t, input, result)
+	// The result is a copy, even though the content is unchanged
+	require.NotSame(t, unsafe.StringData(input), unsafe.StringData(result))
+
+	require.NoError(t, regex.SetMatchString(ctx, "a1b22c333"))
+	result, replaced, err = regex.ReplaceAllString(ctx, "#")
+	require.NoError(t, err)
+	require.True(t, replaced)
+	require.Equal(t, "a#b#c#", result)
+	// A replacement that produces the same text still counts as a replacement
+	result, replaced, err = regex.ReplaceAllString(ctx, "$0")
+	require.NoError(t, err)
+	require.True(t, replaced)
+	require.Equal(t, "a1b22c333", result)
+
+	// Only the region is searched
+	require.NoError(t, regex.SetRegion(ctx, 1, 2))
+	result, replaced, err = regex.ReplaceAllString(ctx, "#")
+	require.NoError(t, err)
+	require.False(t, replaced)
+	require.Equal(t, "a1b22c333", result)
+}
+
+func TestRegexReplaceAllSizeDelta(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer func() {
+		require.NoError(t, regex.Close())
+	}()
+
+	tests := []struct {
+		pattern     string
+		input       string
+		replacement string
+		matches     int
+	}{
+		{`\d+`, "a1b22c333", "#", 3},
+		{`\d+`, "a1b22c333", "[$0]", 3},
+		{`\d+`, "no digits", "#", 0},
+		{`(?<key>\w+)=(\w+)`, "x=1, yy=22", `${key}: $2 \u00e9\U0001F600 \uD83D\uDE00 \uD83D \$ \x \\`, 2},
+		{`(a)|(b)`, "abab", "<$1$2$1>", 4},
+		{`\s+`, "\u00fcber  sch\u00f6n\t\U0001F600", "\u00a0", 2},
+		{`\p{L}`, "\u00fc\U0001D49Cx", "$0$0", 3},
+		{`x*`, "abc", "-", 4},
+		// A digit that would reference a group beyond the last is literal text
+		{`(a)`, "aa", "$10", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern+"/"+test.replacement, func(t *testing.T) {
+			require.NoError(t, regex.SetRegexString(ctx, test.pattern, RegexFlags_None))
+			require.NoError(t, regex.SetMatchString(ctx, test.input))
+			delta, matches, err := regex.ReplaceAllSizeDelta(ctx, test.replacement)
+			require.NoError(t, err)
+			require.Equal(t, test.matches, matches)
+			result, _, err := regex.ReplaceAllString(ctx, test.replacement)
+			require.NoError(t, err)
+			require.Equal(t, len(result)-len(test.input), delta, result)
+		})
+	}
+
+	require.NoError(t, regex.SetRegexString(ctx, `(a)`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a"))
+	for _, replacement := range []string{"$2", "${name}", "$x", "${a"} {
+		_, _, err := regex.ReplaceAllSizeDelta(ctx, replacement)
+		require.True(t, ErrInvalidReplacement.Is(err), replacement)
+	}
+}
+
+func TestRegexFindFrom(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `\d+`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a1b22c333d"))
+	var walked []MatchBounds
+	for pos := 1; ; {
+		bounds, ok, err := regex.FindFrom(ctx, pos)
+		require.NoError(t, err)
+		if !ok {
+			break
+		}
+		walked = append(walked, bounds)
+		pos = bounds.End
+	}
+	require.Equal(t, []MatchBounds{{2, 3}, {4, 6}, {7, 10}}, walked)
+
+	// Each call is independent of the previous one
+	bounds, ok, err := regex.FindFrom(ctx, 5)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MatchBounds{5, 6}, bounds)
+	bounds, ok, err = regex.FindFrom(ctx, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MatchBounds{2, 3}, bounds)
+	_, ok, err = regex.FindFrom(ctx, 10)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Empty matches need to move past the end to make progress
+	require.NoError(t, regex.SetRegexString(ctx, `x*`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "axxb"))
+	walked = nil
+	for pos := 1; ; {
+		bounds, ok, err := regex.FindFrom(ctx, pos)
+		require.NoError(t, err)
+		if !ok {
+			break
+		}
+		walked = append(walked, bounds)
+		pos = bounds.End
+		if bounds.Start == bounds.End {
+			pos++
+		}
+	}
+	require.Equal(t, []MatchBounds{{1, 1}, {2, 4}, {4, 4}, {5, 5}}, walked)
+}
+
+func TestCompileFullMatch(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		pattern string
+		flags   RegexFlags
+		matches []string
+		fails   []string
+	}{
+		// With ^ and $, either half of the alternation could match alone
+		{`cat|dog`, RegexFlags_None, []string{"cat", "dog"}, []string{"cats", "hotdog", "cat dog", ""}},
+		// With ^ and $, these would match a single line of the input
+		{`\d+`, RegexFlags_Multiline, []string{"123"}, []string{"123\n456", "abc\n123", "123\n"}},
+		{`[a-z]+`, RegexFlags_Multiline | RegexFlags_Case_Insensitive, []string{"ABC"}, []string{"abc\ndef"}},
+		{`a.b`, RegexFlags_Literal, []string{"a.b"}, []string{"axb", "a.bc"}},
+		{`a b # comment`, RegexFlags_Comments, []string{"ab"}, []string{"abc", "a b"}},
+		// The quote and comment would otherwise continue through the end of the wrapped pattern
+		{`\Qa.b`, RegexFlags_None, []string{"a.b"}, []string{"axb", "a.bc"}},
+		{`(?x)abc # c`, RegexFlags_None, []string{"abc"}, []string{"abc ", "abcc"}},
+		{`(?x:a) b`, RegexFlags_None, []string{"a b"}, []string{"ab"}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			regex, err := CompileFullMatch(ctx, test.pattern, test.flags)
+			require.NoError(t, err)
+			defer regex.Close()
+			for _, input := range test.matches {
+				require.NoError(t, regex.SetMatchString(ctx, input))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.True(t, ok, input)
+			}
+			for _, input := range test.fails {
+				require.NoError(t, regex.SetMatchString(ctx, input))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.False(t, ok, input)
+			}
+		})
+	}
+
+	// Groups keep their numbers, as the wrapping group does not capture
+	regex, err := CompileFullMatch(ctx, `(\w+)@(\w+)`, RegexFlags_None)
+	require.NoError(t, err)
+	defer regex.Close()
+	require.NoError(t, regex.SetMatchString(ctx, "someone@example"))
+	groups, err := regex.AllGroup(ctx, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"example"}, groups)
+
+	// Errors refer to the pattern as it was given
+	_, err = CompileFullMatch(ctx, "(unclosed", RegexFlags_None)
+	require.True(t, ErrInvalidRegex.Is(err))
+	_, err = CompileFullMatch(ctx, "ab*+?", RegexFlags_None)
+	require.True(t, ErrInvalidRegex.Is(err))
+	parseErr := err.(*errors.Error).Cause().(*ParseError)
+	expected := CreateRegex(0)
+	defer expected.Close()
+	err = expected.SetRegexString(ctx, "ab*+?", RegexFlags_None)
+	require.True(t, ErrInvalidRegex.Is(err))
+	expectedErr := err.(*errors.Error).Cause().(*ParseError)
+	require.Equal(t, expectedErr.Offset, parseErr.Offset)
+	require.Equal(t, expectedErr.PreContext, parseErr.PreContext)
+}
+
+func TestCompileExists(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		pattern  string
+		flags    RegexFlags
+		compiled string
+		matches  []string
+		fails    []string
+	}{
+		{`(\w+)@((?<host>\w+)\.)+(com|org)`, RegexFlags_None, `(?:\w+)@(?:(?:\w+)\.)+(?:com|org)`,
+			[]string{"a@b.com", "x a@b.c.org y"}, []string{"a@b.net", "a@com"}},
+		{`\(a\)[(b)](?:c)(?i:d)(?=\()\Q(f)\E`, RegexFlags_None, `\(a\)[(b)](?:c)(?i:d)(?=\()\Q(f)\E`,
+			[]string{"(a)(cD(f)"}, []string{"(a)(cD"}},
+		{`(a) # (b)
+(c)`, RegexFlags_Comments, `(?:a) # (b)
+(?:c)`, []string{"ac"}, []string{"abc"}},
+		// Backreferences need their groups to capture, so the pattern is left unchanged
+		{`(a)\1`, RegexFlags_None, `(a)\1`, []string{"aa"}, []string{"ab"}},
+		{`(?<x>a)\k<x>`, RegexFlags_None, `(?<x>a)\k<x>`, []string{"aa"}, []string{"ab"}},
+		{`(a)`, RegexFlags_Literal, `(a)`, []string{"(a)"}, []string{"a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			regex, err := CompileExists(test.pattern, test.flags)
+			require.NoError(t, err)
+			defer regex.Close()
+			compiled, flags, err := regex.Pattern()
+			require.NoError(t, err)
+			require.Equal(t, test.compiled, compiled)
+			require.Equal(t, test.flags, flags)
+			for _, input := range test.matches {
+				require.NoError(t, regex.SetMatchString(ctx, input))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.True(t, ok, input)
+			}
+			for _, input := range test.fails {
+				require.NoError(t, regex.SetMatchString(ctx, input))
+				ok, err := regex.Matches(ctx, 0, 0)
+				require.NoError(t, err)
+				require.False(t, ok, input)
+			}
+		})
+	}
+
+	// Errors refer to the pattern as it was given
+	_, err := CompileExists("(a)(b", RegexFlags_None)
+	require.True(t, ErrInvalidRegex.Is(err))
+	parseErr, ok := err.(*errors.Error).Cause().(*ParseError)
+	require.True(t, ok)
+	require.Equal(t, "(a)(b", parseErr.PreContext)
+}
+
+func TestRegexFindAllSubmatchColumnar(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `(\w+)=(\d+)?`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a=1, bb=, ccc=333"))
+	matchStarts, matchEnds, groups, err := regex.FindAllSubmatchColumnar(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 6, 11}, matchStarts)
+	require.Equal(t, []int{4, 9, 18}, matchEnds)
+	require.Equal(t, [][]string{{"a=1", "bb=", "ccc=333"}, {"a", "bb", "ccc"}, {"1", "", "333"}}, groups)
+
+	// Each column lines up with the rows that are found one match at a time
+	for i := range matchStarts {
+		bounds, ok, err := regex.FindFrom(ctx, matchStarts[i])
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, MatchBounds{matchStarts[i], matchEnds[i]}, bounds)
+		match, ok, err := regex.FindLazy(ctx, matchStarts[i])
+		require.NoError(t, err)
+		require.True(t, ok)
+		for group := range groups {
+			require.Equal(t, match.Group(group), groups[group][i])
+		}
+	}
+
+	matchStarts, matchEnds, groups, err = regex.FindAllSubmatchColumnar(ctx, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{6}, matchStarts)
+	require.Equal(t, []int{9}, matchEnds)
+	require.Equal(t, [][]string{{"bb="}, {"bb"}, {""}}, groups)
+
+	// Without any matches, every column is still present
+	require.NoError(t, regex.SetMatchString(ctx, "nothing"))
+	matchStarts, _, groups, err = regex.FindAllSubmatchColumnar(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Empty(t, matchStarts)
+	require.Len(t, groups, 3)
+}
+
+func TestRegexSubstringFrom(t *testing.T) {
+	ctx := context.Background()
+	regex := CreateRegex(1024)
+	defer regex.Close()
+
+	require.NoError(t, regex.SetRegexString(ctx, `\w\d`, RegexFlags_None))
+	require.NoError(t, regex.SetMatchString(ctx, "a1 b2 c3"))
+	// Each call resumes from the end position of the previous match
+	var tokens []string
+	var endPositions []int
+	for pos := 1; ; {
+		text, endPos, ok, err := regex.SubstringFrom(ctx, pos, 1)
+		require.NoError(t, err)
+		if !ok {
+			break
+		}
+		tokens = append(tokens, text)
+		endPositions = append(endPositions, endPos)
+		pos = endPos
+	}
+	require.Equal(t, []string{"a1", "b2", "c3"}, tokens)
+	require.Equal(t, []int{3, 6, 9}, endPositions)
+
+	// The occurrence counts from the start position
+	text, endPos, ok, err := regex.SubstringFrom(ctx, 2, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "c3", text)
+	require.Equal(t, 9, endPos)
+	_, _, ok, err = regex.SubstringFrom(ctx, 1, 4)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
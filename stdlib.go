@@ -0,0 +1,170 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"unicode/utf8"
+)
+
+// StdlibCompat exposes a Regex through methods that are named and shaped like those of Go's regexp.Regexp, which eases
+// migrating code that was written against the standard library. Each method sets the match string of the Regex, so it
+// replaces whatever match string was previously set. Errors are not returned, and instead produce the same result as
+// when nothing matches. Matching follows ICU's rules rather than those of the standard library, which differ in some
+// cases, such as replacement strings, where "$name" and "${1}" are not references to groups (ICU uses "${name}" and
+// "$1").
+type StdlibCompat struct {
+	regex Regex
+	ctx   context.Context
+}
+
+// MatchString reports whether the string contains any match of the regex.
+func (s StdlibCompat) MatchString(str string) bool {
+	if err := s.regex.SetMatchString(s.ctx, str); err != nil {
+		return false
+	}
+	ok, err := s.regex.Matches(s.ctx, 0, 0)
+	return err == nil && ok
+}
+
+// FindString returns the text of the first match of the regex within the string. If there is no match, then an empty
+// string is returned.
+func (s StdlibCompat) FindString(str string) string {
+	match := s.FindStringSubmatch(str)
+	if match == nil {
+		return ""
+	}
+	return match[0]
+}
+
+// FindStringSubmatch returns the text of the first match of the regex within the string, followed by the text of each
+// capture group. Groups that did not participate in the match are empty strings. If there is no match, then nil is
+// returned.
+func (s StdlibCompat) FindStringSubmatch(str string) []string {
+	if err := s.regex.SetMatchString(s.ctx, str); err != nil {
+		return nil
+	}
+	match, ok, err := s.regex.FindLazy(s.ctx, 1)
+	if err != nil || !ok {
+		return nil
+	}
+	results := make([]string, s.regex.NumSubexp()+1)
+	for i := range results {
+		results[i] = match.Group(i)
+	}
+	return results
+}
+
+// FindAllString returns the text of every match of the regex within the string, up to n matches. If n is negative,
+// then every match is returned. As with Go's regexp package, an empty match that immediately follows another match is
+// ignored. If there are no matches, then nil is returned.
+func (s StdlibCompat) FindAllString(str string, n int) []string {
+	matches := s.allMatches(str, n)
+	if len(matches) == 0 {
+		return nil
+	}
+	results := make([]string, len(matches))
+	for i, match := range matches {
+		results[i] = str[match[0]:match[1]]
+	}
+	return results
+}
+
+// ReplaceAllString returns a copy of src where every match of the regex has been replaced by repl. Within repl, "$N"
+// and "${name}" are replaced by the text of the corresponding capture group, using ICU's syntax. If an error occurs,
+// then src is returned unchanged.
+func (s StdlibCompat) ReplaceAllString(src string, repl string) string {
+	if err := s.regex.SetMatchString(s.ctx, src); err != nil {
+		return src
+	}
+	result, err := s.regex.Replace(s.ctx, repl, 1, 0)
+	if err != nil {
+		return src
+	}
+	return result
+}
+
+// Split slices the string into the substrings that are between the matches of the regex, following the same rules as
+// Split from Go's regexp package. The count determines the number of substrings to return: a negative n returns every
+// substring, zero returns nil, and a positive n returns at most n substrings, where the last one is the unsplit
+// remainder.
+func (s StdlibCompat) Split(str string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	if str == "" {
+		return []string{""}
+	}
+	matches := s.allMatches(str, n)
+	if matches == nil {
+		return nil
+	}
+	results := make([]string, 0, len(matches)+1)
+	beg, end := 0, 0
+	for _, match := range matches {
+		if n > 0 && len(results) == n-1 {
+			break
+		}
+		end = match[0]
+		// An empty match at the beginning of the string does not split off an empty string
+		if match[1] != 0 {
+			results = append(results, str[beg:end])
+		}
+		beg = match[1]
+	}
+	if end != len(str) {
+		results = append(results, str[beg:])
+	}
+	return results
+}
+
+// allMatches returns the byte offsets of every match of the regex within the string, up to n matches (or every match
+// when n is negative), where the end offset is exclusive. Empty matches that immediately follow another match are
+// skipped, as ICU returns them while Go's regexp package does not. Returns nil if an error occurs, and an empty slice
+// if there are no matches.
+func (s StdlibCompat) allMatches(str string, n int) [][2]int {
+	if n == 0 {
+		return nil
+	}
+	if err := s.regex.SetMatchString(s.ctx, str); err != nil {
+		return nil
+	}
+	// The skipped matches would count against a limit, so we always retrieve every match
+	bounds, err := s.regex.FindAllRuneBounds(s.ctx, 1, 0)
+	if err != nil {
+		return nil
+	}
+	// The bounds are rune positions, so we record the byte offset of each rune, along with the end of the string
+	offsets := make([]int, 0, utf8.RuneCountInString(str)+1)
+	for i := range str {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(str))
+
+	matches := make([][2]int, 0, len(bounds))
+	prevEnd := -1
+	for _, bound := range bounds {
+		if n > 0 && len(matches) == n {
+			break
+		}
+		start, end := offsets[bound.Start-1], offsets[bound.End-1]
+		if start == end && start == prevEnd {
+			continue
+		}
+		matches = append(matches, [2]int{start, end})
+		prevEnd = end
+	}
+	return matches
+}
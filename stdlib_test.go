@@ -0,0 +1,77 @@
+// Copyright 2024 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regex
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsStdlib(t *testing.T) {
+	ctx := context.Background()
+	// These mirror the examples from Go's regexp package, and are compared against the standard library directly
+	tests := []struct {
+		pattern string
+		check   func(t *testing.T, re StdlibCompat, std *regexp.Regexp)
+	}{
+		{`foo.?`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			require.Equal(t, std.FindString("seafood fool"), re.FindString("seafood fool"))
+			require.Equal(t, std.FindString("meat"), re.FindString("meat"))
+			require.Equal(t, "food", re.FindString("seafood fool"))
+		}},
+		{`a(x*)b(y|z)c`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			require.Equal(t, std.FindStringSubmatch("-axxxbyc-"), re.FindStringSubmatch("-axxxbyc-"))
+			require.Equal(t, std.FindStringSubmatch("-abzc-"), re.FindStringSubmatch("-abzc-"))
+			require.Nil(t, re.FindStringSubmatch("-abc-"))
+		}},
+		{`a.`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			for _, n := range []int{-1, 0, 1, 2, 10} {
+				require.Equal(t, std.FindAllString("paranormal", n), re.FindAllString("paranormal", n), n)
+			}
+			require.Nil(t, re.FindAllString("none", -1))
+		}},
+		{`a(x*)b`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			for _, repl := range []string{"T", "$1", "<$1>"} {
+				require.Equal(t, std.ReplaceAllString("-ab-axxb-", repl), re.ReplaceAllString("-ab-axxb-", repl), repl)
+			}
+		}},
+		{`^[a-z]+\[[0-9]+\]$`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			for _, str := range []string{"adam[23]", "eve[7]", "Job[48]", "snakey"} {
+				require.Equal(t, std.MatchString(str), re.MatchString(str), str)
+			}
+		}},
+		{`a*`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			require.Equal(t, std.Split("abaabaccadaaae", 5), re.Split("abaabaccadaaae", 5))
+			require.Equal(t, []string{"", "b", "b", "c", "cadaaae"}, re.Split("abaabaccadaaae", 5))
+		}},
+		{`,\s*`, func(t *testing.T, re StdlibCompat, std *regexp.Regexp) {
+			for _, n := range []int{-1, 0, 1, 2} {
+				require.Equal(t, std.Split("1, 2,3 ,é,", n), re.Split("1, 2,3 ,é,", n), n)
+			}
+			require.Equal(t, std.Split("", -1), re.Split("", -1))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			regex, err := CompileFrom(test.pattern, RegexFlags_None)
+			require.NoError(t, err)
+			defer regex.Close()
+			test.check(t, regex.AsStdlib(ctx), regexp.MustCompile(test.pattern))
+		})
+	}
+}